@@ -20,10 +20,42 @@ type Config struct {
 	EmailImapPort        int    `ini:"imap_port"`
 	EmailSmtpHost        string `ini:"smtp_host"`
 	EmailSmtpPort        int    `ini:"smtp_port"`
+	EmailVerifyDKIM      bool   `ini:"verify_dkim"`
+	EmailReplyQuote      string `ini:"reply_quote"`
+	EmailQuoteFiles      bool   `ini:"quote_attachments"`
+	EmailUndoSend        int    `ini:"undo_send"`
+	EmailSnoozeFolder    string `ini:"snooze_folder"`
 	TelegramToken        string `ini:"token"`
 	TelegramRecipientId  int64  `ini:"recipient_id"`
+	TelegramZipFiles     int    `ini:"zip_attachments"`
+	TelegramOnDemand     bool   `ini:"attachments_on_demand"`
+	TelegramDraftMode    bool   `ini:"draft_mode"`
+	TelegramTimeZone     string `ini:"timezone"`
 	OpenAIToken          string `ini:"token"`
 	CheckIntervalSeconds int    `ini:"check_interval_seconds"`
+
+	OpenAIModel           string            `ini:"model"`
+	OpenAILanguage        string            `ini:"language"`
+	OpenAITokenBudget     int               `ini:"token_budget"`
+	OpenAIStructured      bool              `ini:"structured_output"`
+	OpenAIExtractEvents   bool              `ini:"extract_events"`
+	OpenAIPromptPrice     float64           `ini:"prompt_price"`
+	OpenAICompletionPrice float64           `ini:"completion_price"`
+	OpenAIMonthlyBudget   float64           `ini:"monthly_budget"`
+	OpenAIRedact          []string          `ini:"redact"`
+	OpenAIRedactPatterns  map[string]string `ini:"-"`
+	OpenAINeverSenders    []string          `ini:"never_send_senders"`
+
+	PGPPrivateKey  string `ini:"pgp_private_key"`
+	PGPPublicKeys  string `ini:"pgp_public_keys"`
+	SMIMECert      string `ini:"smime_cert"`
+	SMIMEKey       string `ini:"smime_key"`
+	SMIMERoots     string `ini:"smime_roots"`
+	SignReplies    bool   `ini:"sign_replies"`
+	EncryptReplies bool   `ini:"encrypt_replies"`
+	AIEncrypted    bool   `ini:"ai_encrypted"`
+
+	Identities []Identity `ini:"-"`
 }
 
 func LoadConfig(fp string) (*Config, error) {
@@ -69,6 +101,13 @@ func LoadConfig(fp string) (*Config, error) {
 		}
 	}
 
+	// Parse attachment options of telegram section (optional)
+
+	cfg.TelegramZipFiles, _ = cf.Section("telegram").Key("zip_attachments").Int()
+	cfg.TelegramOnDemand = cf.Section("telegram").Key("attachments_on_demand").MustBool(false)
+	cfg.TelegramDraftMode = cf.Section("telegram").Key("draft_mode").MustBool(false)
+	cfg.TelegramTimeZone = cf.Section("telegram").Key("timezone").String()
+
 	// Parse openai section (optional)
 
 	ai, err := cf.GetSection("openai")
@@ -76,6 +115,75 @@ func LoadConfig(fp string) (*Config, error) {
 		if t, err := ai.GetKey("token"); err == nil {
 			cfg.OpenAIToken = t.String()
 		}
+		cfg.OpenAIModel = ai.Key("model").String()
+		cfg.OpenAILanguage = strings.ToLower(ai.Key("language").String())
+		if ai.HasKey("token_budget") {
+			if cfg.OpenAITokenBudget, err = ai.Key("token_budget").Int(); err != nil || cfg.OpenAITokenBudget <= 0 {
+				return nil, fmt.Errorf("[openai] token_budget must be a positive number of tokens")
+			}
+		}
+		cfg.OpenAIStructured = ai.Key("structured_output").MustBool(true)
+		cfg.OpenAIExtractEvents = ai.Key("extract_events").MustBool(false)
+		cfg.OpenAIPromptPrice, _ = ai.Key("prompt_price").Float64()
+		cfg.OpenAICompletionPrice, _ = ai.Key("completion_price").Float64()
+		cfg.OpenAIMonthlyBudget, _ = ai.Key("monthly_budget").Float64()
+		cfg.OpenAIRedact = ai.Key("redact").Strings(",")
+		cfg.OpenAINeverSenders = ai.Key("never_send_senders").Strings(",")
+	}
+
+	if cfg.OpenAIModel == "" {
+		cfg.OpenAIModel = "qwen/qwen3-coder"
+	}
+	if cfg.OpenAITokenBudget == 0 {
+		cfg.OpenAITokenBudget = 8000
+	}
+
+	// Parse token budgets section (optional), model = max input tokens
+
+	if tb, err := cf.GetSection("token_budgets"); err == nil && tb.HasKey(cfg.OpenAIModel) {
+		budget, err := tb.Key(cfg.OpenAIModel).Int()
+		if err != nil || budget <= 0 {
+			return nil, fmt.Errorf("[token_budgets] %s must be a positive number of tokens", cfg.OpenAIModel)
+		}
+		cfg.OpenAITokenBudget = budget
+	}
+
+	// Parse redact section (optional), every key is a custom pattern
+
+	cfg.OpenAIRedactPatterns = make(map[string]string)
+	if rs, err := cf.GetSection("redact"); err == nil {
+		for _, k := range rs.Keys() {
+			cfg.OpenAIRedactPatterns[k.Name()] = k.String()
+		}
+	}
+
+	// Parse crypto section (optional)
+
+	if cs, err := cf.GetSection("crypto"); err == nil {
+		cfg.PGPPrivateKey = cs.Key("pgp_private_key").String()
+		cfg.PGPPublicKeys = cs.Key("pgp_public_keys").String()
+		cfg.SMIMECert = cs.Key("smime_cert").String()
+		cfg.SMIMEKey = cs.Key("smime_key").String()
+		cfg.SMIMERoots = cs.Key("smime_roots").String()
+		cfg.SignReplies = cs.Key("sign_replies").MustBool(false)
+		cfg.EncryptReplies = cs.Key("encrypt_replies").MustBool(false)
+		cfg.AIEncrypted = cs.Key("ai_encrypted").MustBool(false)
+	}
+
+	// Parse identity sections (optional), [identity] is the account, [identity.<name>] are aliases
+
+	for _, section := range cf.Sections() {
+		name := section.Name()
+		if name != "identity" && !strings.HasPrefix(name, "identity.") {
+			continue
+		}
+		cfg.Identities = append(cfg.Identities, Identity{
+			Key:           strings.TrimPrefix(strings.TrimPrefix(name, "identity"), "."),
+			Name:          section.Key("name").String(),
+			Address:       section.Key("address").String(),
+			Signature:     readSignature(section.Key("signature").String()),
+			SignatureHTML: readSignature(section.Key("signature_html").String()),
+		})
 	}
 
 	// Parse email section
@@ -89,6 +197,12 @@ func LoadConfig(fp string) (*Config, error) {
 		cfg.EmailSmtpPort = 587
 	}
 
+	cfg.EmailVerifyDKIM = cf.Section("email").Key("verify_dkim").MustBool(false)
+	cfg.EmailReplyQuote = parseQuoteMode(cf.Section("email").Key("reply_quote").String())
+	cfg.EmailQuoteFiles = cf.Section("email").Key("quote_attachments").MustBool(false)
+	cfg.EmailUndoSend = cf.Section("email").Key("undo_send").MustInt(0)
+	cfg.EmailSnoozeFolder = cf.Section("email").Key("snooze_folder").String()
+
 	emailUsername := cf.Section("email").Key("username").String()
 	if emailUsername == "" {
 		emailUsername = readUsername(cfg.TelegramRecipientId)
@@ -217,3 +331,39 @@ func (cfg *Config) SetCred(email string, password string) {
 	cfg.updateHostIfNeeded(email)
 
 }
+
+// Get Set PGP passphrase
+
+func (cfg *Config) GetPassphrase() string {
+
+	rid := fmt.Sprint(cfg.TelegramRecipientId)
+	passphrase, err := keyring.Get("email2Telegram", rid+".pgp")
+	if err != nil {
+		decrypted, err := LoadAndDecrypt(rid, rid+".pgp")
+		if err != nil {
+			return ""
+		}
+		return decrypted["passphrase"]
+	}
+
+	return passphrase
+
+}
+
+func (cfg *Config) SetPassphrase(passphrase string) {
+
+	log.Println(au.Gray(12, "[CONFIG]"), au.Cyan("Storing PGP passphrase..."))
+	rid := fmt.Sprint(cfg.TelegramRecipientId)
+	err := keyring.Set("email2Telegram", rid+".pgp", passphrase)
+	if err != nil {
+		log.Printf(au.Gray(12, "[CONFIG]").String()+" "+au.Red("Failed to store PGP passphrase in keyring: %v").String(), err)
+		if err := EncryptAndSave(rid, rid+".pgp", map[string]string{"passphrase": passphrase}); err != nil {
+			log.Printf(au.Gray(12, "[CONFIG]").String()+" "+au.Red("Failed to store PGP passphrase in file: %v").String(), err)
+		} else {
+			log.Println(au.Gray(12, "[CONFIG]"), au.Green("PGP passphrase stored securely in file: "+rid+".pgp"))
+		}
+	} else {
+		log.Println(au.Gray(12, "[CONFIG]"), au.Green("PGP passphrase stored securely in keyring"))
+	}
+
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigTokenBudget(t *testing.T) {
+
+	base := "[telegram]\ntoken = x\nrecipient_id = 1\n[openai]\nmodel = m\n"
+	tests := []struct {
+		conf string
+		want int
+		err  string
+	}{
+		{base, 8000, ""},
+		{base + "token_budget = 3000\n", 3000, ""},
+		{base + "token_budget = 3000\n[token_budgets]\nm = 500\nother = 9\n", 500, ""},
+		{base + "token_budget = 0\n", 0, "token_budget"},
+		{base + "token_budget = -100\n", 0, "token_budget"},
+		{base + "[token_budgets]\nm = 0\n", 0, "[token_budgets] m"},
+	}
+	for _, tt := range tests {
+		fp := filepath.Join(t.TempDir(), "bot")
+		if err := os.WriteFile(fp+".conf", []byte(tt.conf), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfig(fp)
+		switch {
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%q: error = %v, want %q", tt.conf, err, tt.err)
+		case tt.err == "" && err != nil:
+			t.Errorf("%q: %v", tt.conf, err)
+		case tt.err == "" && cfg.OpenAITokenBudget != tt.want:
+			t.Errorf("%q: budget = %d, want %d", tt.conf, cfg.OpenAITokenBudget, tt.want)
+		}
+	}
+
+}
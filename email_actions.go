@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BrianLeishman/go-imap"
+)
+
+// Mailbox changes on INBOX messages, the caller must hold mu with idle stopped
+
+// UID MOVE (RFC 6851), COPY and delete on servers without it. The library's MoveEmail
+// takes the destination for the selected folder, so selectFolder would skip a real SELECT.
+
+func (ec *EmailClient) moveUID(uid int, folder string) error {
+
+	if err := ec.reconnectIfNeeded(); err != nil {
+		return err
+	}
+	if err := ec.selectFolder("INBOX"); err != nil {
+		return err
+	}
+
+	return ec.moveSelectedUID(uid, folder)
+}
+
+func (ec *EmailClient) moveSelectedUID(uid int, folder string) error {
+
+	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Cyan("Moving UID %d from %s to %s").String(), uid, ec.imap.Folder, folder)
+	quoted := `"` + imap.AddSlashes.Replace(folder) + `"`
+	if ec.hasCapability("MOVE") {
+		_, err := ec.imap.Exec(fmt.Sprintf("UID MOVE %d %s", uid, quoted), true, 0, nil)
+		if err == nil {
+			return nil
+		}
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("UID MOVE of %d failed, copying instead: %v").String(), uid, err)
+
+		// The library drops the connection after a failed command, reconnecting selects the folder again
+
+		if err := ec.reconnectIfNeeded(); err != nil {
+			return err
+		}
+	}
+	if _, err := ec.imap.Exec(fmt.Sprintf("UID COPY %d %s", uid, quoted), true, 0, nil); err != nil {
+		return err
+	}
+	if err := ec.imap.DeleteEmail(uid); err != nil {
+		return err
+	}
+
+	return ec.expungeUIDs(uid)
+}
+
+// Removes only the given messages, a bare EXPUNGE would also take messages another client
+// flagged \Deleted and still means to restore. Without UIDPLUS they stay flagged.
+
+func (ec *EmailClient) expungeUIDs(uids ...int) error {
+
+	if !ec.hasCapability("UIDPLUS") {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Server has no UIDPLUS, UIDs %v stay flagged as deleted").String(), uids)
+		return nil
+	}
+	set := make([]string, len(uids))
+	for i, uid := range uids {
+		set[i] = strconv.Itoa(uid)
+	}
+	_, err := ec.imap.Exec("UID EXPUNGE "+strings.Join(set, ","), false, 0, nil)
+
+	return err
+}
+
+// Creates the folder when the server does not list it
+
+func (ec *EmailClient) ensureFolder(folder string) error {
+
+	folders, err := ec.imap.GetFolders()
+	if err != nil {
+		return err
+	}
+	for _, f := range folders {
+		if f == folder {
+			return nil
+		}
+	}
+	if _, err := ec.imap.Exec(`CREATE "`+imap.AddSlashes.Replace(folder)+`"`, false, 0, nil); err != nil {
+		return err
+	}
+	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Green("Created folder %s").String(), folder)
+
+	return nil
+}
+
+// UID of a message in a folder by its Message-ID, the folder stays selected
+
+func (ec *EmailClient) findUID(folder string, messageID string) (int, error) {
+
+	if err := ec.reconnectIfNeeded(); err != nil {
+		return 0, err
+	}
+	if err := ec.selectFolder(folder); err != nil {
+		return 0, err
+	}
+	uids, err := ec.imap.GetUIDs(`HEADER Message-ID "` + imap.AddSlashes.Replace(messageID) + `"`)
+	if err != nil {
+		return 0, err
+	}
+	if len(uids) == 0 {
+		return 0, fmt.Errorf("no mail in %s with Message-ID %s", folder, messageID)
+	}
+
+	return uids[len(uids)-1], nil
+}
+
+// Flags
+
+func (ec *EmailClient) storeFlag(uid int, flag string, on bool) error {
+
+	if err := ec.reconnectIfNeeded(); err != nil {
+		return err
+	}
+	if err := ec.selectFolder("INBOX"); err != nil {
+		return err
+	}
+	sign := "+"
+	if !on {
+		sign = "-"
+	}
+	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Cyan("Setting %s%s on UID %d").String(), sign, flag, uid)
+	_, err := ec.imap.Exec(fmt.Sprintf("UID STORE %d %sFLAGS.SILENT (%s)", uid, sign, flag), false, imap.RetryCount, nil)
+
+	return err
+}
+
+// Flags of several INBOX messages in one FETCH, UIDs missing from the map may be gone from INBOX
+
+var reFetchUID = regexp.MustCompile(`(?i)\bUID (\d+)`)
+var reFetchFlags = regexp.MustCompile(`(?i)\bFLAGS \(([^)]*)\)`)
+
+func (ec *EmailClient) FetchFlags(uids []int) (map[int][]string, error) {
+
+	if err := ec.reconnectIfNeeded(); err != nil {
+		return nil, err
+	}
+	if err := ec.selectFolder("INBOX"); err != nil {
+		return nil, err
+	}
+	set := make([]string, len(uids))
+	for i, uid := range uids {
+		set[i] = strconv.Itoa(uid)
+	}
+	r, err := ec.imap.Exec("UID FETCH "+strings.Join(set, ",")+" (UID FLAGS)", true, imap.RetryCount, nil)
+	if err != nil {
+		return nil, err
+	}
+	flags := make(map[int][]string)
+	for _, line := range strings.Split(r, "\n") {
+		u, f := reFetchUID.FindStringSubmatch(line), reFetchFlags.FindStringSubmatch(line)
+		if u == nil || f == nil {
+			continue
+		}
+		uid, _ := strconv.Atoi(u[1])
+		flags[uid] = strings.Fields(f[1])
+	}
+
+	return flags, nil
+}
+
+// Which of the UIDs are still in INBOX, a FETCH answer can miss messages that exist
+
+func (ec *EmailClient) ExistingUIDs(uids []int) (map[int]bool, error) {
+
+	if err := ec.reconnectIfNeeded(); err != nil {
+		return nil, err
+	}
+	if err := ec.selectFolder("INBOX"); err != nil {
+		return nil, err
+	}
+	set := make([]string, len(uids))
+	for i, uid := range uids {
+		set[i] = strconv.Itoa(uid)
+	}
+	found, err := ec.imap.GetUIDs("UID " + strings.Join(set, ","))
+	if err != nil {
+		return nil, err
+	}
+	exist := make(map[int]bool, len(found))
+	for _, uid := range found {
+		exist[uid] = true
+	}
+
+	return exist, nil
+}
+
+// Moves
+
+func (ec *EmailClient) Archive(uid int) (string, error) {
+
+	folder := ec.specialFolder(`\Archive`, "Archive")
+	if err := ec.ensureFolder(folder); err != nil {
+		return folder, err
+	}
+
+	return folder, ec.moveUID(uid, folder)
+}
+
+func (ec *EmailClient) Trash(uid int) (string, error) {
+
+	folder := ec.specialFolder(`\Trash`, "Trash")
+	if err := ec.ensureFolder(folder); err != nil {
+		return folder, err
+	}
+
+	return folder, ec.moveUID(uid, folder)
+}
+
+// Folders to move emails to, INBOX and folders that cannot hold emails aside
+
+func (ec *EmailClient) Folders() ([]string, error) {
+
+	if err := ec.reconnectIfNeeded(); err != nil {
+		return nil, err
+	}
+	var list []string
+	seen := make(map[string]bool)
+	_, err := ec.imap.Exec(`LIST "" "*"`, false, imap.RetryCount, func(line []byte) error {
+		attrs, name, ok := parseListLine(line)
+		if !ok || seen[name] || strings.EqualFold(name, "INBOX") {
+			return nil
+		}
+		for _, a := range attrs {
+			if strings.EqualFold(a, `\Noselect`) || strings.EqualFold(a, `\NonExistent`) {
+				return nil
+			}
+		}
+		seen[name] = true
+		list = append(list, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(list)
+
+	return list, nil
+}
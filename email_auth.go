@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/mail"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// SPF / DKIM / DMARC verdicts, empty if the receiving server did not report them
+
+type AuthResults struct {
+	SPF       string
+	DKIM      string
+	DMARC     string
+	LocalDKIM bool
+}
+
+// Only the topmost Authentication-Results is trusted, it is added by our own server
+
+func parseAuthResults(headers []rawHeader) AuthResults {
+
+	var a AuthResults
+	values := headerValues(headers, "Authentication-Results")
+	if len(values) == 0 {
+		return a
+	}
+	_, results, err := authres.Parse(values[0])
+	if err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to parse Authentication-Results: %v").String(), err)
+		return a
+	}
+	for _, r := range results {
+		switch r := r.(type) {
+		case *authres.SPFResult:
+			a.SPF = string(r.Value)
+		case *authres.DKIMResult:
+			if a.DKIM != string(authres.ResultPass) {
+				a.DKIM = string(r.Value)
+			}
+		case *authres.DMARCResult:
+			a.DMARC = string(r.Value)
+		}
+	}
+
+	return a
+}
+
+// Local DKIM check, looks up the signer keys in DNS
+
+func verifyDKIM(raw []byte) string {
+
+	verifications, err := dkim.Verify(bytes.NewReader(raw))
+	if err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to verify DKIM: %v").String(), err)
+		return string(authres.ResultTempError)
+	}
+	if len(verifications) == 0 {
+		return string(authres.ResultNone)
+	}
+	for _, v := range verifications {
+		if v.Err == nil {
+			return string(authres.ResultPass)
+		}
+	}
+
+	return string(authres.ResultFail)
+}
+
+func (a AuthResults) Known() bool {
+
+	return a.SPF != "" || a.DKIM != "" || a.DMARC != ""
+}
+
+func (a AuthResults) Passed() bool {
+
+	pass := string(authres.ResultPass)
+	if a.DMARC != "" && a.DMARC != string(authres.ResultNone) {
+		return a.DMARC == pass
+	}
+
+	return a.DKIM == pass || a.SPF == pass
+}
+
+func (a AuthResults) Badge() string {
+
+	if !a.Known() {
+		return ""
+	}
+	var verdicts []string
+	for _, v := range []struct{ name, value string }{{"SPF", a.SPF}, {"DKIM", a.DKIM}, {"DMARC", a.DMARC}} {
+		if v.value == "" {
+			continue
+		}
+		if v.name == "DKIM" && a.LocalDKIM {
+			v.value += ", local"
+		}
+		verdicts = append(verdicts, v.name+": "+v.value)
+	}
+	badge := "✅ "
+	if !a.Passed() {
+		badge = "⚠️ "
+	}
+
+	return badge + "<i>" + strings.Join(verdicts, " · ") + "</i>"
+}
+
+// Display names of known contacts, learned from authenticated senders and our own recipients
+
+type Contacts struct {
+	mu    sync.Mutex
+	key   string
+	file  string
+	names map[string]string
+}
+
+func NewContacts(recipientID int64) *Contacts {
+
+	rid := fmt.Sprint(recipientID)
+	names, err := LoadAndDecrypt(rid, rid+".con")
+	if err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to load contacts: %v").String(), err)
+		names = make(map[string]string)
+	}
+
+	return &Contacts{key: rid, file: rid + ".con", names: names}
+}
+
+func (c *Contacts) Learn(name string, address string) {
+
+	name = normalizeDisplayName(name)
+	if c == nil || name == "" || address == "" {
+		return
+	}
+	address = strings.ToLower(address)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var addresses []string
+	json.Unmarshal([]byte(c.names[name]), &addresses)
+	for _, a := range addresses {
+		if a == address {
+			return
+		}
+	}
+	raw, _ := json.Marshal(append(addresses, address))
+	c.names[name] = string(raw)
+	if err := EncryptAndSave(c.key, c.file, c.names); err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to save contacts: %v").String(), err)
+	}
+
+}
+
+// Known address the display name belongs to, if the sender domain differs from all of them
+
+func (c *Contacts) Impersonated(name string, address string) string {
+
+	name = normalizeDisplayName(name)
+	if c == nil || name == "" {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var addresses []string
+	json.Unmarshal([]byte(c.names[name]), &addresses)
+	domain := addressDomain(address)
+	for _, a := range addresses {
+		if addressDomain(a) == domain {
+			return ""
+		}
+	}
+	if len(addresses) > 0 {
+		return addresses[0]
+	}
+
+	return ""
+}
+
+// Warning text if the From display name pretends to be someone else
+
+func spoofingWarning(contacts *Contacts, name string, address string) string {
+
+	// Display name that is itself an address of another domain
+
+	if a, err := mail.ParseAddress(strings.Trim(name, `"' `)); err == nil && addressDomain(a.Address) != addressDomain(address) {
+		return fmt.Sprintf("⚠️ <b>Display name shows %s, but the email came from %s</b>", html.EscapeString(a.Address), html.EscapeString(address))
+	}
+	if known := contacts.Impersonated(name, address); known != "" {
+		return fmt.Sprintf("⚠️ <b>%s is a known contact at %s, but this email came from %s</b>", html.EscapeString(name), html.EscapeString(known), html.EscapeString(address))
+	}
+
+	return ""
+}
+
+func normalizeDisplayName(name string) string {
+
+	return strings.ToLower(strings.Join(strings.Fields(strings.Trim(name, `"' `)), " "))
+}
+
+func addressDomain(address string) string {
+
+	_, domain, _ := strings.Cut(strings.ToLower(address), "@")
+
+	return domain
+}
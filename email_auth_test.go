@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestParseAuthResults(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		headers []rawHeader
+		want    AuthResults
+	}{
+		{"none", nil, AuthResults{}},
+		{
+			"all pass",
+			[]rawHeader{{Name: "Authentication-Results", Value: "mx.example.com; spf=pass smtp.mailfrom=a@example.org; dkim=pass header.d=example.org; dmarc=pass header.from=example.org"}},
+			AuthResults{SPF: "pass", DKIM: "pass", DMARC: "pass"},
+		},
+		{
+			"one good signature is enough",
+			[]rawHeader{{Name: "Authentication-Results", Value: "mx.example.com; dkim=pass header.d=example.org; dkim=fail header.d=other.org"}},
+			AuthResults{DKIM: "pass"},
+		},
+		{
+			"failures",
+			[]rawHeader{{Name: "Authentication-Results", Value: "mx.example.com; spf=softfail smtp.mailfrom=a@example.org; dkim=none; dmarc=fail header.from=example.org"}},
+			AuthResults{SPF: "softfail", DKIM: "none", DMARC: "fail"},
+		},
+		{
+			"only the topmost header counts",
+			[]rawHeader{
+				{Name: "Authentication-Results", Value: "mx.example.com; spf=fail smtp.mailfrom=a@example.org"},
+				{Name: "Authentication-Results", Value: "forged.example.net; spf=pass smtp.mailfrom=a@example.org"},
+			},
+			AuthResults{SPF: "fail"},
+		},
+		{
+			"garbage",
+			[]rawHeader{{Name: "Authentication-Results", Value: ";;;"}},
+			AuthResults{},
+		},
+	}
+	for _, tt := range tests {
+		if got := parseAuthResults(tt.headers); got != tt.want {
+			t.Errorf("%s: parseAuthResults = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+}
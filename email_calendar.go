@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CalendarEvent struct {
+	UID           string
+	Method        string
+	Sequence      int
+	Summary       string
+	Location      string
+	Description   string
+	Organizer     string
+	OrganizerName string
+	Start         time.Time
+	End           time.Time
+	AllDay        bool
+
+	// Original property lines, echoed back in iTIP replies
+
+	dtstart string
+	dtend   string
+}
+
+type icsProperty struct {
+	name   string
+	params map[string]string
+	value  string
+	line   string
+}
+
+// ICS parsing
+
+func parseICS(data string, method string) []CalendarEvent {
+
+	if method == "" {
+		method = "PUBLISH"
+	}
+	var events []CalendarEvent
+	var ev *CalendarEvent
+	for _, p := range unfoldICS(data) {
+		switch {
+		case p.name == "METHOD" && ev == nil:
+			method = strings.ToUpper(p.value)
+		case p.name == "BEGIN" && strings.EqualFold(p.value, "VEVENT"):
+			ev = &CalendarEvent{Method: strings.ToUpper(method)}
+		case p.name == "END" && strings.EqualFold(p.value, "VEVENT"):
+			if ev != nil && !ev.Start.IsZero() {
+				events = append(events, *ev)
+			}
+			ev = nil
+		case ev == nil:
+			continue
+		case p.name == "UID":
+			ev.UID = p.value
+		case p.name == "SEQUENCE":
+			ev.Sequence, _ = strconv.Atoi(p.value)
+		case p.name == "SUMMARY":
+			ev.Summary = unescapeICS(p.value)
+		case p.name == "LOCATION":
+			ev.Location = unescapeICS(p.value)
+		case p.name == "DESCRIPTION":
+			ev.Description = unescapeICS(p.value)
+		case p.name == "ORGANIZER":
+			ev.Organizer = strings.TrimPrefix(strings.TrimPrefix(p.value, "mailto:"), "MAILTO:")
+			ev.OrganizerName = strings.Trim(p.params["CN"], `"`)
+		case p.name == "DTSTART":
+			ev.Start, ev.AllDay = parseICSTime(p)
+			ev.dtstart = p.line
+		case p.name == "DTEND":
+			ev.End, _ = parseICSTime(p)
+			ev.dtend = p.line
+		}
+	}
+
+	return events
+}
+
+func unfoldICS(data string) []icsProperty {
+
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\n ", "")
+	data = strings.ReplaceAll(data, "\n\t", "")
+
+	var props []icsProperty
+	for _, line := range strings.Split(data, "\n") {
+		head, value, ok := cutUnquoted(line, ':')
+		if !ok {
+			continue
+		}
+		var parts []string
+		for rest, more := head, true; more; {
+			var part string
+			part, rest, more = cutUnquoted(rest, ';')
+			parts = append(parts, part)
+		}
+		p := icsProperty{
+			name:   strings.ToUpper(strings.TrimSpace(parts[0])),
+			params: make(map[string]string),
+			value:  strings.TrimSpace(value),
+			line:   strings.TrimSpace(line),
+		}
+		for _, param := range parts[1:] {
+			if k, v, ok := strings.Cut(param, "="); ok {
+				p.params[strings.ToUpper(k)] = v
+			}
+		}
+		props = append(props, p)
+	}
+
+	return props
+}
+
+// Separators inside quoted parameter values, like CN="Doe; John", do not count
+
+func cutUnquoted(s string, sep byte) (string, string, bool) {
+
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			return s[:i], s[i+1:], true
+		}
+	}
+
+	return s, "", false
+}
+
+func parseICSTime(p icsProperty) (time.Time, bool) {
+
+	if p.params["VALUE"] == "DATE" || len(p.value) == 8 {
+		t, err := time.ParseInLocation("20060102", p.value, time.Local)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return t, true
+	}
+	if strings.HasSuffix(p.value, "Z") {
+		t, _ := time.Parse("20060102T150405Z", p.value)
+		return t.Local(), false
+	}
+	loc := time.Local
+	if tzid := strings.Trim(p.params["TZID"], `"`); tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	t, _ := time.ParseInLocation("20060102T150405", p.value, loc)
+
+	return t.Local(), false
+}
+
+func unescapeICS(s string) string {
+
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(s)
+}
+
+func escapeICS(s string) string {
+
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, ",", `\,`, ";", `\;`).Replace(s)
+}
+
+// Events suggested by AI from the email prose, times in ISO 8601
+
+func parseAIEvents(list []AIEvent) []CalendarEvent {
+
+	var events []CalendarEvent
+	for _, e := range list {
+		start, allDay, ok := parseISOTime(e.Start)
+		if !ok || e.Title == "" {
+			continue
+		}
+		end, _, _ := parseISOTime(e.End)
+		if allDay && end.IsZero() {
+			end = start.AddDate(0, 0, 1)
+		}
+		events = append(events, CalendarEvent{
+			Summary:  e.Title,
+			Location: e.Location,
+			Start:    start,
+			End:      end,
+			AllDay:   allDay,
+		})
+	}
+
+	return events
+}
+
+func parseISOTime(s string) (time.Time, bool, bool) {
+
+	s = strings.TrimSpace(s)
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, true, true
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.Local(), false, true
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, false, true
+		}
+	}
+
+	return time.Time{}, false, false
+}
+
+// ICS building
+
+func buildICSReply(ev CalendarEvent, attendee string, partstat string) string {
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Email2Telegram//EN",
+		"METHOD:REPLY",
+		"BEGIN:VEVENT",
+		"UID:" + ev.UID,
+		"SEQUENCE:" + strconv.Itoa(ev.Sequence),
+		"DTSTAMP:" + time.Now().UTC().Format("20060102T150405Z"),
+		ev.dtstart,
+	}
+	if ev.dtend != "" {
+		lines = append(lines, ev.dtend)
+	}
+	lines = append(lines,
+		"ORGANIZER:mailto:"+ev.Organizer,
+		"ATTENDEE;PARTSTAT="+partstat+":mailto:"+attendee,
+		"SUMMARY:"+escapeICS(ev.Summary),
+		"END:VEVENT",
+		"END:VCALENDAR",
+	)
+
+	return foldICS(lines)
+}
+
+func buildICSEvent(ev CalendarEvent) string {
+
+	uid := ev.UID
+	if uid == "" {
+		uid = fmt.Sprintf("%d@email2telegram", time.Now().UnixNano())
+	}
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Email2Telegram//EN",
+		"METHOD:PUBLISH",
+		"BEGIN:VEVENT",
+		"UID:" + uid,
+		"DTSTAMP:" + time.Now().UTC().Format("20060102T150405Z"),
+	}
+	if ev.AllDay {
+		lines = append(lines, "DTSTART;VALUE=DATE:"+ev.Start.Format("20060102"))
+		if !ev.End.IsZero() {
+			lines = append(lines, "DTEND;VALUE=DATE:"+ev.End.Format("20060102"))
+		}
+	} else {
+		lines = append(lines, "DTSTART:"+ev.Start.UTC().Format("20060102T150405Z"))
+		if !ev.End.IsZero() {
+			lines = append(lines, "DTEND:"+ev.End.UTC().Format("20060102T150405Z"))
+		}
+	}
+	lines = append(lines, "SUMMARY:"+escapeICS(ev.Summary))
+	if ev.Location != "" {
+		lines = append(lines, "LOCATION:"+escapeICS(ev.Location))
+	}
+	if ev.Description != "" {
+		lines = append(lines, "DESCRIPTION:"+escapeICS(ev.Description))
+	}
+	lines = append(lines, "END:VEVENT", "END:VCALENDAR")
+
+	return foldICS(lines)
+}
+
+// Lines longer than 75 octets are folded with CRLF + space, the space counts in the next line
+
+func foldICS(lines []string) string {
+
+	var b strings.Builder
+	for _, line := range lines {
+		for limit := 75; len(line) > limit; limit = 74 {
+			cut := limit
+			for cut > 0 && (line[cut]&0xC0) == 0x80 {
+				cut--
+			}
+			b.WriteString(line[:cut] + "\r\n ")
+			line = line[cut:]
+		}
+		b.WriteString(line + "\r\n")
+	}
+
+	return b.String()
+}
+
+// Telegram card
+
+func eventCard(ev CalendarEvent) string {
+
+	card := "📅 <b>" + html.EscapeString(ev.Summary) + "</b>\n🕒 "
+	if ev.AllDay {
+		card += ev.Start.Format("Mon, 02 Jan 2006")
+		if !ev.End.IsZero() && ev.End.Sub(ev.Start) > 24*time.Hour {
+			card += " – " + ev.End.Add(-24*time.Hour).Format("Mon, 02 Jan 2006")
+		}
+	} else {
+		card += ev.Start.Format("Mon, 02 Jan 2006 15:04")
+		if !ev.End.IsZero() {
+			if ev.End.YearDay() == ev.Start.YearDay() && ev.End.Year() == ev.Start.Year() {
+				card += "–" + ev.End.Format("15:04")
+			} else {
+				card += " – " + ev.End.Format("Mon, 02 Jan 2006 15:04")
+			}
+		}
+		card += " " + ev.Start.Format("MST")
+	}
+	if ev.Location != "" {
+		card += "\n📍 " + html.EscapeString(ev.Location)
+	}
+	if ev.Organizer != "" {
+		organizer := ev.Organizer
+		if ev.OrganizerName != "" {
+			organizer = ev.OrganizerName + " " + ev.Organizer
+		}
+		card += "\n👤 " + html.EscapeString(organizer)
+	}
+	if ev.Method == "CANCEL" {
+		card = "❌ <b>CANCELLED</b>\n" + card
+	}
+
+	return card
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+const testInvite = "BEGIN:VCALENDAR\r\n" +
+	"METHOD:REQUEST\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:first@example.com\r\n" +
+	"SEQUENCE:2\r\n" +
+	"SUMMARY:Quarterly review\\, Q3\r\n" +
+	"DESCRIPTION:Agenda:\\nnumbers\\; plans\r\n" +
+	"ORGANIZER;CN=\"Doe; John: CEO\":mailto:john@example.com\r\n" +
+	"DTSTART:20240115T100000Z\r\n" +
+	"DTEND:20240115T110000Z\r\n" +
+	"LOCATION:Room 1\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:second@example.com\r\n" +
+	"SUMMARY:All day event with a long title that the sender folded over two\r\n" +
+	"  lines\r\n" +
+	"DTSTART;VALUE=DATE:20240116\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:no-start@example.com\r\n" +
+	"SUMMARY:Dropped\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParseICS(t *testing.T) {
+
+	events := parseICS(testInvite, "")
+	if len(events) != 2 {
+		t.Fatalf("parseICS returned %d events, want 2", len(events))
+	}
+	first, second := events[0], events[1]
+	tests := []struct {
+		name string
+		got  any
+		want any
+	}{
+		{"method", first.Method, "REQUEST"},
+		{"uid", first.UID, "first@example.com"},
+		{"sequence", first.Sequence, 2},
+		{"summary", first.Summary, "Quarterly review, Q3"},
+		{"description", first.Description, "Agenda:\nnumbers; plans"},
+		{"organizer", first.Organizer, "john@example.com"},
+		{"organizer name", first.OrganizerName, "Doe; John: CEO"},
+		{"location", first.Location, "Room 1"},
+		{"start", first.Start.UTC(), time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)},
+		{"end", first.End.UTC(), time.Date(2024, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"all day", second.AllDay, true},
+		{"folded summary", second.Summary, "All day event with a long title that the sender folded over two lines"},
+		{"all day start", second.Start.Format("2006-01-02"), "2024-01-16"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+}
+
+func TestParseICSMethod(t *testing.T) {
+
+	ics := "BEGIN:VEVENT\nDTSTART:20240115T100000Z\nEND:VEVENT\n"
+	tests := []struct {
+		method string
+		want   string
+	}{
+		{"", "PUBLISH"},
+		{"request", "REQUEST"},
+		{"CANCEL", "CANCEL"},
+	}
+	for _, tt := range tests {
+		events := parseICS(ics, tt.method)
+		if len(events) != 1 || events[0].Method != tt.want {
+			t.Errorf("parseICS(method %q) = %+v, want method %s", tt.method, events, tt.want)
+		}
+	}
+
+}
+
+func TestFoldICS(t *testing.T) {
+
+	tests := []string{
+		"SUMMARY:short",
+		"DESCRIPTION:" + strings.Repeat("a", 200),
+		"DESCRIPTION:" + strings.Repeat("ж", 100),
+		"SUMMARY:" + strings.Repeat("x", 67),
+	}
+	for _, line := range tests {
+		folded := foldICS([]string{line})
+		if !strings.HasSuffix(folded, "\r\n") {
+			t.Errorf("foldICS(%q) does not end with CRLF", line)
+		}
+		for _, l := range strings.Split(strings.TrimSuffix(folded, "\r\n"), "\r\n") {
+			if len(l) > 75 {
+				t.Errorf("foldICS(%q) has a %d octet line", line, len(l))
+			}
+			if !utf8.ValidString(l) {
+				t.Errorf("foldICS(%q) split a UTF-8 sequence: %q", line, l)
+			}
+		}
+		props := unfoldICS(folded)
+		if len(props) != 1 || props[0].line != line {
+			t.Errorf("unfoldICS(foldICS(%q)) = %+v", line, props)
+		}
+	}
+
+}
+
+func TestICSEscapeRoundTrip(t *testing.T) {
+
+	for _, s := range []string{"plain", "a, b; c", "line\nnext", `back\slash`} {
+		if got := unescapeICS(escapeICS(s)); got != s {
+			t.Errorf("unescapeICS(escapeICS(%q)) = %q", s, got)
+		}
+	}
+
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jhillyerd/enmime"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// Parts are kept undecoded and decoded here, so text in a mislabelled charset can be detected
+
+var rawCharsetParser = enmime.NewParser(enmime.RawContent(true))
+
+func partContent(p *enmime.Part) []byte {
+
+	switch strings.ToLower(strings.TrimSpace(p.Header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		clean := strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) {
+				return -1
+			}
+			return r
+		}, string(p.Content))
+		if b, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(clean, "=")); err == nil {
+			return b
+		}
+	case "quoted-printable":
+		if b, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(p.Content))); err == nil {
+			return b
+		}
+	}
+
+	return p.Content
+}
+
+func charsetDecoder(label string) *encoding.Decoder {
+
+	label = strings.ToLower(strings.Trim(strings.TrimSpace(label), `"'`))
+	if label == "" {
+		return nil
+	}
+	if e, err := htmlindex.Get(label); err == nil && e != nil {
+		return e.NewDecoder()
+	}
+	if e, err := ianaindex.MIME.Encoding(label); err == nil && e != nil {
+		return e.NewDecoder()
+	}
+
+	return nil
+}
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+
+	dec := charsetDecoder(charset)
+	if dec == nil {
+		return nil, fmt.Errorf("unknown charset %s", charset)
+	}
+
+	return dec.Reader(input), nil
+}
+
+// Body text in UTF-8, the declared charset is checked against the content
+
+func decodeText(b []byte, declared string) string {
+
+	declared = strings.ToLower(strings.Trim(strings.TrimSpace(declared), `"'`))
+	switch {
+	case isISO2022JP(b):
+		declared = "iso-2022-jp"
+	case declared == "" || declared == "utf-8" || declared == "utf8" || declared == "us-ascii" || declared == "ascii":
+		if utf8.Valid(b) {
+			return string(b)
+		}
+		declared = detectCharset(b)
+	case isSingleByteCharset(declared) && utf8.Valid(b) && !isASCII(b):
+
+		// Multi-byte UTF-8 sequences almost never occur in single-byte text
+
+		return string(b)
+	case isSingleByteCharset(declared):
+		if cyrillic := detectCyrillic(b); cyrillic != "" {
+			declared = cyrillic
+		}
+	}
+	if dec := charsetDecoder(declared); dec != nil {
+		if s, err := dec.Bytes(b); err == nil {
+			return string(s)
+		}
+	}
+	if utf8.Valid(b) {
+		return string(b)
+	}
+
+	return decodeText(b, detectCharset(b))
+}
+
+func detectCharset(b []byte) string {
+
+	switch {
+	case isISO2022JP(b):
+		return "iso-2022-jp"
+	case utf8.Valid(b):
+		return "utf-8"
+	}
+	if cyrillic := detectCyrillic(b); cyrillic != "" {
+		return cyrillic
+	}
+
+	return "windows-1252"
+}
+
+func isASCII(b []byte) bool {
+
+	return !bytes.ContainsFunc(b, func(r rune) bool { return r >= utf8.RuneSelf })
+}
+
+func isISO2022JP(b []byte) bool {
+
+	return bytes.Contains(b, []byte("\x1b$B")) || bytes.Contains(b, []byte("\x1b$@")) || bytes.Contains(b, []byte("\x1b(J"))
+}
+
+func isSingleByteCharset(label string) bool {
+
+	return strings.HasPrefix(label, "iso-8859-") || strings.HasPrefix(label, "windows-125") || strings.HasPrefix(label, "cp125") || strings.HasPrefix(label, "koi8")
+}
+
+// KOI8-R read as Windows-1251 gives mostly capital letters and vice versa,
+// so the charset that gives mostly lowercase Cyrillic text wins
+
+func detectCyrillic(b []byte) string {
+
+	best, bestScore := "", 0.0
+	for _, charset := range []string{"windows-1251", "koi8-r"} {
+		s, err := charsetDecoder(charset).Bytes(b)
+		if err != nil {
+			continue
+		}
+		runes := []rune(string(s))
+		cyrillic, lower, mixed := 0, 0, 0
+		for i, r := range runes {
+			if !unicode.Is(unicode.Cyrillic, r) || !unicode.IsLetter(r) {
+				continue
+			}
+			cyrillic++
+			if unicode.IsLower(r) {
+				lower++
+			}
+			if (i > 0 && isLatinLetter(runes[i-1])) || (i+1 < len(runes) && isLatinLetter(runes[i+1])) {
+				mixed++
+			}
+		}
+
+		// Latin text with accented letters gives Cyrillic letters inside Latin words
+
+		if cyrillic == 0 || mixed*5 > cyrillic {
+			continue
+		}
+		if score := float64(lower) / float64(cyrillic); score > bestScore {
+			best, bestScore = charset, score
+		}
+	}
+	if bestScore < 0.6 {
+		return ""
+	}
+
+	return best
+}
+
+func isLatinLetter(r rune) bool {
+
+	return r < utf8.RuneSelf && unicode.IsLetter(r)
+}
+
+// Header value with raw 8-bit bytes and RFC 2047 words in any charset
+
+func decodeHeaderValue(v string) string {
+
+	if !utf8.ValidString(v) {
+		v = decodeText([]byte(v), "")
+	}
+	if decoded, err := headerDecoder.DecodeHeader(v); err == nil {
+		return decoded
+	}
+
+	return v
+}
+
+// Attachment file name, RFC 2231 parameters in any charset first
+
+func decodeFileName(p *enmime.Part) string {
+
+	for _, h := range []struct{ header, param string }{{"Content-Disposition", "filename"}, {"Content-Type", "name"}} {
+		if name := rfc2231Param(p.Header.Get(h.header), h.param); name != "" {
+			return name
+		}
+	}
+
+	return decodeHeaderValue(p.FileName)
+}
+
+// Extended (name*=charset'lang'value) and continued (name*0*=, name*1*=) parameters,
+// continuations are joined by their numbers whatever order they come in
+
+func rfc2231Param(header string, name string) string {
+
+	var charset string
+	sections := make(map[int][]byte)
+	for _, param := range strings.Split(header, ";") {
+		key, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !strings.HasPrefix(key, name+"*") {
+			continue
+		}
+		v = strings.Trim(strings.TrimSpace(v), `"`)
+		section := strings.TrimPrefix(key, name+"*")
+		extended := strings.HasSuffix(section, "*") || section == ""
+		n, err := strconv.Atoi(strings.TrimSuffix(section, "*"))
+		if section == "" {
+			n, err = 0, nil
+		}
+		if err != nil || n < 0 {
+			continue
+		}
+		if extended && n == 0 {
+			parts := strings.SplitN(v, "'", 3)
+			if len(parts) == 3 {
+				charset, v = parts[0], parts[2]
+			}
+		}
+		if extended {
+			if unescaped, err := url.PathUnescape(v); err == nil {
+				v = unescaped
+			}
+		}
+		sections[n] = []byte(v)
+	}
+	if len(sections) == 0 {
+		return ""
+	}
+	var value []byte
+	for n := 0; ; n++ {
+		v, ok := sections[n]
+		if !ok {
+			break
+		}
+		value = append(value, v...)
+	}
+
+	return decodeText(value, charset)
+}
+
+// Subject, addresses, body and file names decoded from the raw message, the IMAP library
+// trusts declared charsets and drops 8-bit headers
+
+func (d *ParsedEmailData) applyCharsets(env *enmime.Envelope, headers []rawHeader) {
+
+	if values := headerValues(headers, "Subject"); len(values) > 0 {
+		d.Subject = values[0]
+	}
+	for _, h := range headers {
+		switch {
+		case strings.EqualFold(h.Name, "From"):
+			if from := decodeAddresses(h.Raw); len(from) > 0 {
+				d.From = parseAddressList(from)
+				for _, address := range sortedKeys(from) {
+					d.FromAddress, d.FromName = address, from[address]
+					break
+				}
+			}
+		case strings.EqualFold(h.Name, "To"):
+			if to := decodeAddresses(h.Raw); len(to) > 0 {
+				d.To = parseAddressList(to)
+			}
+		}
+	}
+
+	if body := envelopeBody(env); body != "" {
+		d.TextBody = body
+	}
+
+	d.Attachments = make(map[string][]byte)
+	d.Parts = make(map[string]string)
+	d.Images = nil
+	d.addParts(env, 0, "")
+
+}
+
+// First text part that is not an attachment, HTML preferred
+
+func envelopeBody(env *enmime.Envelope) string {
+
+	for _, contentType := range []string{"text/html", "text/plain"} {
+		p := env.Root.DepthMatchFirst(func(p *enmime.Part) bool {
+			return p.ContentType == contentType && p.Disposition != "attachment"
+		})
+		if p == nil {
+			continue
+		}
+		text := decodeText(partContent(p), p.Charset)
+		if contentType == "text/html" {
+			return renderHTML(text)
+		}
+		return cleanTextLinks(text)
+	}
+
+	return ""
+}
+
+func decodeAddresses(raw string) map[string]string {
+
+	if !utf8.ValidString(raw) {
+		raw = decodeText([]byte(raw), "")
+	}
+	list, err := (&mail.AddressParser{WordDecoder: headerDecoder}).ParseList(raw)
+	if err != nil {
+		return nil
+	}
+	addresses := make(map[string]string)
+	for _, a := range list {
+		addresses[strings.ToLower(a.Address)] = a.Name
+	}
+
+	return addresses
+}
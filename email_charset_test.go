@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/BrianLeishman/go-imap"
+)
+
+const testRussian = "Привет! Встреча перенесена на завтра, в десять часов утра. Не забудьте отчёт."
+
+func readTestdata(t *testing.T, name string) []byte {
+
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestDetectCyrillic(t *testing.T) {
+
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"koi8r.txt", "koi8-r"},
+		{"cp1251.txt", "windows-1251"},
+	}
+	for _, tt := range tests {
+		if got := detectCyrillic(readTestdata(t, tt.file)); got != tt.want {
+			t.Errorf("detectCyrillic(%s) = %q, want %q", tt.file, got, tt.want)
+		}
+	}
+	if got := detectCyrillic([]byte("Caf\xe9 cr\xe8me br\xfbl\xe9e, d\xe9j\xe0 vu")); got != "" {
+		t.Errorf("detectCyrillic(Latin-1) = %q, want none", got)
+	}
+
+}
+
+func TestDecodeText(t *testing.T) {
+
+	koi8 := strings.ReplaceAll(testRussian, "ё", "е")
+	tests := []struct {
+		name     string
+		file     string
+		declared string
+		want     string
+	}{
+		{"koi8-r", "koi8r.txt", "koi8-r", koi8},
+		{"koi8-r labelled windows-1251", "koi8r.txt", "windows-1251", koi8},
+		{"koi8-r unlabelled", "koi8r.txt", "", koi8},
+		{"windows-1251 labelled koi8-r", "cp1251.txt", "koi8-r", testRussian},
+		{"windows-1251 labelled us-ascii", "cp1251.txt", "us-ascii", testRussian},
+		{"iso-2022-jp", "iso2022jp.txt", "iso-2022-jp", "こんにちは。会議は明日の十時からです。"},
+		{"iso-2022-jp labelled us-ascii", "iso2022jp.txt", "us-ascii", "こんにちは。会議は明日の十時からです。"},
+		{"utf-8 labelled windows-1251", "utf8.txt", "windows-1251", testRussian},
+		{"utf-8 labelled koi8-r", "utf8.txt", "\"KOI8-R\"", testRussian},
+		{"utf-8 labelled iso-8859-1", "utf8.txt", "iso-8859-1", testRussian},
+	}
+	for _, tt := range tests {
+		if got := decodeText(readTestdata(t, tt.file), tt.declared); got != tt.want {
+			t.Errorf("%s: decodeText = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+}
+
+func TestDecodeHeaderValue(t *testing.T) {
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"Plain subject", "Plain subject"},
+		{"\xce\xf2\xf7\xb8\xf2 \xe7\xe0 \xec\xe0\xf0\xf2", "Отчёт за март"},
+		{"=?koi8-r?B?7tXS18nL?=", "Нурвик"},
+		{"=?iso-2022-jp?B?GyRCJDMkcyRLJEEkTxsoQg==?=", "こんにちは"},
+		{"Re: =?utf-8?Q?caf=C3=A9?= menu", "Re: café menu"},
+	}
+	for _, tt := range tests {
+		if got := decodeHeaderValue(tt.in); got != tt.want {
+			t.Errorf("decodeHeaderValue(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+}
+
+func TestRFC2231Param(t *testing.T) {
+
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{`attachment; filename="report.pdf"`, ""},
+		{`attachment; filename*=utf-8''%D0%BE%D1%82%D1%87%D1%91%D1%82.pdf`, "отчёт.pdf"},
+		{`attachment; filename*=iso-8859-1'en'caf%E9.txt`, "café.txt"},
+		{`attachment; filename*0="long "; filename*1="name.txt"`, "long name.txt"},
+		{`attachment; filename*0*=utf-8''%D0%BE%D1%82; filename*1*=%D1%87%D1%91%D1%82.pdf`, "отчёт.pdf"},
+		{`attachment; filename*1*=%D1%87%D1%91%D1%82.pdf; filename*0*=utf-8''%D0%BE%D1%82`, "отчёт.pdf"},
+		{`attachment; FILENAME*=windows-1251''%CE%F2%F7%B8%F2.doc`, "Отчёт.doc"},
+	}
+	for _, tt := range tests {
+		if got := rfc2231Param(tt.header, "filename"); got != tt.want {
+			t.Errorf("rfc2231Param(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+
+}
+
+func TestParseEmailCharsets(t *testing.T) {
+
+	d := ParseEmail(&imap.Email{}, readTestdata(t, "raw_headers.eml"), 1)
+	if d.Subject != "Отчёт за март" {
+		t.Errorf("subject = %q", d.Subject)
+	}
+	if d.FromAddress != "ivan@example.com" || d.FromName != "Иван" {
+		t.Errorf("from = %q %q", d.FromAddress, d.FromName)
+	}
+	if !strings.Contains(d.TextBody, testRussian) {
+		t.Errorf("body = %q", d.TextBody)
+	}
+	if _, ok := d.Attachments["Отчёт за март.pdf"]; !ok {
+		t.Errorf("attachments = %v", d.AttachmentNames())
+	}
+
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"bufio"
-	"encoding/base64"
 	"fmt"
 	"html"
 	"log"
+	"mime"
 	"net/smtp"
 	"os"
+	"path"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -31,6 +33,20 @@ type EmailClient struct {
 
 	handler  *imap.IdleHandler
 	callback func()
+	folders  map[string]string
+	caps     map[string]bool
+
+	verifyDKIM       bool
+	contacts         *Contacts
+	crypto           *MailCrypto
+	replyQuote       string
+	quoteAttachments bool
+	identities       []Identity
+	outbox           *Outbox
+	scheduler        *Scheduler
+	snoozer          *Snoozer
+	snoozeFolder     string
+	flagsChanged     func()
 }
 
 // Lifecycle
@@ -62,16 +78,27 @@ func NewEmailClient(imapHost string, imapPort int, smtpHost string, smtpPort int
 			log.Println(au.Gray(12, "[EMAIL]").String()+" "+au.Green("New email arrived: %d").String(), event.MessageIndex)
 			callback()
 		},
-		OnExpunge: func(event imap.ExpungeEvent) {
-			log.Println(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Email expunged: %d").String(), event.MessageIndex)
-		},
-		OnFetch: func(event imap.FetchEvent) {
-			log.Println(au.Gray(12, "[EMAIL]").String()+" "+au.Blue("Email fetched: %d, UID: %d").String(), event.MessageIndex, event.UID)
-		},
+	}
+
+	// Flag changes and expunges carry sequence numbers only, so the Telegram side resyncs
+	// the UIDs it shows
+
+	ec := &EmailClient{}
+	idleHandler.OnExpunge = func(event imap.ExpungeEvent) {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Email expunged: %d").String(), event.MessageIndex)
+		if ec.flagsChanged != nil {
+			ec.flagsChanged()
+		}
+	}
+	idleHandler.OnFetch = func(event imap.FetchEvent) {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Blue("Email flags changed: %d, flags: %v").String(), event.MessageIndex, event.Flags)
+		if ec.flagsChanged != nil {
+			ec.flagsChanged()
+		}
 	}
 
 	log.Println(au.Gray(12, "[EMAIL]").String() + " " + au.Green(au.Bold("Email client initialized successfully")).String())
-	return &EmailClient{
+	*ec = EmailClient{
 		imap: c,
 
 		lastProcessedUID: uid,
@@ -85,7 +112,9 @@ func NewEmailClient(imapHost string, imapPort int, smtpHost string, smtpPort int
 
 		handler:  &idleHandler,
 		callback: callback,
-	}, nil
+	}
+
+	return ec, nil
 
 }
 
@@ -161,6 +190,136 @@ func (ec *EmailClient) FetchMail(uid int) (*imap.Email, error) {
 	return emails[int(uid)], nil
 }
 
+func (ec *EmailClient) FetchRawMail(uid int) ([]byte, error) {
+
+	return ec.fetchRawMailIn("INBOX", uid)
+}
+
+func (ec *EmailClient) fetchRawMailIn(folder string, uid int) ([]byte, error) {
+
+	// Reconnect if needed
+
+	if err := ec.reconnectIfNeeded(); err != nil {
+		return nil, err
+	}
+
+	// Fetch RFC 822 source
+
+	if err := ec.selectFolder(folder); err != nil {
+		return nil, err
+	}
+	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Cyan("Fetching raw email UID %d from %s").String(), uid, folder)
+	r, err := ec.imap.Exec(fmt.Sprintf("UID FETCH %d BODY.PEEK[]", uid), true, imap.RetryCount, nil)
+	if err != nil {
+		return nil, err
+	}
+	records, err := ec.imap.ParseFetchResponse(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, tks := range records {
+		for i, t := range tks {
+			if t.Type == imap.TLiteral && t.Str == "BODY[]" && i+1 < len(tks) {
+				return []byte(tks[i+1].Str), nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no raw mail in %s with uid: %d", folder, uid)
+}
+
+// One attachment by its part id, only that body section is downloaded
+
+func (ec *EmailClient) FetchPart(uid int, part string) (string, []byte, error) {
+
+	if err := ec.reconnectIfNeeded(); err != nil {
+		return "", nil, err
+	}
+	folder := "INBOX"
+	if err := ec.selectFolder(folder); err != nil {
+		return "", nil, err
+	}
+	section, file, tnef := strings.Cut(part, "#")
+	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Cyan("Fetching part %s of email UID %d from %s").String(), section, uid, folder)
+	r, err := ec.imap.Exec(fmt.Sprintf("UID FETCH %d (BODY.PEEK[%s.MIME] BODY.PEEK[%s])", uid, section, section), true, imap.RetryCount, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	records, err := ec.imap.ParseFetchResponse(r)
+	if err != nil {
+		return "", nil, err
+	}
+	var header, body string
+	for _, tks := range records {
+		for i := 0; i+1 < len(tks); i++ {
+			switch strings.ToUpper(tks[i].Str) {
+			case "BODY[" + section + ".MIME]":
+				header = tks[i+1].Str
+			case "BODY[" + section + "]":
+				body = tks[i+1].Str
+			}
+		}
+	}
+	if strings.TrimSpace(header) == "" {
+		return "", nil, fmt.Errorf("no part %s in email %d", section, uid)
+	}
+	p, err := rawCharsetParser.ReadParts(strings.NewReader(header + body))
+	if err != nil {
+		return "", nil, err
+	}
+	name, content := attachmentName(decodeFileName(p), p.ContentType), partContent(p)
+	if !tnef {
+		return name, content, nil
+	}
+
+	// File unpacked from winmail.dat
+
+	t, err := decodeTNEF(content)
+	if err != nil {
+		return "", nil, err
+	}
+	i, err := strconv.Atoi(file)
+	if err != nil || i < 0 || i >= len(t.Attachments) {
+		return "", nil, fmt.Errorf("no file %s in winmail.dat of email %d", file, uid)
+	}
+
+	return t.Attachments[i].Name, t.Attachments[i].Content, nil
+}
+
+// Envelope plus one body download, parsed the way the library's GetEmails does
+
+func (ec *EmailClient) FetchMailWithRaw(uid int) (*imap.Email, []byte, error) {
+
+	return ec.fetchMailWithRawIn("INBOX", uid)
+}
+
+func (ec *EmailClient) fetchMailWithRawIn(folder string, uid int) (*imap.Email, []byte, error) {
+
+	if err := ec.reconnectIfNeeded(); err != nil {
+		return nil, nil, err
+	}
+	if err := ec.selectFolder(folder); err != nil {
+		return nil, nil, err
+	}
+	overviews, err := ec.imap.GetOverviews(uid)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, ok := overviews[uid]
+	if !ok {
+		return nil, nil, fmt.Errorf("no mail in %s with uid: %d", folder, uid)
+	}
+	raw, err := ec.fetchRawMailIn(folder, uid)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := fillFromRaw(m, raw); err != nil {
+		return nil, nil, err
+	}
+
+	return m, raw, nil
+}
+
 func (ec *EmailClient) selectFolder(folder string) error {
 
 	if ec.imap.Folder != folder {
@@ -295,10 +454,24 @@ func saveLastProcessedUID(filePath string, uid int) error {
 
 func (ec *EmailClient) ReplyTo(uid int, message string, files []struct{ Url, Name string }) error {
 
+	out, err := ec.ComposeReply(uid, message, files)
+	if err != nil {
+		return err
+	}
+	if err := ec.Send(out); err != nil {
+		return err
+	}
+	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Green(au.Bold("Successfully sent reply to email %d")).String(), uid)
+
+	return nil
+}
+
+func (ec *EmailClient) ComposeReply(uid int, message string, files []struct{ Url, Name string }) (*OutgoingEmail, error) {
+
 	// Reconnect if needed
 
 	if err := ec.reconnectIfNeeded(); err != nil {
-		return fmt.Errorf("failed to reconnect: %w", err)
+		return nil, fmt.Errorf("failed to reconnect: %w", err)
 	}
 	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Cyan("Preparing reply to email UID %d").String(), uid)
 
@@ -306,20 +479,36 @@ func (ec *EmailClient) ReplyTo(uid int, message string, files []struct{ Url, Nam
 
 	m, err := ec.FetchMail(uid)
 	if err != nil {
-		return fmt.Errorf("error fetching email %d: %w", uid, err)
+		return nil, fmt.Errorf("error fetching email %d: %w", uid, err)
 	}
 
 	// Make new mail
 
-	var attachments string
-	if len(files) > 0 {
-		attachments += "<ul>"
-		for _, f := range files {
-			attachments += fmt.Sprintf(`<li><a href="%s">%s</a></li>`, f.Url, html.EscapeString(f.Name))
+	id := ec.replyIdentity(m.To, m.CC)
+	text, body := id.Sign(composeBody(message, files))
+
+	// Quote the original, a decrypted one only into a reply that gets encrypted too
+
+	var d *ParsedEmailData
+	var quoted map[string][]byte
+	encrypted := false
+	if ec.replyQuote != QuoteNone {
+		d = ec.parseOriginal(m, uid)
+		encrypted = d.Crypto != nil && d.Crypto.Encrypted
+		if encrypted && !ec.crypto.Encrypts() {
+			log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Not quoting encrypted email UID %d, the reply is not encrypted").String(), uid)
+			d, encrypted = nil, false
+		}
+	}
+	if d != nil {
+		text, body = quoteReply(text, body, d, ec.replyQuote)
+		if ec.quoteAttachments {
+			quoted = d.Attachments
+			for _, img := range d.Images {
+				quoted[img.Name] = img.Content
+			}
 		}
-		attachments += "</ul>"
 	}
-	body := fmt.Sprintf("<p>%s</p>%s", html.EscapeString(message), attachments)
 
 	addresses := m.From
 	if len(m.ReplyTo) > 0 {
@@ -330,43 +519,84 @@ func (ec *EmailClient) ReplyTo(uid int, message string, files []struct{ Url, Nam
 	for address := range addresses {
 		to = append(to, address)
 	}
-	msg := getHTMLMsg(ec.username, to, m.Subject, body)
+	subject := m.Subject
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
 
-	// Send
+	out := &OutgoingEmail{Uid: uid, From: id.From(ec.username), To: to, Subject: subject, Text: text, Contacts: addresses, QuotesEncrypted: encrypted}
+	out.MessageID = newMessageID(id.SenderAddress(ec.username))
+	out.Raw = getAlternativeMsg(out.From, to, subject, out.MessageID, text, body, quoted)
+	out.Files = fileNames(files, quoted)
 
-	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Magenta("Sending reply via SMTP to %v").String(), to)
-	err = smtp.SendMail(
-		fmt.Sprintf("%s:%d", ec.smtpHost, ec.smtpPort),
-		smtp.PlainAuth("", ec.username, ec.password, ec.smtpHost),
-		ec.username,
-		to,
-		[]byte(msg),
-	)
+	return out, nil
+}
+
+// Original email for quoting, decrypted when possible
+
+func (ec *EmailClient) parseOriginal(m *imap.Email, uid int) *ParsedEmailData {
+
+	raw, err := ec.FetchRawMail(uid)
 	if err != nil {
-		return fmt.Errorf("smtp error: %s", err)
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to fetch raw email UID %d for quoting: %v").String(), uid, err)
+		return ParseEmail(m, nil, uid)
 	}
+	opened, status := ec.crypto.Open(raw)
+	d := ParseEmail(m, opened, uid)
+	d.Crypto = status
 
-	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Green(au.Bold("Successfully sent reply to email %d")).String(), uid)
-	return nil
+	return d
 }
 
-func (ec *EmailClient) SendMail(to []string, title string, message string, files []struct{ Url, Name string }) error {
+func (ec *EmailClient) SendMail(from string, to []string, title string, message string, files []struct{ Url, Name string }) error {
+
+	return ec.Send(ec.ComposeMail(from, to, title, message, files))
+}
+
+func (ec *EmailClient) ComposeMail(from string, to []string, title string, message string, files []struct{ Url, Name string }) *OutgoingEmail {
 
 	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Cyan("Preparing new email to %s").String(), strings.Join(to, ", "))
-	var attachments string
-	if len(files) > 0 {
-		attachments += "<ul>"
-		for _, f := range files {
-			attachments += fmt.Sprintf(`<li><a href="%s">%s</a></li>`, f.Url, html.EscapeString(f.Name))
-		}
-		attachments += "</ul>"
+	id := ec.identity(from)
+	text, body := id.Sign(composeBody(message, files))
+	out := &OutgoingEmail{From: id.From(ec.username), To: to, Subject: title, Text: text}
+	out.MessageID = newMessageID(id.SenderAddress(ec.username))
+	out.Raw = getAlternativeMsg(out.From, to, title, out.MessageID, text, body, nil)
+	out.Files = fileNames(files, nil)
+
+	return out
+}
+
+func fileNames(files []struct{ Url, Name string }, attachments map[string][]byte) []string {
+
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	for name := range attachments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// iTIP reply to a meeting invitation, sent to the organizer
+
+func (ec *EmailClient) SendCalendarReply(ev CalendarEvent, partstat string) error {
+
+	answer := map[string]string{"ACCEPTED": "Accepted", "TENTATIVE": "Tentative", "DECLINED": "Declined"}[partstat]
+	if answer == "" {
+		return fmt.Errorf("unknown participation status %q", partstat)
 	}
-	body := fmt.Sprintf("<p>%s</p>%s", html.EscapeString(message), attachments)
-	msg := getHTMLMsg(ec.username, to, title, body)
+	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Cyan("Preparing %s reply to invitation %s").String(), partstat, ev.UID)
+	to := []string{ev.Organizer}
+	text := fmt.Sprintf("%s has %s the invitation: %s", ec.username, strings.ToLower(answer), ev.Summary)
+	id := ec.identity("")
+	msg := getCalendarMsg(id.From(ec.username), to, answer+": "+ev.Summary, newMessageID(id.SenderAddress(ec.username)), text, buildICSReply(ev, ec.username, partstat))
 
 	// Send
 
-	log.Println(au.Gray(12, "[EMAIL]").String() + " " + au.Magenta("Sending email via SMTP").String())
+	log.Println(au.Gray(12, "[EMAIL]").String() + " " + au.Magenta("Sending invitation reply via SMTP").String())
 	err := smtp.SendMail(
 		fmt.Sprintf("%s:%d", ec.smtpHost, ec.smtpPort),
 		smtp.PlainAuth("", ec.username, ec.password, ec.smtpHost),
@@ -377,27 +607,248 @@ func (ec *EmailClient) SendMail(to []string, title string, message string, files
 	if err != nil {
 		return fmt.Errorf("smtp error: %s", err)
 	}
-	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Green(au.Bold("Successfully sent email to %s")).String(), strings.Join(to, ", "))
+	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Green(au.Bold("Successfully sent invitation reply to %s")).String(), ev.Organizer)
 
 	return nil
 }
 
-func getHTMLMsg(username string, to []string, subject, body string) string {
-	return "From: " + username + "\n" +
-		"To: " + strings.Join(to, ", ") + "\n" +
-		"Subject: =?UTF-8?B?" + base64.StdEncoding.EncodeToString([]byte("Re: "+subject)) + "?=\r\n" +
+// Message from Telegram HTML as plain text and email HTML, file links listed below it
+
+func composeBody(message string, files []struct{ Url, Name string }) (string, string) {
+
+	text := stripMarkup(message)
+	body := "<div>" + telegramToEmailHTML(message) + "</div>"
+	if len(files) > 0 {
+		text += "\n"
+		body += "<ul>"
+		for _, f := range files {
+			text += "\n" + f.Name + ": " + f.Url
+			body += fmt.Sprintf(`<li><a href="%s">%s</a></li>`, html.EscapeString(f.Url), html.EscapeString(f.Name))
+		}
+		body += "</ul>"
+	}
+
+	return strings.TrimSpace(text), body
+}
+
+var (
+	reBulletLine   = regexp.MustCompile(`^\s*[-•*]\s+(.*)$`)
+	reNumberedLine = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	reInlineTag    = regexp.MustCompile(`<(/?)(b|i|u|s|code|a|span)(?:\s[^>]*)?>`)
+)
+
+const emailQuoteTag = `<blockquote style="margin:0 0 0 .8ex;border-left:1px solid #ccc;padding-left:1ex">`
+
+// Telegram HTML to email HTML: line breaks, spoilers, quotes and "- " or "1. " lines as lists.
+// Formatting open at a line end is closed there and opened again on the next line, so a list
+// item never holds half of a tag.
+
+func telegramToEmailHTML(message string) string {
+
+	message = strings.NewReplacer(
+		"<tg-spoiler>", `<span style="background:#777;color:#777">`,
+		"</tg-spoiler>", "</span>",
+		"<blockquote expandable>", emailQuoteTag,
+		"<blockquote>", emailQuoteTag,
+	).Replace(message)
+
+	var out strings.Builder
+	list := ""
+	closeList := func() {
+		if list != "" {
+			out.WriteString("</" + list + ">")
+			list = ""
+		}
+	}
+	var open []string
+	lines := strings.Split(message, "\n")
+	inPre := false
+	for i, line := range lines {
+		pre := inPre || strings.Contains(line, "<pre>")
+
+		// Quotes around list lines go outside the list
+
+		tail := ""
+		if !pre {
+			for strings.HasPrefix(line, emailQuoteTag) {
+				closeList()
+				out.WriteString(emailQuoteTag)
+				line = strings.TrimPrefix(line, emailQuoteTag)
+			}
+			for strings.HasSuffix(line, "</blockquote>") {
+				tail += "</blockquote>"
+				line = strings.TrimSuffix(line, "</blockquote>")
+			}
+			reopen := strings.Join(open, "")
+			open = openInlineTags(open, line)
+			line = reopen + line + closeInlineTags(open)
+		}
+
+		kind, item := "", ""
+		if !pre {
+			if m := reBulletLine.FindStringSubmatch(stripLeadingTags(line)); m != nil {
+				kind, item = "ul", listItem(line, m[1])
+			} else if m := reNumberedLine.FindStringSubmatch(stripLeadingTags(line)); m != nil {
+				kind, item = "ol", listItem(line, m[1])
+			}
+		}
+		if kind != list {
+			closeList()
+		}
+		switch {
+		case kind != "":
+			if list == "" {
+				out.WriteString("<" + kind + ">")
+				list = kind
+			}
+			out.WriteString("<li>" + item + "</li>")
+			if tail != "" {
+				closeList()
+				out.WriteString(tail)
+			}
+		default:
+			out.WriteString(line)
+			if tail != "" {
+				closeList()
+				out.WriteString(tail)
+			}
+			if i < len(lines)-1 {
+				if inPre || strings.Contains(line, "<pre>") && !strings.Contains(line, "</pre>") {
+					out.WriteString("\n")
+				} else {
+					out.WriteString("<br>")
+				}
+			}
+		}
+		if strings.Contains(line, "<pre>") {
+			inPre = true
+		}
+		if strings.Contains(line, "</pre>") {
+			inPre = false
+		}
+	}
+	closeList()
+
+	return out.String()
+}
+
+// Inline tags still open after a line, given the ones open before it
+
+func openInlineTags(open []string, line string) []string {
+
+	open = append([]string(nil), open...)
+	for _, m := range reInlineTag.FindAllStringSubmatch(line, -1) {
+		if m[1] == "" {
+			open = append(open, m[0])
+			continue
+		}
+		for j := len(open) - 1; j >= 0; j-- {
+			if reInlineTag.FindStringSubmatch(open[j])[2] == m[2] {
+				open = append(open[:j], open[j+1:]...)
+				break
+			}
+		}
+	}
+
+	return open
+}
+
+func closeInlineTags(open []string) string {
+
+	var b strings.Builder
+	for j := len(open) - 1; j >= 0; j-- {
+		b.WriteString("</" + reInlineTag.FindStringSubmatch(open[j])[2] + ">")
+	}
+
+	return b.String()
+}
+
+// Line without the inline tags it starts with, "<b>- item" is a list line too
+
+func stripLeadingTags(line string) string {
+
+	for {
+		loc := reInlineTag.FindStringIndex(line)
+		if loc == nil || loc[0] != 0 {
+			return line
+		}
+		line = line[loc[1]:]
+	}
+}
+
+// List item with the tags that were before the "- " marker
+
+func listItem(line string, text string) string {
+
+	stripped := stripLeadingTags(line)
+
+	return line[:len(line)-len(stripped)] + text
+}
+
+// Plain text and HTML alternatives, attachments make it multipart/mixed
+
+func getAlternativeMsg(from string, to []string, subject, messageID, text, htmlBody string, attachments map[string][]byte) string {
+
+	boundary := newBoundary()
+	alternative := "Content-Type: multipart/alternative; boundary=\"" + boundary + "-alt\"\r\n\r\n" +
+		"--" + boundary + "-alt\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		wrapBase64([]byte(text)) +
+		"--" + boundary + "-alt\r\n" +
 		"Content-Type: text/html; charset=UTF-8\r\n" +
-		"Content-Transfer-Encoding: base64\r\n" +
-		"MIME-Version: 1.0\r\n\r\n" +
-		base64.StdEncoding.EncodeToString([]byte(body)) + "\r\n"
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		wrapBase64([]byte(htmlBody)) +
+		"--" + boundary + "-alt--\r\n"
+
+	header := "From: " + from + "\r\n" +
+		"To: " + strings.Join(to, ", ") + "\r\n" +
+		"Subject: " + mime.BEncoding.Encode("UTF-8", subject) + "\r\n" +
+		"Message-ID: " + messageID + "\r\n" +
+		"MIME-Version: 1.0\r\n"
+	if len(attachments) == 0 {
+		return header + alternative
+	}
+
+	names := make([]string, 0, len(attachments))
+	for name := range attachments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msg := header + "Content-Type: multipart/mixed; boundary=\"" + boundary + "\"\r\n\r\n" +
+		"--" + boundary + "\r\n" + alternative
+	for _, name := range names {
+		mimeType := mime.TypeByExtension(path.Ext(name))
+		if mimeType == "" {
+			mimeType = "application/octet-stream"
+		}
+		msg += "--" + boundary + "\r\n" +
+			"Content-Type: " + mimeType + "\r\n" +
+			"Content-Disposition: " + mime.FormatMediaType("attachment", map[string]string{"filename": name}) + "\r\n" +
+			"Content-Transfer-Encoding: base64\r\n\r\n" +
+			wrapBase64(attachments[name])
+	}
+
+	return msg + "--" + boundary + "--\r\n"
 }
 
-func getTextMsg(username string, to []string, subject, body string) string {
-	return "From: " + username + "\n" +
-		"To: " + strings.Join(to, ", ") + "\n" +
-		"Subject: =?UTF-8?B?" + base64.StdEncoding.EncodeToString([]byte("Re: "+subject)) + "?=\r\n" +
+func getCalendarMsg(from string, to []string, subject, messageID, text, ics string) string {
+
+	boundary := newBoundary()
+
+	return "From: " + from + "\r\n" +
+		"To: " + strings.Join(to, ", ") + "\r\n" +
+		"Subject: " + mime.BEncoding.Encode("UTF-8", subject) + "\r\n" +
+		"Message-ID: " + messageID + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"" + boundary + "\"\r\n\r\n" +
+		"--" + boundary + "\r\n" +
 		"Content-Type: text/plain; charset=UTF-8\r\n" +
-		"Content-Transfer-Encoding: base64\r\n" +
-		"MIME-Version: 1.0\r\n\r\n" +
-		base64.StdEncoding.EncodeToString([]byte(body)) + "\r\n"
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		wrapBase64([]byte(text)) +
+		"--" + boundary + "\r\n" +
+		"Content-Type: text/calendar; charset=UTF-8; method=REPLY\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		wrapBase64([]byte(ics)) +
+		"--" + boundary + "--\r\n"
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/jhillyerd/enmime"
+)
+
+func TestTelegramToEmailHTML(t *testing.T) {
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"lines", "Hello\nworld", "Hello<br>world"},
+		{"bullets", "Items:\n- one\n- two\nEnd", "Items:<br><ul><li>one</li><li>two</li></ul>End"},
+		{"numbered", "1. one\n2) two", "<ol><li>one</li><li>two</li></ol>"},
+		{"bold over list", "<b>Items:\n- one\n- two</b>", "<b>Items:</b><br><ul><li><b>one</b></li><li><b>two</b></li></ul>"},
+		{"bold marker", "<b>- one</b>\n- two", "<ul><li><b>one</b></li><li>two</li></ul>"},
+		{"link in item", `- <a href="https://x.io">x</a> and <i>more`, `<ul><li><a href="https://x.io">x</a> and <i>more</i></li></ul>`},
+		{"quoted list", "<blockquote>Note\n- one\n- two</blockquote>\nBye", emailQuoteTag + "Note<br><ul><li>one</li><li>two</li></ul></blockquote>Bye"},
+		{"spoiler", "<tg-spoiler>secret\nmore</tg-spoiler>", `<span style="background:#777;color:#777">secret</span><br><span style="background:#777;color:#777">more</span>`},
+		{"pre", "<pre>- a\n<b>b</pre>", "<pre>- a\n<b>b</pre>"},
+	}
+	for _, tt := range tests {
+		if got := telegramToEmailHTML(tt.in); got != tt.want {
+			t.Errorf("%s: telegramToEmailHTML = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+}
+
+func TestGetCalendarMsg(t *testing.T) {
+
+	ics := "BEGIN:VCALENDAR\r\nMETHOD:REPLY\r\n" + strings.Repeat("X-LONG:"+strings.Repeat("a", 70)+"\r\n", 3) + "END:VCALENDAR\r\n"
+	raw := getCalendarMsg("me@example.com", []string{"boss@example.com"}, "Принято: Встреча", "<id@example.com>", "Accepted", ics)
+	if strings.Contains(strings.ReplaceAll(raw, "\r\n", ""), "\n") {
+		t.Error("line without CRLF")
+	}
+	for _, line := range strings.Split(raw, "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("line of %d characters", len(line))
+		}
+	}
+	m, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Header.Get("Message-ID") != "<id@example.com>" {
+		t.Errorf("Message-ID = %q", m.Header.Get("Message-ID"))
+	}
+	env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.GetHeader("Subject") != "Принято: Встреча" || env.Text != "Accepted" {
+		t.Errorf("subject = %q, text = %q", env.GetHeader("Subject"), env.Text)
+	}
+	var got string
+	for _, p := range append(env.OtherParts, env.Inlines...) {
+		if p.ContentType == "text/calendar" {
+			got = string(p.Content)
+		}
+	}
+	if got != ics {
+		t.Errorf("calendar part = %q", got)
+	}
+
+}
@@ -0,0 +1,668 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/smallstep/pkcs7"
+)
+
+// OpenPGP and S/MIME keys, nil if neither is configured
+
+type MailCrypto struct {
+	pgpSigner *openpgp.Entity
+	pgpKeys   openpgp.EntityList
+
+	smimeCert  *x509.Certificate
+	smimeKey   crypto.PrivateKey
+	smimeRoots *x509.CertPool
+
+	sign    bool
+	encrypt bool
+}
+
+var ErrPGPPassphrase = errors.New("PGP key passphrase is missing or wrong")
+
+var ErrEncryptWithoutPGP = errors.New("encrypt_replies needs a PGP private key, S/MIME encryption is not supported")
+
+func NewMailCrypto(pgpPrivateKey string, pgpPublicKeys string, passphrase string, smimeCert string, smimeKey string, smimeRoots string, sign bool, encrypt bool) (*MailCrypto, error) {
+
+	// Encryption is PGP only, without a key emails would quietly go out in cleartext
+
+	if encrypt && pgpPrivateKey == "" {
+		return nil, ErrEncryptWithoutPGP
+	}
+	if pgpPrivateKey == "" && pgpPublicKeys == "" && smimeCert == "" {
+		return nil, nil
+	}
+	log.Println(au.Gray(12, "[CRYPTO]").String() + " " + au.Cyan("Loading PGP and S/MIME keys...").String())
+	mc := &MailCrypto{sign: sign, encrypt: encrypt}
+
+	// OpenPGP, own secret key first, then public keys of contacts
+
+	if pgpPrivateKey != "" {
+		keys, err := readArmoredKeyRing(pgpPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PGP private key: %w", err)
+		}
+		for _, e := range keys {
+			if e.PrivateKey == nil {
+				continue
+			}
+			if e.PrivateKey.Encrypted {
+				if passphrase == "" {
+					return nil, ErrPGPPassphrase
+				}
+				if err := e.DecryptPrivateKeys([]byte(passphrase)); err != nil {
+					return nil, fmt.Errorf("%w: %v", ErrPGPPassphrase, err)
+				}
+			}
+			if mc.pgpSigner == nil {
+				mc.pgpSigner = e
+			}
+		}
+		if mc.pgpSigner == nil {
+			return nil, fmt.Errorf("no private key in %s", pgpPrivateKey)
+		}
+		mc.pgpKeys = append(mc.pgpKeys, keys...)
+	}
+	if pgpPublicKeys != "" {
+		keys, err := readArmoredKeyRing(pgpPublicKeys)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PGP public keys: %w", err)
+		}
+		mc.pgpKeys = append(mc.pgpKeys, keys...)
+	}
+
+	// S/MIME certificate and key in PEM, CA bundle for signature checks
+
+	if smimeCert != "" {
+		pair, err := tls.LoadX509KeyPair(smimeCert, smimeKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load S/MIME certificate: %w", err)
+		}
+		mc.smimeCert, err = x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse S/MIME certificate: %w", err)
+		}
+		mc.smimeKey = pair.PrivateKey
+	}
+	if smimeRoots != "" {
+		pem, err := os.ReadFile(smimeRoots)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read S/MIME roots: %w", err)
+		}
+		mc.smimeRoots = x509.NewCertPool()
+		if !mc.smimeRoots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", smimeRoots)
+		}
+	} else if roots, err := x509.SystemCertPool(); err == nil {
+		mc.smimeRoots = roots
+	}
+
+	log.Printf(au.Gray(12, "[CRYPTO]").String()+" "+au.Green("Loaded %d PGP keys, S/MIME: %t").String(), len(mc.pgpKeys), mc.smimeCert != nil)
+	return mc, nil
+}
+
+func readArmoredKeyRing(fn string) (openpgp.EntityList, error) {
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return openpgp.ReadArmoredKeyRing(f)
+}
+
+// Incoming
+
+type CryptoStatus struct {
+	Encrypted bool
+	Decrypted bool
+	Signed    bool
+	Verified  bool
+	Signer    string
+	Error     string
+}
+
+func (s *CryptoStatus) Badge() string {
+
+	if s == nil {
+		return ""
+	}
+	var notes []string
+	if s.Encrypted {
+		if s.Decrypted {
+			notes = append(notes, "🔐 Decrypted")
+		} else {
+			notes = append(notes, "🔒 Encrypted, cannot decrypt")
+		}
+	}
+	if s.Signed {
+		switch {
+		case s.Verified:
+			notes = append(notes, "🔏 Signed by "+html.EscapeString(s.Signer)+" ✅")
+		case s.Signer != "":
+			notes = append(notes, "⚠️ Signature by "+html.EscapeString(s.Signer)+" not verified")
+		default:
+			notes = append(notes, "⚠️ Signature not verified")
+		}
+	}
+	badge := strings.Join(notes, " · ")
+	if s.Error != "" {
+		badge += " <i>(" + html.EscapeString(s.Error) + ")</i>"
+	}
+
+	return badge
+}
+
+// Decrypt and unwrap signed messages, returns the message with the inner content and its status
+
+func (mc *MailCrypto) Open(raw []byte) ([]byte, *CryptoStatus) {
+
+	if mc == nil {
+		return raw, nil
+	}
+	st := &CryptoStatus{}
+
+	// Signed inside encrypted and vice versa, a few levels deep at most
+
+	for range 3 {
+		next, ok := mc.unwrap(raw, st)
+		if !ok {
+			break
+		}
+		raw = next
+	}
+	if !st.Encrypted && !st.Signed {
+		return raw, nil
+	}
+
+	return raw, st
+}
+
+func (mc *MailCrypto) unwrap(raw []byte, st *CryptoStatus) ([]byte, bool) {
+
+	header, body := splitEntity(raw)
+	headers := parseRawHeaders(header)
+	values := headerValues(headers, "Content-Type")
+	if len(values) == 0 {
+		return nil, false
+	}
+	mediaType, params, err := mime.ParseMediaType(values[0])
+	if err != nil {
+		return nil, false
+	}
+
+	var entity []byte
+	switch {
+	case mediaType == "multipart/encrypted" && strings.EqualFold(params["protocol"], "application/pgp-encrypted"):
+		st.Encrypted = true
+		parts := multipartParts(body, params["boundary"])
+		if len(parts) < 2 {
+			st.Error = "malformed PGP/MIME message"
+			return nil, false
+		}
+		_, data := decodePart(parts[1])
+		entity, err = mc.decryptPGP(data, st)
+	case mediaType == "application/pkcs7-mime" || mediaType == "application/x-pkcs7-mime":
+		der := decodeBody(headers, body)
+		if strings.EqualFold(params["smime-type"], "signed-data") {
+			st.Signed = true
+			entity, err = mc.verifySMIME(der, nil, st)
+		} else {
+			st.Encrypted = true
+			entity, err = mc.decryptSMIME(der, st)
+		}
+	case mediaType == "multipart/signed":
+		st.Signed = true
+		parts := multipartParts(body, params["boundary"])
+		if len(parts) < 2 {
+			st.Error = "malformed signed message"
+			return nil, false
+		}
+		signed := toCRLF(parts[0])
+		_, sig := decodePart(parts[1])
+		switch strings.ToLower(params["protocol"]) {
+		case "application/pgp-signature":
+			err = mc.verifyPGP(signed, sig, st)
+		case "application/pkcs7-signature", "application/x-pkcs7-signature":
+			_, err = mc.verifySMIME(sig, signed, st)
+		default:
+			err = fmt.Errorf("unknown signature protocol %s", params["protocol"])
+		}
+		if err != nil {
+			st.Error = err.Error()
+		}
+		return replaceEntity(header, parts[0]), true
+	default:
+		return nil, false
+	}
+	if err != nil {
+		st.Error = err.Error()
+		return nil, false
+	}
+
+	return replaceEntity(header, entity), true
+}
+
+func (mc *MailCrypto) decryptPGP(data []byte, st *CryptoStatus) ([]byte, error) {
+
+	if mc.pgpSigner == nil {
+		return nil, errors.New("no PGP private key")
+	}
+	var r io.Reader = bytes.NewReader(data)
+	if block, err := armor.Decode(bytes.NewReader(data)); err == nil {
+		r = block.Body
+	}
+	md, err := openpgp.ReadMessage(r, mc.pgpKeys, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := io.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, err
+	}
+	st.Decrypted = true
+
+	// Signature of an encrypted message is checked once the body is read
+
+	if md.IsSigned {
+		st.Signed = true
+		if md.SignedBy != nil {
+			st.Signer = pgpIdentity(md.SignedBy.Entity)
+		} else {
+			st.Signer = fmt.Sprintf("unknown key %016X", md.SignedByKeyId)
+		}
+		st.Verified = md.SignedBy != nil && md.SignatureError == nil
+		if md.SignatureError != nil {
+			st.Error = md.SignatureError.Error()
+		}
+	}
+
+	return plain, nil
+}
+
+func (mc *MailCrypto) verifyPGP(signed []byte, sig []byte, st *CryptoStatus) error {
+
+	signer, err := openpgp.CheckArmoredDetachedSignature(mc.pgpKeys, bytes.NewReader(signed), bytes.NewReader(sig), nil)
+	if errors.Is(err, pgperrors.ErrUnknownIssuer) {
+		return errors.New("signer key is not in the keyring")
+	}
+	if err != nil {
+		return err
+	}
+	st.Signer = pgpIdentity(signer)
+	st.Verified = true
+
+	return nil
+}
+
+func (mc *MailCrypto) decryptSMIME(der []byte, st *CryptoStatus) ([]byte, error) {
+
+	if mc.smimeCert == nil {
+		return nil, errors.New("no S/MIME key")
+	}
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := p7.Decrypt(mc.smimeCert, mc.smimeKey)
+	if err != nil {
+		return nil, err
+	}
+	st.Decrypted = true
+
+	return plain, nil
+}
+
+// Detached signature if content is set, otherwise the content is inside the signature
+
+func (mc *MailCrypto) verifySMIME(der []byte, content []byte, st *CryptoStatus) ([]byte, error) {
+
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return nil, err
+	}
+	if content != nil {
+		p7.Content = content
+	}
+	if cert := p7.GetOnlySigner(); cert != nil {
+		st.Signer = cert.Subject.CommonName
+		if len(cert.EmailAddresses) > 0 {
+			st.Signer += " <" + cert.EmailAddresses[0] + ">"
+		}
+	}
+	if err := p7.VerifyWithChain(mc.smimeRoots); err != nil {
+		return p7.Content, err
+	}
+	st.Verified = true
+
+	return p7.Content, nil
+}
+
+func pgpIdentity(e *openpgp.Entity) string {
+
+	if id := e.PrimaryIdentity(); id != nil {
+		return id.Name
+	}
+
+	return fmt.Sprintf("key %016X", e.PrimaryKey.KeyId)
+}
+
+// Outgoing, signs and encrypts a message built by getAlternativeMsg
+
+func (mc *MailCrypto) Protect(msg string, to []string) (string, error) {
+
+	if mc == nil || (!mc.sign && !mc.encrypt) {
+		return msg, nil
+	}
+
+	// Content headers go inside the signed or encrypted part
+
+	header, body := splitEntity([]byte(msg))
+	var outer, inner []string
+	for _, line := range strings.Split(strings.TrimRight(string(header), "\r\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		name, _, _ := strings.Cut(line, ":")
+		if strings.HasPrefix(strings.ToLower(name), "content-") {
+			inner = append(inner, line)
+		} else {
+			outer = append(outer, line)
+		}
+	}
+	entity := toCRLF([]byte(strings.Join(inner, "\r\n") + "\r\n\r\n" + string(body)))
+
+	var content []byte
+	var err error
+	switch {
+	case mc.pgpSigner != nil:
+		content, err = mc.protectPGP(entity, to)
+	case mc.smimeCert != nil && mc.sign:
+		content, err = mc.signSMIME(entity)
+	default:
+		return msg, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join(outer, "\r\n") + "\r\n" + string(content), nil
+}
+
+func (mc *MailCrypto) protectPGP(entity []byte, to []string) ([]byte, error) {
+
+	if mc.encrypt {
+		var recipients []*openpgp.Entity
+		var missing []string
+		for _, address := range to {
+			if e := mc.pgpKeyFor(address); e != nil {
+				recipients = append(recipients, e)
+			} else {
+				missing = append(missing, address)
+			}
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("no PGP key for %s", strings.Join(missing, ", "))
+		}
+		return mc.encryptPGP(entity, append(recipients, mc.pgpSigner))
+	}
+	if mc.sign {
+		return mc.signPGP(entity)
+	}
+
+	return entity, nil
+}
+
+// Outgoing emails are encrypted, quoting decrypted text is safe only then
+
+func (mc *MailCrypto) Encrypts() bool {
+
+	return mc != nil && mc.encrypt
+}
+
+// Recipients an encrypted email can not be sent to, checked before it is queued
+
+func (mc *MailCrypto) MissingKeys(to []string) []string {
+
+	if mc == nil || !mc.encrypt {
+		return nil
+	}
+	var missing []string
+	for _, address := range to {
+		if mc.pgpKeyFor(address) == nil {
+			missing = append(missing, address)
+		}
+	}
+
+	return missing
+}
+
+func (mc *MailCrypto) pgpKeyFor(address string) *openpgp.Entity {
+
+	for _, e := range mc.pgpKeys {
+		for _, id := range e.Identities {
+			if id.UserId != nil && strings.EqualFold(id.UserId.Email, address) {
+				return e
+			}
+		}
+	}
+
+	return nil
+}
+
+func (mc *MailCrypto) signPGP(entity []byte) ([]byte, error) {
+
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sig, mc.pgpSigner, bytes.NewReader(entity), &packet.Config{DefaultHash: crypto.SHA256}); err != nil {
+		return nil, fmt.Errorf("failed to sign with PGP: %w", err)
+	}
+	boundary := newBoundary()
+
+	return []byte("Content-Type: multipart/signed; micalg=pgp-sha256; protocol=\"application/pgp-signature\"; boundary=\"" + boundary + "\"\r\n\r\n" +
+		"--" + boundary + "\r\n" +
+		string(entity) + "\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n" +
+		"Content-Disposition: attachment; filename=\"signature.asc\"\r\n\r\n" +
+		sig.String() + "\r\n" +
+		"--" + boundary + "--\r\n"), nil
+}
+
+func (mc *MailCrypto) encryptPGP(entity []byte, recipients []*openpgp.Entity) ([]byte, error) {
+
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	var signer *openpgp.Entity
+	if mc.sign {
+		signer = mc.pgpSigner
+	}
+	pt, err := openpgp.Encrypt(w, recipients, signer, nil, &packet.Config{DefaultHash: crypto.SHA256})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt with PGP: %w", err)
+	}
+	if _, err := pt.Write(entity); err != nil {
+		return nil, err
+	}
+	if err := pt.Close(); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	boundary := newBoundary()
+
+	return []byte("Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\"" + boundary + "\"\r\n\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Type: application/pgp-encrypted\r\n\r\n" +
+		"Version: 1\r\n\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n" +
+		"Content-Disposition: inline; filename=\"encrypted.asc\"\r\n\r\n" +
+		buf.String() + "\r\n" +
+		"--" + boundary + "--\r\n"), nil
+}
+
+func (mc *MailCrypto) signSMIME(entity []byte) ([]byte, error) {
+
+	sd, err := pkcs7.NewSignedData(entity)
+	if err != nil {
+		return nil, err
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err := sd.AddSigner(mc.smimeCert, mc.smimeKey, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, fmt.Errorf("failed to sign with S/MIME: %w", err)
+	}
+	sd.Detach()
+	der, err := sd.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign with S/MIME: %w", err)
+	}
+	boundary := newBoundary()
+
+	return []byte("Content-Type: multipart/signed; micalg=sha-256; protocol=\"application/pkcs7-signature\"; boundary=\"" + boundary + "\"\r\n\r\n" +
+		"--" + boundary + "\r\n" +
+		string(entity) + "\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"Content-Disposition: attachment; filename=\"smime.p7s\"\r\n\r\n" +
+		wrapBase64(der) +
+		"--" + boundary + "--\r\n"), nil
+}
+
+// MIME helpers working on exact bytes, signatures cover the raw part
+
+func splitEntity(raw []byte) ([]byte, []byte) {
+
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(raw, []byte(sep)); i >= 0 {
+			return raw[:i+len(sep)], raw[i+len(sep):]
+		}
+	}
+
+	return raw, nil
+}
+
+func multipartParts(body []byte, boundary string) [][]byte {
+
+	if boundary == "" {
+		return nil
+	}
+	var parts [][]byte
+	segments := bytes.Split(body, []byte("--"+boundary))
+	for _, seg := range segments[1:] {
+		if bytes.HasPrefix(seg, []byte("--")) {
+			break
+		}
+		i := bytes.IndexByte(seg, '\n')
+		if i < 0 {
+			continue
+		}
+		seg = bytes.TrimSuffix(bytes.TrimSuffix(seg[i+1:], []byte("\n")), []byte("\r"))
+		parts = append(parts, seg)
+	}
+
+	return parts
+}
+
+func decodePart(part []byte) ([]rawHeader, []byte) {
+
+	header, body := splitEntity(part)
+	headers := parseRawHeaders(header)
+
+	return headers, decodeBody(headers, body)
+}
+
+func decodeBody(headers []rawHeader, body []byte) []byte {
+
+	var encoding string
+	if values := headerValues(headers, "Content-Transfer-Encoding"); len(values) > 0 {
+		encoding = strings.ToLower(values[0])
+	}
+	switch encoding {
+	case "base64":
+		decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+		if err == nil {
+			return decoded
+		}
+	case "quoted-printable":
+		decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		if err == nil {
+			return decoded
+		}
+	}
+
+	return body
+}
+
+// Outer headers without the content fields, followed by the inner entity
+
+func replaceEntity(header []byte, entity []byte) []byte {
+
+	var out bytes.Buffer
+	skip := false
+	for _, line := range strings.SplitAfter(string(header), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if !skip {
+				out.WriteString(line)
+			}
+			continue
+		}
+		name, _, _ := strings.Cut(line, ":")
+		skip = strings.HasPrefix(strings.ToLower(strings.TrimSpace(name)), "content-")
+		if !skip {
+			out.WriteString(line)
+		}
+	}
+	out.Write(entity)
+
+	return out.Bytes()
+}
+
+func toCRLF(b []byte) []byte {
+
+	return bytes.ReplaceAll(bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+}
+
+func wrapBase64(b []byte) string {
+
+	encoded := base64.StdEncoding.EncodeToString(b)
+	var out strings.Builder
+	for len(encoded) > 76 {
+		out.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	out.WriteString(encoded + "\r\n")
+
+	return out.String()
+}
+
+func newBoundary() string {
+
+	return fmt.Sprintf("e2t-%x", time.Now().UnixNano())
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNewMailCryptoEncryptNeedsPGP(t *testing.T) {
+
+	if _, err := NewMailCrypto("", "", "", "", "", "", false, true); !errors.Is(err, ErrEncryptWithoutPGP) {
+		t.Errorf("no keys: error = %v, want %v", err, ErrEncryptWithoutPGP)
+	}
+	if _, err := NewMailCrypto("", "", "", "cert.pem", "key.pem", "", true, true); !errors.Is(err, ErrEncryptWithoutPGP) {
+		t.Errorf("S/MIME only: error = %v, want %v", err, ErrEncryptWithoutPGP)
+	}
+	if mc, err := NewMailCrypto("", "", "", "", "", "", true, false); mc != nil || err != nil {
+		t.Errorf("signing without keys = %v, %v", mc, err)
+	}
+
+}
+
+func TestMailCryptoEncrypts(t *testing.T) {
+
+	var none *MailCrypto
+	if none.Encrypts() || (&MailCrypto{sign: true}).Encrypts() || !(&MailCrypto{encrypt: true}).Encrypts() {
+		t.Error("Encrypts does not follow encrypt_replies")
+	}
+
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"fmt"
+	"html"
 	"log"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/logrusorgru/aurora/v4"
+	telehtml "github.com/svanichkin/TelegramHTML"
 )
 
 var mu sync.Mutex
@@ -42,22 +47,39 @@ func processNewEmails(ec *EmailClient, tb *TelegramBot, ai *OpenAIClient) {
 	// Main cycle for new letters
 
 	for _, uid := range uids {
-		m, err := ec.FetchMail(uid)
+		d, err := fetchEmailData(ec, uid)
 		if err != nil {
 			log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Error fetching email %d: %v").String(), uid, err)
 			continue
 		}
-		d := ParseEmail(m, uid)
 
-		if ai != nil && d != nil && d.TextBody != "" {
+		// Snoozed email moved back to INBOX, a reminder instead of the whole email
+
+		if sn, ok := ec.snoozer.Woken(d.MessageID); ok {
+			if err := tb.SendSnoozeReminder(sn, uid); err != nil {
+				log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error sending snooze reminder for email %d: %v").String(), uid, err)
+				continue
+			}
+			if err := ec.MarkUIDAsProcessed(uid); err != nil {
+				log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Error marking email %d as processed: %v").String(), uid, err)
+			}
+			continue
+		}
+
+		if ai != nil && d != nil && d.TextBody != "" && !ai.AllowedEmail(d) {
+			log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Yellow("Email UID %d is excluded from AI processing").String(), uid)
+		} else if res, ok := ai.CachedAnalysis(d.MessageID); ok {
+			log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Blue("Using cached analysis for email UID %d").String(), uid)
+			d.applyAnalysis(res)
+		} else if ai != nil && d != nil && d.TextBody != "" {
 			log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Magenta("Attempting to process email UID %d with OpenAI...").String(), uid)
-			res, err := ai.GenerateTextFromEmail("Subject: " + d.Subject + " From: " + d.From + " To: " + d.To + " Body: " + d.TextBody)
+			res, err := ai.GenerateTextFromEmail("Subject: "+d.Subject+" From: "+d.From+" To: "+d.To+" Body: "+prepareEmailBody(d.TextBody), firstAddress(d.From))
 			if err != nil {
 				log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Red("Failed to process email UID %d with OpenAI: %v. Sending original email.").String(), uid, err)
+			} else {
+				d.applyAnalysis(res)
+				ai.CacheAnalysis(d.MessageID, res)
 			}
-			d.Type = res.Type
-			d.Summary = res.Summary
-			d.Unsubscrube = res.Unsubscribe
 		}
 
 		if err := tb.SendEmailData(d); err != nil {
@@ -67,55 +89,748 @@ func processNewEmails(ec *EmailClient, tb *TelegramBot, ai *OpenAIClient) {
 		if err := ec.MarkUIDAsProcessed(uid); err != nil {
 			log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Error marking email %d as processed: %v").String(), uid, err)
 		}
+		if d.Spoofing == "" && d.Auth.Passed() {
+			ec.contacts.Learn(d.FromName, d.FromAddress)
+		}
+	}
+
+}
+
+// Fetch and parse an email, the caller must hold mu with idle stopped
+
+func fetchEmailData(ec *EmailClient, uid int) (*ParsedEmailData, error) {
+
+	return fetchEmailDataIn(ec, "INBOX", uid)
+}
+
+func fetchEmailDataIn(ec *EmailClient, folder string, uid int) (*ParsedEmailData, error) {
+
+	m, raw, err := ec.fetchMailWithRawIn(folder, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decrypted or unwrapped signed content replaces the opaque parts
+
+	opened, status := ec.crypto.Open(raw)
+	if status != nil {
+		if err := replaceBody(m, opened); err != nil {
+			log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to parse decrypted email %d: %v").String(), uid, err)
+		}
+	}
+	d := ParseEmail(m, opened, uid)
+	d.Crypto = status
+
+	// Sections of the decrypted or unwrapped message do not exist on the server
+
+	if status != nil {
+		for name, part := range d.Parts {
+			d.Parts[name] = "~" + part
+		}
+		for i := range d.Images {
+			d.Images[i].Part = "~" + d.Images[i].Part
+		}
 	}
+	if ec.verifyDKIM && len(raw) > 0 {
+		d.Auth.DKIM, d.Auth.LocalDKIM = verifyDKIM(raw), true
+	}
+	d.Spoofing = spoofingWarning(ec.contacts, d.FromName, d.FromAddress)
 
+	return d, nil
 }
 
-func replayToEmail(ec *EmailClient, tb *TelegramBot, uid int, msg string, files []struct{ Url, Name string }) {
+func replayToEmail(ec *EmailClient, tb *TelegramBot, uid int, tid int, msg string, files []struct{ Url, Name string }) {
 
+	at, msg, err := parseSendAt(msg, tb.now())
+	if err != nil {
+		tb.SendMessage("Failed to schedule email: " + err.Error())
+		return
+	}
+	uid = unsnoozeEmail(ec, tb, uid)
 	mu.Lock()
 	ec.imap.StopIdle()
-	err := ec.ReplyTo(uid, msg, files)
+	out, err := ec.ComposeReply(uid, msg, files)
+	if err := ec.startIdleWithHandler(); err != nil {
+		log.Fatalf(au.Gray(12, "[EMAIL]").String()+" "+au.Red(aurora.Bold("Failed to restart idle mode: %v")).String(), err)
+	}
+	mu.Unlock()
 	if err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Error composing reply to email %d: %v").String(), uid, err)
 		tb.SendMessage("Failed to reply email for!")
+		return
 	}
+	out.SendAt = at
+	sendOutgoing(ec, tb, tid, out, "Failed to reply email for!")
+
+}
+
+func replyOrOfferTranslation(ec *EmailClient, tb *TelegramBot, ai *OpenAIClient, uid int, tid int, msg string, files []struct{ Url, Name string }) {
+
+	if ai.Language() == "" || msg == "" {
+		replayToEmail(ec, tb, uid, tid, msg, files)
+		return
+	}
+
+	// Language of the original email from cached analysis
+
+	mu.Lock()
+	ec.imap.StopIdle()
+	m, err := ec.FetchMail(uid)
 	if err := ec.startIdleWithHandler(); err != nil {
 		log.Fatalf(au.Gray(12, "[EMAIL]").String()+" "+au.Red(aurora.Bold("Failed to restart idle mode: %v")).String(), err)
 	}
 	mu.Unlock()
+	var language string
+	if err == nil {
+		if res, ok := ai.CachedAnalysis(m.MessageID); ok {
+			language = res.Language
+		}
+	}
+	if !ai.NeedsTranslation(language) {
+		replayToEmail(ec, tb, uid, tid, msg, files)
+		return
+	}
+	if err := tb.OfferReplyTranslation(uid, tid, msg, files, language); err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error offering translation for email %d: %v").String(), uid, err)
+		replayToEmail(ec, tb, uid, tid, msg, files)
+	}
+
+}
+
+func sendNewEmail(ec *EmailClient, tb *TelegramBot, tid int, from, to, subj, msg string, files []struct{ Url, Name string }) {
+
+	if !ec.KnownIdentity(from) {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Unknown identity %q, email is not sent").String(), from)
+		tb.SendMessage("Unknown identity \"" + from + "\", email is not sent! Use one of: " + strings.Join(ec.IdentityNames(), ", "))
+		return
+	}
+
+	at, msg, err := parseSendAt(msg, tb.now())
+	if err != nil {
+		tb.SendMessage("Failed to schedule email: " + err.Error())
+		return
+	}
+	out := ec.ComposeMail(from, []string{to}, subj, msg, files)
+	out.SendAt = at
+	sendOutgoing(ec, tb, tid, out, "Failed to send email!")
+
+}
+
+// Sends right away, schedules the email when it has a send time, or queues it
+// with an UNDO button when undo_send is set
+
+func sendOutgoing(ec *EmailClient, tb *TelegramBot, tid int, out *OutgoingEmail, failure string) {
+
+	if missing := ec.crypto.MissingKeys(out.To); len(missing) > 0 {
+		log.Printf(au.Gray(12, "[CRYPTO]").String()+" "+au.Yellow("No PGP key for %s, email is not sent").String(), strings.Join(missing, ", "))
+		tb.SendMessage("No PGP key for " + strings.Join(missing, ", ") + ", email is not sent!")
+		return
+	}
+
+	if !out.SendAt.IsZero() {
+		e, err := ec.scheduler.Add(tid, out, tb.FileIDs(out.Text))
+		if err != nil {
+			log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Error scheduling email to %v: %v").String(), out.To, err)
+			tb.SendMessage("Failed to schedule email!")
+			return
+		}
+		if err := tb.ShowScheduled(tid, e); err != nil {
+			log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error showing scheduled email %s: %v").String(), e.ID, err)
+		}
+		return
+	}
+	delay := ec.outbox.Delay()
+	if delay == 0 {
+		if err := ec.Send(out); err != nil {
+			log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Error sending email to %v: %v").String(), out.To, err)
+			tb.SendMessage(failure)
+			return
+		}
+		markReplied(ec, tb, out)
+		return
+	}
+	id := newOutboxID()
+	mid, err := tb.ShowQueued(tid, id, out, delay)
+	if err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error showing undo for email %s: %v").String(), id, err)
+	}
+	ec.outbox.Enqueue(id, out, func(err error) {
+		if err != nil && mid == 0 {
+			tb.SendMessage(failure)
+		}
+		tb.ShowSent(mid, out, err)
+		if err == nil {
+			markReplied(ec, tb, out)
+		}
+	})
+
+}
+
+// Failures are shown on the first attempt and the last one, retries in between are quiet
+
+func sendScheduledEmail(ec *EmailClient, tb *TelegramBot, e *ScheduledEmail, retry time.Time) error {
+
+	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Magenta("Sending scheduled email %s").String(), e.ID)
+
+	// File links from the time it was written have expired by now
+
+	if fresh := tb.FreshFileURLs(e.Files); len(fresh) > 0 {
+		if err := e.Out.ReplaceLinks(fresh); err != nil {
+			log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to refresh file links of scheduled email %s: %v").String(), e.ID, err)
+		} else {
+			for old, url := range fresh {
+				e.Files[url] = e.Files[old]
+				delete(e.Files, old)
+			}
+		}
+	}
+	err := ec.Send(e.Out)
+	if err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Error sending scheduled email %s: %v").String(), e.ID, err)
+	} else {
+		markReplied(ec, tb, e.Out)
+	}
+	if err == nil || e.Attempts == 0 || retry.IsZero() {
+		tb.ShowScheduledSent(e, err, retry)
+	}
+
+	return err
+}
+
+func unscheduleEmail(ec *EmailClient, tb *TelegramBot, mid int, id string) {
+
+	e, ok := ec.scheduler.Cancel(id)
+	if !ok {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Scheduled email %s is already sent").String(), id)
+		return
+	}
+	tb.ShowUndone(mid, e.Out)
 
 }
 
-func sendNewEmail(ec *EmailClient, tb *TelegramBot, to, subj, msg string, files []struct{ Url, Name string }) {
+// Mailbox actions from Telegram, on is the new state of a toggled flag and folder
+// where the email was moved
+
+func mailboxAction(ec *EmailClient, uid int, action string, folder string) (on bool, moved string, err error) {
 
+	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Magenta("Processing %s of email UID %d").String(), action, uid)
 	mu.Lock()
 	ec.imap.StopIdle()
-	err := ec.SendMail([]string{to}, subj, msg, files)
+	switch action {
+	case "read", "unread":
+		on = action == "read"
+		err = ec.storeFlag(uid, `\Seen`, on)
+	case "star", "unstar":
+		on = action == "star"
+		err = ec.storeFlag(uid, `\Flagged`, on)
+	case "archive":
+		moved, err = ec.Archive(uid)
+	case "trash":
+		moved, err = ec.Trash(uid)
+	case "moveto":
+		moved, err = folder, ec.moveUID(uid, folder)
+	default:
+		err = fmt.Errorf("unknown mailbox action %q", action)
+	}
+	if err := ec.startIdleWithHandler(); err != nil {
+		log.Fatalf(au.Gray(12, "[EMAIL]").String()+" "+au.Red(aurora.Bold("Failed to restart idle mode: %v")).String(), err)
+	}
+	mu.Unlock()
 	if err != nil {
-		tb.SendMessage("Failed to send email!")
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Error on %s of email UID %d: %v").String(), action, uid, err)
 	}
+
+	return on, moved, err
+}
+
+func listFolders(ec *EmailClient) ([]string, error) {
+
+	mu.Lock()
+	ec.imap.StopIdle()
+	folders, err := ec.Folders()
 	if err := ec.startIdleWithHandler(); err != nil {
 		log.Fatalf(au.Gray(12, "[EMAIL]").String()+" "+au.Red(aurora.Bold("Failed to restart idle mode: %v")).String(), err)
 	}
 	mu.Unlock()
 
+	return folders, err
 }
 
-func expandEmail(ec *EmailClient, tb *TelegramBot, uid int, tid int) {
+// Snooze: remember the email, optionally move it out of INBOX until it wakes up
+
+func snoozeEmail(ec *EmailClient, tb *TelegramBot, uid int, tid int, mid int, picker int, until time.Time) {
 
+	sn := &Snooze{Uid: uid, Tid: tid, Mid: mid, Until: until}
 	mu.Lock()
 	ec.imap.StopIdle()
 	m, err := ec.FetchMail(uid)
+	if err := ec.startIdleWithHandler(); err != nil {
+		log.Fatalf(au.Gray(12, "[EMAIL]").String()+" "+au.Red(aurora.Bold("Failed to restart idle mode: %v")).String(), err)
+	}
+	mu.Unlock()
+
+	// Stored before the move, a failed move leaves the email in INBOX with only a reminder
+
+	if err == nil {
+		sn.MessageID, sn.Subject, sn.From = m.MessageID, m.Subject, m.From.String()
+		if ec.snoozeFolder != "" && sn.MessageID != "" {
+			sn.Folder = ec.snoozeFolder
+		}
+		err = ec.snoozer.Add(sn)
+	}
+	if err == nil && sn.Folder != "" {
+		mu.Lock()
+		ec.imap.StopIdle()
+		merr := ec.ensureFolder(sn.Folder)
+		if merr == nil {
+			merr = ec.moveUID(uid, sn.Folder)
+		}
+		if err := ec.startIdleWithHandler(); err != nil {
+			log.Fatalf(au.Gray(12, "[EMAIL]").String()+" "+au.Red(aurora.Bold("Failed to restart idle mode: %v")).String(), err)
+		}
+		mu.Unlock()
+		if merr != nil {
+			log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to move email %d to %s: %v").String(), uid, sn.Folder, merr)
+			ec.snoozer.Unmoved(sn)
+		}
+	}
 	if err != nil {
-		tb.SendMessage("Failed to expand email!")
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Error snoozing email %d: %v").String(), uid, err)
+	}
+	tb.ShowSnoozed(picker, sn, err)
+
+}
+
+func wakeEmail(ec *EmailClient, tb *TelegramBot, sn *Snooze) {
+
+	if sn.Folder == "" {
+		if err := tb.SendSnoozeReminder(sn, sn.Uid); err != nil {
+			log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error sending snooze reminder for email %d: %v").String(), sn.Uid, err)
+		}
+		return
+	}
+
+	// Back to INBOX, the new mail check finds it there and posts the reminder
+
+	ec.snoozer.MarkWoken(sn)
+	mu.Lock()
+	ec.imap.StopIdle()
+	uid, err := ec.findUID(sn.Folder, sn.MessageID)
+	if err == nil {
+		err = ec.moveSelectedUID(uid, "INBOX")
+	}
+	if err := ec.startIdleWithHandler(); err != nil {
+		log.Fatalf(au.Gray(12, "[EMAIL]").String()+" "+au.Red(aurora.Bold("Failed to restart idle mode: %v")).String(), err)
+	}
+	mu.Unlock()
+	if err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Error moving snoozed email back from %s: %v").String(), sn.Folder, err)
+		ec.snoozer.Woken(sn.MessageID)
+		if err := tb.SendSnoozeReminder(sn, sn.Uid); err != nil {
+			log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error sending snooze reminder for email %d: %v").String(), sn.Uid, err)
+		}
+		return
+	}
+	ec.callback()
+
+}
+
+// A reply to a snoozed email brings it back to INBOX first, the reply needs its new UID
+
+func unsnoozeEmail(ec *EmailClient, tb *TelegramBot, uid int) int {
+
+	sn, ok := ec.snoozer.Take(uid)
+	if !ok {
+		return tb.currentUid(uid)
+	}
+	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Magenta("Snoozed email UID %d wakes up for a reply").String(), uid)
+	ec.snoozer.MarkWoken(sn)
+	mu.Lock()
+	ec.imap.StopIdle()
+	cur, err := ec.findUID(sn.Folder, sn.MessageID)
+	if err == nil {
+		err = ec.moveSelectedUID(cur, "INBOX")
+	}
+	if err == nil {
+		cur, err = ec.findUID("INBOX", sn.MessageID)
+	}
+	if err := ec.startIdleWithHandler(); err != nil {
+		log.Fatalf(au.Gray(12, "[EMAIL]").String()+" "+au.Red(aurora.Bold("Failed to restart idle mode: %v")).String(), err)
+	}
+	mu.Unlock()
+	if err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Error moving snoozed email back from %s: %v").String(), sn.Folder, err)
+		ec.snoozer.Woken(sn.MessageID)
+		return uid
+	}
+	tb.replaceUid(sn.Tid, sn.Uid, cur)
+
+	return cur
+}
+
+func undoEmail(ec *EmailClient, tb *TelegramBot, mid int, id string) bool {
+
+	out, ok := ec.outbox.Cancel(id)
+	if !ok {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Email %s is already sent").String(), id)
+		return false
+	}
+	tb.ShowUndone(mid, out)
+
+	return true
+}
+
+// Draft mode: compose the email, save it to the Drafts folder and show it
+
+func previewEmail(ec *EmailClient, tb *TelegramBot, p *EmailPreview) {
+
+	at, message, err := parseSendAt(p.Message, tb.now())
+	if err != nil {
+		tb.SendMessage("Failed to schedule email: " + err.Error())
+		return
+	}
+	uid := p.Uid
+	if uid > 0 {
+		uid = unsnoozeEmail(ec, tb, uid)
+	}
+	mu.Lock()
+	ec.imap.StopIdle()
+	var out *OutgoingEmail
+	if uid > 0 {
+		out, err = ec.ComposeReply(uid, message, p.Files)
+	} else {
+		out = ec.ComposeMail(p.From, []string{p.To}, p.Subject, message, p.Files)
+	}
+	if err == nil {
+		out.SendAt = at
+		if old := tb.SetPreviewDraft(p.Mid, out.MessageID); old != "" {
+			if err := ec.DeleteDraft(old); err != nil {
+				log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to delete old draft %s: %v").String(), old, err)
+			}
+		}
+		if err := ec.SaveDraft(out); err != nil {
+			log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to save draft to IMAP: %v").String(), err)
+		}
+	}
+	if err := ec.startIdleWithHandler(); err != nil {
+		log.Fatalf(au.Gray(12, "[EMAIL]").String()+" "+au.Red(aurora.Bold("Failed to restart idle mode: %v")).String(), err)
+	}
+	mu.Unlock()
+	if err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Error composing draft of message %d: %v").String(), p.Mid, err)
+		tb.SendMessage("Failed to prepare email draft!")
+		return
+	}
+	if err := tb.ShowPreview(p.Mid, out); err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error showing draft of message %d: %v").String(), p.Mid, err)
+	}
+
+}
+
+func sendOrCancelPreview(ec *EmailClient, tb *TelegramBot, p *EmailPreview, send bool) {
+
+	mu.Lock()
+	ec.imap.StopIdle()
+	if err := ec.DeleteDraft(p.draftID); err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to delete draft %s: %v").String(), p.draftID, err)
+	}
+	if err := ec.startIdleWithHandler(); err != nil {
+		log.Fatalf(au.Gray(12, "[EMAIL]").String()+" "+au.Red(aurora.Bold("Failed to restart idle mode: %v")).String(), err)
+	}
+	mu.Unlock()
+	if !send {
+		return
+	}
+	if p.Uid > 0 {
+		replayToEmail(ec, tb, p.Uid, p.Tid, p.Message, p.Files)
+		return
 	}
-	d := ParseEmail(m, uid)
-	if err := tb.SendExpandEmailData(d, tid); err != nil {
+	sendNewEmail(ec, tb, p.Tid, p.From, p.To, p.Subject, p.Message, p.Files)
+
+}
+
+func expandEmail(ec *EmailClient, tb *TelegramBot, ai *OpenAIClient, uid int, tid int) {
+
+	mu.Lock()
+	ec.imap.StopIdle()
+	d, err := fetchEmailData(ec, uid)
+	if err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Error fetching email %d: %v").String(), uid, err)
 		tb.SendMessage("Failed to expand email!")
+	} else {
+		if res, ok := ai.CachedAnalysis(d.MessageID); ok {
+			d.applyAnalysis(res)
+		}
+		if err := tb.SendExpandEmailData(d, tid); err != nil {
+			tb.SendMessage("Failed to expand email!")
+		}
+		markSeen(ec, tb, uid)
+	}
+	if err := ec.startIdleWithHandler(); err != nil {
+		log.Fatalf(au.Gray(12, "[EMAIL]").String()+" "+au.Red(aurora.Bold("Failed to restart idle mode: %v")).String(), err)
+	}
+	mu.Unlock()
+
+}
+
+func draftReplyToEmail(ec *EmailClient, tb *TelegramBot, ai *OpenAIClient, uid int, tid int, language string) {
+
+	if ai == nil {
+		tb.SendMessage("AI features are disabled!")
+		return
+	}
+
+	// A snoozed email is read where it waits, only sending the reply brings it back
+
+	mu.Lock()
+	ec.imap.StopIdle()
+	var d *ParsedEmailData
+	var err error
+	if sn, ok := ec.snoozer.Snoozed(uid); ok {
+		var cur int
+		if cur, err = ec.findUID(sn.Folder, sn.MessageID); err == nil {
+			d, err = fetchEmailDataIn(ec, sn.Folder, cur)
+		}
+	} else {
+		d, err = fetchEmailData(ec, uid)
+	}
+	if err := ec.startIdleWithHandler(); err != nil {
+		log.Fatalf(au.Gray(12, "[EMAIL]").String()+" "+au.Red(aurora.Bold("Failed to restart idle mode: %v")).String(), err)
+	}
+	mu.Unlock()
+	if err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Error fetching email %d: %v").String(), uid, err)
+		tb.SendMessage("Failed to draft reply!")
+		return
+	}
+
+	if !ai.AllowedEmail(d) {
+		tb.SendMessage("This email is excluded from AI processing!")
+		return
+	}
+	draft, err := ai.DraftReply("Subject: "+d.Subject+" From: "+d.From+" To: "+d.To+" Body: "+stripMarkup(d.TextBody), language, firstAddress(d.From))
+	if err != nil {
+		log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Red("Failed to draft reply for email UID %d: %v").String(), uid, err)
+		tb.SendMessage("Failed to draft reply!")
+		return
+	}
+	if err := tb.SendDraftReply(uid, tid, draft, nil); err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error sending draft for email %d to Telegram: %v").String(), uid, err)
+		tb.SendMessage("Failed to draft reply!")
+	}
+
+}
+
+func summarizeThread(ec *EmailClient, tb *TelegramBot, ai *OpenAIClient, uids []int, tid int) {
+
+	if ai == nil {
+		tb.SendMessage("AI features are disabled!")
+		return
+	}
+
+	// Fetch every email of the conversation
+
+	mu.Lock()
+	ec.imap.StopIdle()
+	var thread strings.Builder
+	for i, uid := range uids {
+		d, err := fetchEmailData(ec, uid)
+		if err != nil {
+			log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Error fetching email %d: %v").String(), uid, err)
+			continue
+		}
+		if !ai.AllowedEmail(d) {
+			log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Yellow("Email UID %d is excluded from AI processing").String(), uid)
+			continue
+		}
+		fmt.Fprintf(&thread, "Email %d\nFrom: %s\nTo: %s\n", i+1, d.From, d.To)
+		if !d.Date.IsZero() {
+			fmt.Fprintf(&thread, "Date: %s\n", d.Date.Format(time.RFC1123Z))
+		}
+		fmt.Fprintf(&thread, "Subject: %s\nBody: %s\n\n", d.Subject, prepareEmailBody(d.TextBody))
+	}
+	if err := ec.startIdleWithHandler(); err != nil {
+		log.Fatalf(au.Gray(12, "[EMAIL]").String()+" "+au.Red(aurora.Bold("Failed to restart idle mode: %v")).String(), err)
+	}
+	mu.Unlock()
+
+	// Summarize
+
+	summary, err := ai.SummarizeThread(thread.String())
+	if err != nil {
+		log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Red("Failed to summarize topic %d: %v").String(), tid, err)
+		tb.SendMessage("Failed to summarize thread!")
+		return
+	}
+	if err := tb.SendThreadSummary(tid, summary); err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error sending summary to topic %d: %v").String(), tid, err)
+		tb.SendMessage("Failed to summarize thread!")
+	}
+
+}
+
+func reportUsage(tb *TelegramBot, ai *OpenAIClient, tid int) {
+
+	if ai == nil {
+		tb.SendMessage("AI features are disabled!")
+		return
+	}
+	if err := tb.SendHTMLMessage(tid, ai.UsageReport()); err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error sending usage report: %v").String(), err)
+	}
+
+}
+
+func translateEmail(ec *EmailClient, tb *TelegramBot, ai *OpenAIClient, uid int, tid int) {
+
+	if ai.Language() == "" {
+		tb.SendMessage("Translation is disabled!")
+		return
+	}
+
+	mu.Lock()
+	ec.imap.StopIdle()
+	d, err := fetchEmailData(ec, uid)
+	if err := ec.startIdleWithHandler(); err != nil {
+		log.Fatalf(au.Gray(12, "[EMAIL]").String()+" "+au.Red(aurora.Bold("Failed to restart idle mode: %v")).String(), err)
+	}
+	mu.Unlock()
+	if err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Error fetching email %d: %v").String(), uid, err)
+		tb.SendMessage("Failed to translate email!")
+		return
+	}
+
+	if !ai.AllowedEmail(d) {
+		tb.SendMessage("This email is excluded from AI processing!")
+		return
+	}
+	translation, err := ai.Translate(stripMarkup(d.TextBody), ai.Language(), firstAddress(d.From))
+	if err != nil {
+		log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Red("Failed to translate email UID %d: %v").String(), uid, err)
+		tb.SendMessage("Failed to translate email!")
+		return
+	}
+	if err := tb.SendHTMLMessage(tid, "🌐 <b>TRANSLATION</b>\n\n"+html.EscapeString(translation)+telehtml.EncodeIntInvisible(uid)); err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error sending translation for email %d: %v").String(), uid, err)
+	}
+
+}
+
+func translateReply(tb *TelegramBot, ai *OpenAIClient, uid int, tid int, msg string, files []struct{ Url, Name string }, language string) {
+
+	line, msg := cutSendAtLine(msg)
+	translation, err := ai.Translate(stripMarkup(msg), language, "")
+	if err != nil {
+		log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Red("Failed to translate reply to email UID %d: %v").String(), uid, err)
+		tb.SendMessage("Failed to translate reply!")
+		return
+	}
+	if line != "" {
+		translation = line + "\n" + translation
+	}
+	if err := tb.SendDraftReply(uid, tid, translation, files); err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error sending translated reply for email %d: %v").String(), uid, err)
+		tb.SendMessage("Failed to translate reply!")
+	}
+
+}
+
+// Index of the event in the email, -1 for the first invitation
+
+func replyToEvent(ec *EmailClient, tb *TelegramBot, uid int, mid int, index int, partstat string) {
+
+	mu.Lock()
+	ec.imap.StopIdle()
+	d, err := fetchEmailData(ec, uid)
+	if err == nil {
+		err = fmt.Errorf("no invitation in email %d", uid)
+		for i, ev := range d.Events {
+			if (index < 0 || i == index) && ev.Method == "REQUEST" && ev.Organizer != "" {
+				err = ec.SendCalendarReply(ev, partstat)
+				break
+			}
+		}
+	}
+	if err := ec.startIdleWithHandler(); err != nil {
+		log.Fatalf(au.Gray(12, "[EMAIL]").String()+" "+au.Red(aurora.Bold("Failed to restart idle mode: %v")).String(), err)
+	}
+	mu.Unlock()
+	if err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Failed to reply to invitation in email %d: %v").String(), uid, err)
+		tb.SendMessage("Failed to reply to invitation!")
+		return
+	}
+	tb.MarkEventReplied(mid, partstat)
+
+}
+
+// Attachment by part id, the whole email is parsed only for parts the server cannot serve alone
+
+func getAttachment(ec *EmailClient, tb *TelegramBot, uid int, tid int, part string) {
+
+	var name string
+	var content []byte
+	var found bool
+	mu.Lock()
+	ec.imap.StopIdle()
+	var err error
+	if !strings.HasPrefix(part, "~") && !strings.HasPrefix(part, "@") {
+		name, content, err = ec.FetchPart(uid, part)
+		if err != nil {
+			log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to fetch part %s of email %d, fetching the whole email: %v").String(), part, uid, err)
+		}
+		found = err == nil
+	}
+	if !found {
+		var d *ParsedEmailData
+		if d, err = fetchEmailData(ec, uid); err == nil {
+			name, content, found = d.Part(part)
+		}
 	}
 	if err := ec.startIdleWithHandler(); err != nil {
 		log.Fatalf(au.Gray(12, "[EMAIL]").String()+" "+au.Red(aurora.Bold("Failed to restart idle mode: %v")).String(), err)
 	}
 	mu.Unlock()
+	if err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Error fetching email %d: %v").String(), uid, err)
+		tb.SendMessage("Failed to get attachment!")
+		return
+	}
+	if !found {
+		tb.SendMessage("Attachment not found!")
+		return
+	}
+	if err := tb.SendAttachment(tid, uid, name, content); err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error sending attachment of email %d: %v").String(), uid, err)
+		tb.SendMessage("Failed to get attachment!")
+	}
+
+}
+
+func sendEmailSource(ec *EmailClient, tb *TelegramBot, uid int, tid int, headersOnly bool) {
+
+	mu.Lock()
+	ec.imap.StopIdle()
+	raw, err := ec.FetchRawMail(uid)
+	if err := ec.startIdleWithHandler(); err != nil {
+		log.Fatalf(au.Gray(12, "[EMAIL]").String()+" "+au.Red(aurora.Bold("Failed to restart idle mode: %v")).String(), err)
+	}
+	mu.Unlock()
+	if err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Error fetching raw email %d: %v").String(), uid, err)
+		tb.SendMessage("Failed to fetch original email!")
+		return
+	}
+
+	if headersOnly {
+		err = tb.SendHTMLMessage(tid, formatHeaderDump(raw, uid))
+	} else {
+		err = tb.SendEML(tid, uid, raw)
+	}
+	if err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error sending original email %d: %v").String(), uid, err)
+		tb.SendMessage("Failed to send original email!")
+	}
 
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"mime"
+	"strings"
+)
+
+type rawHeader struct {
+	Name  string
+	Value string
+	Raw   string
+}
+
+var headerDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// Header block of an RFC 822 message, unfolded and with encoded words and 8-bit text decoded
+
+func parseRawHeaders(raw []byte) []rawHeader {
+
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	if i := bytes.Index(raw, []byte("\n\n")); i >= 0 {
+		raw = raw[:i]
+	}
+
+	var headers []rawHeader
+	for _, line := range strings.Split(string(raw), "\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1].Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		headers = append(headers, rawHeader{Name: strings.TrimSpace(name), Value: strings.TrimSpace(value)})
+	}
+	for i, h := range headers {
+		headers[i].Raw = h.Value
+		headers[i].Value = decodeHeaderValue(h.Value)
+	}
+
+	return headers
+}
+
+func headerValues(headers []rawHeader, name string) []string {
+
+	var values []string
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, name) {
+			values = append(values, h.Value)
+		}
+	}
+
+	return values
+}
+
+// Telegram HTML dump, delivery related headers first
+
+func formatHeaderDump(raw []byte, uid int) string {
+
+	headers := parseRawHeaders(raw)
+	text := fmt.Sprintf("🔍 <b>HEADERS</b> (UID %d)\n", uid)
+	if values := headerValues(headers, "Return-Path"); len(values) > 0 {
+		text += "\n<b>Return-Path:</b> <code>" + html.EscapeString(values[0]) + "</code>\n"
+	}
+	if values := headerValues(headers, "Authentication-Results"); len(values) > 0 {
+		text += "\n<b>Authentication-Results:</b>\n"
+		for _, v := range values {
+			text += "<code>" + html.EscapeString(v) + "</code>\n"
+		}
+	}
+
+	// Received headers are prepended by every hop, so the first hop is the last one
+
+	if values := headerValues(headers, "Received"); len(values) > 0 {
+		text += "\n<b>Received chain:</b>\n"
+		for i := len(values) - 1; i >= 0; i-- {
+			text += fmt.Sprintf("%d. <code>%s</code>\n", len(values)-i, html.EscapeString(values[i]))
+		}
+	}
+
+	text += "\n<b>All headers:</b>\n<pre>"
+	for _, h := range headers {
+		text += html.EscapeString(h.Name+": "+h.Value) + "\n"
+	}
+	text += "</pre>"
+
+	return text
+}
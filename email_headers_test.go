@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRawHeaders(t *testing.T) {
+
+	raw := "Received: from a.example.com\r\n" +
+		"\tby b.example.com; Mon, 15 Jan 2024 10:00:00 +0000\r\n" +
+		"Received: from c.example.com\r\n" +
+		"Subject: =?UTF-8?B?0J/RgNC40LLQtdGC?=\r\n" +
+		"X-Broken line without colon\r\n" +
+		"To:  bob@example.com \r\n" +
+		"\r\n" +
+		"Body: not a header\r\n"
+	headers := parseRawHeaders([]byte(raw))
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"Received", []string{"from a.example.com by b.example.com; Mon, 15 Jan 2024 10:00:00 +0000", "from c.example.com"}},
+		{"subject", []string{"Привет"}},
+		{"To", []string{"bob@example.com"}},
+		{"Body", nil},
+	}
+	for _, tt := range tests {
+		if got := headerValues(headers, tt.name); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("headerValues(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	for _, h := range headers {
+		if h.Name == "Subject" && h.Raw != "=?UTF-8?B?0J/RgNC40LLQtdGC?=" {
+			t.Errorf("Subject raw value = %q", h.Raw)
+		}
+	}
+	if len(headers) != 4 {
+		t.Errorf("parseRawHeaders returned %d headers, want 4", len(headers))
+	}
+
+}
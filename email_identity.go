@@ -0,0 +1,138 @@
+package main
+
+import (
+	"html"
+	"net/mail"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Sender identity from an [identity] or [identity.<name>] section, the one without
+// an address is the account itself
+
+type Identity struct {
+	Key           string
+	Name          string
+	Address       string
+	Signature     string
+	SignatureHTML string
+}
+
+// Value of a signature key, a path to a file or the text itself with \n for line breaks
+
+func readSignature(value string) string {
+
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ""
+	}
+	if info, err := os.Stat(value); err == nil && info.Mode().IsRegular() {
+		if b, err := os.ReadFile(value); err == nil {
+			return strings.TrimSpace(string(b))
+		}
+	}
+
+	return strings.ReplaceAll(value, `\n`, "\n")
+}
+
+// From header value, the display name is encoded when needed
+
+func (id Identity) From(username string) string {
+
+	address := id.SenderAddress(username)
+	if id.Name == "" {
+		return address
+	}
+
+	return (&mail.Address{Name: id.Name, Address: address}).String()
+}
+
+func (id Identity) SenderAddress(username string) string {
+
+	if id.Address == "" {
+		return username
+	}
+
+	return id.Address
+}
+
+func (id Identity) Sign(text string, body string) (string, string) {
+
+	if id.Signature == "" && id.SignatureHTML == "" {
+		return text, body
+	}
+	plain := id.Signature
+	if plain == "" {
+		plain = stripMarkup(id.SignatureHTML)
+	}
+	signature := id.SignatureHTML
+	if signature == "" {
+		signature = strings.ReplaceAll(html.EscapeString(id.Signature), "\n", "<br>")
+	}
+
+	return text + "\n\n-- \n" + plain, body + `<div class="signature"><br>-- <br>` + signature + "</div>"
+}
+
+// Identity by section name or address, the default one if nothing matches
+
+func (ec *EmailClient) identity(key string) Identity {
+
+	key = strings.ToLower(strings.TrimSpace(key))
+	for _, id := range ec.identities {
+		if key != "" && (strings.ToLower(id.Key) == key || strings.ToLower(id.Address) == key) {
+			return id
+		}
+	}
+	for _, id := range ec.identities {
+		if id.Address == "" || strings.EqualFold(id.Address, ec.username) {
+			return id
+		}
+	}
+
+	return Identity{}
+}
+
+// Names and addresses a "From:" line accepts, the account address is always one of them
+
+func (ec *EmailClient) IdentityNames() []string {
+
+	names := []string{ec.username}
+	for _, id := range ec.identities {
+		for _, name := range []string{id.Key, id.Address} {
+			if name != "" && !slices.ContainsFunc(names, func(n string) bool { return strings.EqualFold(n, name) }) {
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names
+}
+
+// Empty means the default identity, anything else must be configured, a typo
+// is not sent from the default one
+
+func (ec *EmailClient) KnownIdentity(key string) bool {
+
+	key = strings.TrimSpace(key)
+
+	return key == "" || slices.ContainsFunc(ec.IdentityNames(), func(n string) bool { return strings.EqualFold(n, key) })
+}
+
+// Alias the original email was sent to, the default identity if none of them
+
+func (ec *EmailClient) replyIdentity(recipients ...map[string]string) Identity {
+
+	for _, id := range ec.identities {
+		if id.Address == "" {
+			continue
+		}
+		for _, list := range recipients {
+			if _, ok := list[strings.ToLower(id.Address)]; ok {
+				return id
+			}
+		}
+	}
+
+	return ec.identity("")
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestKnownIdentity(t *testing.T) {
+
+	ec := &EmailClient{username: "me@example.com", identities: []Identity{
+		{Name: "Me"},
+		{Key: "work", Address: "me@work.example.com"},
+	}}
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"", true},
+		{"work", true},
+		{" Work ", true},
+		{"ME@WORK.EXAMPLE.COM", true},
+		{"me@example.com", true},
+		{"wrok", false},
+		{"other@example.com", false},
+	}
+	for _, tt := range tests {
+		if got := ec.KnownIdentity(tt.key); got != tt.want {
+			t.Errorf("KnownIdentity(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+	if got := ec.identity("work").Address; got != "me@work.example.com" {
+		t.Errorf("identity(work) = %q", got)
+	}
+
+}
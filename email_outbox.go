@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var errOutboxStopped = errors.New("not sent, the bot was stopped before the undo window ended")
+
+// Outgoing emails held back for the undo window before they are handed to SMTP
+
+type queuedEmail struct {
+	out   *OutgoingEmail
+	timer *time.Timer
+	done  func(error)
+}
+
+type Outbox struct {
+	delay   time.Duration
+	send    func(out *OutgoingEmail) error
+	pending map[string]*queuedEmail
+	mu      sync.Mutex
+}
+
+func NewOutbox(delay time.Duration, send func(out *OutgoingEmail) error) *Outbox {
+
+	return &Outbox{delay: delay, send: send, pending: make(map[string]*queuedEmail)}
+}
+
+func (o *Outbox) Delay() time.Duration {
+
+	if o == nil {
+		return 0
+	}
+
+	return o.delay
+}
+
+// Short id for callback data, Message-IDs can exceed its 64 bytes
+
+func newOutboxID() string {
+
+	b := make([]byte, 6)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// Sends the email when the delay expires, done gets the SMTP result
+
+func (o *Outbox) Enqueue(id string, out *OutgoingEmail, done func(error)) {
+
+	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Cyan("Email %s to %v queued for %s").String(), id, out.To, o.delay)
+	q := &queuedEmail{out: out, done: done}
+	o.mu.Lock()
+	o.pending[id] = q
+	q.timer = time.AfterFunc(o.delay, func() {
+		o.deliver(id)
+	})
+	o.mu.Unlock()
+
+}
+
+func (o *Outbox) deliver(id string) {
+
+	o.mu.Lock()
+	q, ok := o.pending[id]
+	delete(o.pending, id)
+	o.mu.Unlock()
+	if !ok {
+		return
+	}
+	err := o.send(q.out)
+	if err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Failed to send queued email %s: %v").String(), id, err)
+	}
+	if q.done != nil {
+		q.done(err)
+	}
+
+}
+
+// Removes the email from the queue, false when it is already sent or unknown
+
+func (o *Outbox) Cancel(id string) (*OutgoingEmail, bool) {
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	q, ok := o.pending[id]
+	if !ok || !q.timer.Stop() {
+		return nil, false
+	}
+	delete(o.pending, id)
+	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Blue("Queued email %s cancelled").String(), id)
+
+	return q.out, true
+}
+
+// Drops everything still waiting, used on shutdown: sending early would skip the undo
+// window the user relies on, done gets errOutboxStopped so the text can be sent again
+
+func (o *Outbox) Drop() {
+
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	var dropped []*queuedEmail
+	for id, q := range o.pending {
+		if q.timer.Stop() {
+			dropped = append(dropped, q)
+			delete(o.pending, id)
+		}
+	}
+	o.mu.Unlock()
+	for _, q := range dropped {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Queued email to %v dropped on shutdown").String(), q.out.To)
+		if q.done != nil {
+			q.done(errOutboxStopped)
+		}
+	}
+
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutboxDrop(t *testing.T) {
+
+	sent := 0
+	o := NewOutbox(time.Hour, func(out *OutgoingEmail) error {
+		sent++
+		return nil
+	})
+	var got error
+	o.Enqueue("a", &OutgoingEmail{To: []string{"x@example.com"}}, func(err error) { got = err })
+	o.Drop()
+	if sent != 0 || got != errOutboxStopped {
+		t.Errorf("Drop sent %d emails, done got %v", sent, got)
+	}
+	if _, ok := o.Cancel("a"); ok {
+		t.Error("Cancel found a dropped email")
+	}
+
+}
+
+func TestOutboxCancel(t *testing.T) {
+
+	done := make(chan error, 1)
+	o := NewOutbox(10*time.Millisecond, func(out *OutgoingEmail) error { return nil })
+	o.Enqueue("a", &OutgoingEmail{}, nil)
+	if _, ok := o.Cancel("a"); !ok {
+		t.Error("Cancel within the delay failed")
+	}
+	o.Enqueue("b", &OutgoingEmail{}, func(err error) { done <- err })
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := o.Cancel("b"); ok {
+		t.Error("Cancel after sending succeeded")
+	}
+
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"log"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/BrianLeishman/go-imap"
+	"github.com/jhillyerd/enmime"
+)
+
+// Composed email, kept unsigned until it is sent so it can be saved as a draft
+
+type OutgoingEmail struct {
+	Uid       int
+	From      string
+	To        []string
+	Subject   string
+	Text      string
+	Files     []string
+	MessageID string
+	Raw       string
+	Contacts  map[string]string
+	SendAt    time.Time
+
+	// Quotes a decrypted email, never stored on the server as is
+	QuotesEncrypted bool
+}
+
+func newMessageID(address string) string {
+
+	b := make([]byte, 12)
+	rand.Read(b)
+	domain := addressDomain(address)
+	if domain == "" {
+		domain = "localhost"
+	}
+
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
+
+func (ec *EmailClient) Send(out *OutgoingEmail) error {
+
+	msg, err := ec.crypto.Protect(out.Raw, out.To)
+	if err != nil {
+		return err
+	}
+
+	// Send
+
+	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Magenta("Sending email via SMTP to %v").String(), out.To)
+	err = smtp.SendMail(
+		fmt.Sprintf("%s:%d", ec.smtpHost, ec.smtpPort),
+		smtp.PlainAuth("", ec.username, ec.password, ec.smtpHost),
+		ec.username,
+		out.To,
+		[]byte(msg),
+	)
+	if err != nil {
+		return fmt.Errorf("smtp error: %s", err)
+	}
+
+	for address, name := range out.Contacts {
+		ec.contacts.Learn(name, address)
+	}
+	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Green(au.Bold("Successfully sent email to %s")).String(), strings.Join(out.To, ", "))
+
+	return nil
+}
+
+// Swaps links in the body, the message is built again from its text, HTML and attachments
+
+func (out *OutgoingEmail) ReplaceLinks(links map[string]string) error {
+
+	env, err := enmime.ReadEnvelope(strings.NewReader(out.Raw))
+	if err != nil {
+		return err
+	}
+	var pairs []string
+	for old, url := range links {
+		pairs = append(pairs, old, url, html.EscapeString(old), html.EscapeString(url))
+	}
+	r := strings.NewReplacer(pairs...)
+	attachments := make(map[string][]byte)
+	for _, a := range env.Attachments {
+		attachments[a.FileName] = a.Content
+	}
+	out.Text = r.Replace(out.Text)
+	out.Raw = getAlternativeMsg(out.From, out.To, out.Subject, out.MessageID, r.Replace(env.Text), r.Replace(env.HTML), attachments)
+
+	return nil
+}
+
+// Drafts
+
+func (ec *EmailClient) SaveDraft(out *OutgoingEmail) error {
+
+	if out.QuotesEncrypted {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Draft %s quotes an encrypted email, not saving it to the server").String(), out.MessageID)
+		return nil
+	}
+	if err := ec.reconnectIfNeeded(); err != nil {
+		return err
+	}
+	folder := ec.specialFolder(`\Drafts`, "Drafts")
+	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Cyan("Saving draft %s to %s").String(), out.MessageID, folder)
+	raw := toCRLF([]byte(out.Raw))
+	command := fmt.Sprintf(`APPEND "%s" (\Draft \Seen)`, imap.AddSlashes.Replace(folder))
+
+	// Only a non-synchronizing literal (RFC 7888), the library cannot wait for a continuation
+
+	if !ec.hasCapability("LITERAL+") && !(ec.hasCapability("LITERAL-") && len(raw) <= 4096) {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Server takes no non-synchronizing literal, draft %s is not saved").String(), out.MessageID)
+		return nil
+	}
+	_, err := ec.imap.Exec(fmt.Sprintf("%s {%d+}\r\n%s", command, len(raw), raw), false, 0, nil)
+
+	return err
+}
+
+func (ec *EmailClient) DeleteDraft(messageID string) error {
+
+	if messageID == "" {
+		return nil
+	}
+	if err := ec.reconnectIfNeeded(); err != nil {
+		return err
+	}
+	folder := ec.specialFolder(`\Drafts`, "Drafts")
+	if err := ec.selectFolder(folder); err != nil {
+		return err
+	}
+	uids, err := ec.imap.GetUIDs(`HEADER Message-ID "` + imap.AddSlashes.Replace(messageID) + `"`)
+	if err != nil {
+		return err
+	}
+	for _, uid := range uids {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Cyan("Deleting draft UID %d from %s").String(), uid, folder)
+		if err := ec.imap.DeleteEmail(uid); err != nil {
+			return err
+		}
+	}
+	if len(uids) == 0 {
+		return nil
+	}
+
+	return ec.expungeUIDs(uids...)
+}
+
+// Server capabilities, read once after login
+
+func (ec *EmailClient) hasCapability(name string) bool {
+
+	ec.dataMu.Lock()
+	defer ec.dataMu.Unlock()
+	if ec.caps == nil {
+		ec.caps = make(map[string]bool)
+		_, err := ec.imap.Exec("CAPABILITY", false, imap.RetryCount, func(line []byte) error {
+			if rest, ok := bytes.CutPrefix(bytes.TrimRight(line, "\r\n"), []byte("* CAPABILITY ")); ok {
+				for _, c := range strings.Fields(string(rest)) {
+					ec.caps[strings.ToUpper(c)] = true
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to read server capabilities: %v").String(), err)
+			ec.caps = nil
+			return false
+		}
+	}
+
+	return ec.caps[strings.ToUpper(name)]
+}
+
+// Folder with a special-use attribute (RFC 6154), the fallback name if the server has none
+
+func (ec *EmailClient) specialFolder(attr string, fallback string) string {
+
+	ec.dataMu.Lock()
+	defer ec.dataMu.Unlock()
+	if ec.folders == nil {
+		ec.folders = make(map[string]string)
+		_, err := ec.imap.Exec(`LIST "" "*"`, false, imap.RetryCount, func(line []byte) error {
+			attrs, name, ok := parseListLine(line)
+			for _, a := range attrs {
+				if ok && a != `\HasChildren` && a != `\HasNoChildren` {
+					ec.folders[strings.ToLower(a)] = name
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to list folders: %v").String(), err)
+		}
+	}
+	if name := ec.folders[strings.ToLower(attr)]; name != "" {
+		return name
+	}
+
+	return fallback
+}
+
+// Attributes and mailbox name of a "* LIST (\\HasNoChildren) "/" Name" response line
+
+func parseListLine(line []byte) (attrs []string, name string, ok bool) {
+
+	line = bytes.TrimRight(line, "\r\n")
+	open, close := bytes.IndexByte(line, '('), bytes.IndexByte(line, ')')
+	if !bytes.HasPrefix(line, []byte("* LIST")) || open < 0 || close < open {
+		return nil, "", false
+	}
+
+	return strings.Fields(string(line[open+1 : close])), listMailboxName(string(line[close+1:])), true
+}
+
+// Mailbox name after the attributes of a LIST response: "/" "Name" or "/" Name
+
+func listMailboxName(rest string) string {
+
+	rest = strings.TrimSpace(rest)
+	if strings.HasPrefix(rest, `"`) {
+		if end := strings.Index(rest[1:], `"`); end >= 0 {
+			rest = strings.TrimSpace(rest[end+2:])
+		}
+	} else if _, after, ok := strings.Cut(rest, " "); ok {
+		rest = strings.TrimSpace(after)
+	}
+
+	if len(rest) >= 2 && rest[0] == '"' && rest[len(rest)-1] == '"' {
+		rest = rest[1 : len(rest)-1]
+	}
+
+	return imap.RemoveSlashes.Replace(rest)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/jhillyerd/enmime"
+)
+
+func TestReplaceLinks(t *testing.T) {
+
+	old := "https://api.telegram.org/file/bot1:x/documents/file_1.pdf"
+	fresh := "https://api.telegram.org/file/bot1:x/documents/file_2.pdf"
+	text, body := composeBody("See <b>the file</b>", []struct{ Url, Name string }{{old, "report.pdf"}})
+	out := &OutgoingEmail{From: "me@example.com", To: []string{"you@example.com"}, Subject: "Report", Text: text, MessageID: "<1@example.com>"}
+	out.Raw = getAlternativeMsg(out.From, out.To, out.Subject, out.MessageID, text, body, map[string][]byte{"quoted.txt": []byte("quoted")})
+
+	if err := out.ReplaceLinks(map[string]string{old: fresh}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.Text, old) || !strings.Contains(out.Text, fresh) {
+		t.Errorf("text = %q", out.Text)
+	}
+	env, err := enmime.ReadEnvelope(bytes.NewReader([]byte(out.Raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, part := range map[string]string{"text": env.Text, "html": env.HTML} {
+		if strings.Contains(part, old) || !strings.Contains(part, fresh) {
+			t.Errorf("%s part = %q", name, part)
+		}
+	}
+	if !strings.Contains(env.HTML, "<b>the file</b>") || env.GetHeader("Subject") != "Report" || env.GetHeader("Message-ID") != "<1@example.com>" {
+		t.Errorf("message changed beyond the links: %s", out.Raw)
+	}
+	if len(env.Attachments) != 1 || string(env.Attachments[0].Content) != "quoted" {
+		t.Errorf("attachments = %+v", env.Attachments)
+	}
+
+}
+
+func TestParseListLine(t *testing.T) {
+
+	tests := []struct {
+		line  string
+		attrs []string
+		name  string
+		ok    bool
+	}{
+		{"* LIST (\\HasNoChildren \\Sent) \"/\" \"Sent Items\"\r\n", []string{`\HasNoChildren`, `\Sent`}, "Sent Items", true},
+		{"* LIST (\\Noselect \\HasChildren) \"/\" \"[Gmail]\"", []string{`\Noselect`, `\HasChildren`}, "[Gmail]", true},
+		{"* LIST () \".\" Archive", nil, "Archive", true},
+		{"* LIST (\\HasNoChildren) \"/\" \"Quote \\\"d\\\"\"", []string{`\HasNoChildren`}, `Quote "d"`, true},
+		{"* OK done", nil, "", false},
+	}
+	for _, tt := range tests {
+		attrs, name, ok := parseListLine([]byte(tt.line))
+		if ok != tt.ok || name != tt.name || strings.Join(attrs, " ") != strings.Join(tt.attrs, " ") {
+			t.Errorf("parseListLine(%q) = %q, %q, %v", tt.line, attrs, name, ok)
+		}
+	}
+
+}
@@ -1,54 +1,423 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"html"
+	"log"
+	"mime"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/BrianLeishman/go-imap"
-	telehtml "github.com/svanichkin/TelegramHTML"
+	"github.com/jhillyerd/enmime"
 )
 
 type ParsedEmailData struct {
 	Uid         int
+	MessageID   string
 	From        string
+	FromAddress string
+	FromName    string
 	To          string
 	Subject     string
+	Date        time.Time
 	TextBody    string
 	Summary     string
+	Language    string
 	Unsubscrube string
 	Type        EmailType
 	Attachments map[string][]byte
+	Parts       map[string]string
+	Images      []EmailImage
+	Events      []CalendarEvent
+	Auth        AuthResults
+	Spoofing    string
+	Crypto      *CryptoStatus
 }
 
-func ParseEmail(mail *imap.Email, uid int) *ParsedEmailData {
+type EmailImage struct {
+	Name    string
+	Part    string
+	Content []byte
+}
+
+func ParseEmail(mail *imap.Email, raw []byte, uid int) *ParsedEmailData {
 
 	// Compile fields
 
 	data := &ParsedEmailData{
-		Uid: uid,
+		Uid:       uid,
+		MessageID: mail.MessageID,
 
 		From: parseAddressList(mail.From),
 		To:   parseAddressList(mail.To),
 
 		Subject:     mail.Subject,
-		TextBody:    mail.Text,
+		Date:        mail.Sent,
+		TextBody:    cleanTextLinks(mail.Text),
 		Attachments: make(map[string][]byte),
+		Parts:       make(map[string]string),
 		Type:        TypeUnknown,
 	}
 
+	for _, address := range sortedKeys(mail.From) {
+		data.FromAddress, data.FromName = address, mail.From[address]
+		break
+	}
+
 	if len(mail.Attachments) > 0 {
 		for _, a := range mail.Attachments {
+			if isPhoto(a.MimeType) {
+				data.Images = append(data.Images, EmailImage{Name: a.Name, Content: a.Content})
+				continue
+			}
 			data.Attachments[a.Name] = a.Content
 		}
 	}
 
 	if mail.HTML != "" {
-		data.TextBody = telehtml.CleanTelegramHTML(mail.HTML)
+		data.TextBody = renderHTML(mail.HTML)
+	}
+
+	// Parts the IMAP library drops, from the raw message
+
+	if len(raw) > 0 {
+		env, err := rawCharsetParser.ReadEnvelope(bytes.NewReader(raw))
+		if err != nil {
+			log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to parse raw email UID %d: %v").String(), uid, err)
+		} else {
+			headers := parseRawHeaders(raw)
+			data.applyCharsets(env, headers)
+			data.Auth = parseAuthResults(headers)
+			data.Events = parseCalendarParts(env)
+			data.Images = append(data.Images, parseInlineImages(env)...)
+		}
 	}
 
 	return data
 }
 
+// Body and attachments from a rewritten raw message, the same way the IMAP library fills them
+
+func replaceBody(mail *imap.Email, raw []byte) error {
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	setBody(mail, env)
+
+	return nil
+}
+
+func setBody(mail *imap.Email, env *enmime.Envelope) {
+
+	mail.Text = env.Text
+	mail.HTML = env.HTML
+	mail.Attachments = nil
+	for _, parts := range [][]*enmime.Part{env.Attachments, env.Inlines} {
+		for _, a := range parts {
+			mail.Attachments = append(mail.Attachments, imap.Attachment{Name: a.FileName, MimeType: a.ContentType, Content: a.Content})
+		}
+	}
+
+}
+
+// Subject, addresses, body and attachments from the raw message, over the envelope ones
+
+func fillFromRaw(mail *imap.Email, raw []byte) error {
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	setBody(mail, env)
+	mail.Subject = env.GetHeader("Subject")
+	for _, a := range []struct {
+		dest   *imap.EmailAddresses
+		header string
+	}{
+		{&mail.From, "From"},
+		{&mail.ReplyTo, "Reply-To"},
+		{&mail.To, "To"},
+		{&mail.CC, "cc"},
+		{&mail.BCC, "bcc"},
+	} {
+		list, _ := env.AddressList(a.header)
+		*a.dest = make(imap.EmailAddresses, len(list))
+		for _, addr := range list {
+			(*a.dest)[strings.ToLower(addr.Address)] = addr.Name
+		}
+	}
+
+	return nil
+}
+
+func parseCalendarParts(env *enmime.Envelope) []CalendarEvent {
+
+	var events []CalendarEvent
+	seen := make(map[string]bool)
+	parts := env.Root.DepthMatchAll(func(p *enmime.Part) bool {
+		return p.ContentType == "text/calendar" || p.ContentType == "application/ics"
+	})
+	for _, p := range parts {
+		for _, ev := range parseICS(decodeText(partContent(p), p.Charset), p.ContentTypeParams["method"]) {
+			if ev.UID != "" && seen[ev.UID] {
+				continue
+			}
+			seen[ev.UID] = true
+			events = append(events, ev)
+		}
+	}
+
+	return events
+}
+
+// Attachments and images of an envelope, winmail.dat is unpacked and forwarded
+// messages are quoted into the body with their own attachments
+
+const maxNestedMessages = 5
+
+// Telegram does not allow quotes inside quotes
+
+var unquoteReplacer = strings.NewReplacer("<blockquote>", "", "<blockquote expandable>", "", "</blockquote>", "")
+
+// Part ids are IMAP body sections ("2", "1.3"), so one file can be fetched on its own.
+// Files unpacked from winmail.dat add "#n" to the section of the container.
+
+func (d *ParsedEmailData) addParts(env *enmime.Envelope, depth int, prefix string) {
+
+	nested := env.Root.BreadthMatchAll(func(p *enmime.Part) bool {
+		return p.Disposition == "" && (p.ContentType == "message/rfc822" || isTNEF(p.ContentType, ""))
+	})
+	for _, parts := range [][]*enmime.Part{env.Attachments, env.Inlines, nested} {
+		for _, p := range parts {
+			name, content, section := decodeFileName(p), partContent(p), partSection(p, prefix)
+			switch {
+			case isTNEF(p.ContentType, name):
+				if d.addTNEF(content, section) {
+					continue
+				}
+			case p.ContentType == "message/rfc822" && depth < maxNestedMessages:
+				if d.addNestedMessage(content, depth+1, section) {
+					continue
+				}
+			}
+			d.addAttachment(attachmentName(name, p.ContentType), p.ContentType, content, section)
+		}
+	}
+
+}
+
+func (d *ParsedEmailData) addAttachment(name string, mimeType string, content []byte, part string) {
+
+	if isPhoto(mimeType) {
+		d.Images = append(d.Images, EmailImage{Name: name, Part: part, Content: content})
+		return
+	}
+
+	// Nested messages often carry files with the same names
+
+	unique := name
+	for i := 2; d.Attachments[unique] != nil; i++ {
+		ext := path.Ext(name)
+		unique = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	d.Attachments[unique] = content
+	d.Parts[unique] = part
+
+}
+
+func attachmentName(name string, mimeType string) string {
+
+	if name == "" && mimeType == "message/rfc822" {
+		return "message.eml"
+	}
+
+	return name
+}
+
+// IMAP section of a part, prefix is the section of the enclosing message/rfc822 plus a dot
+
+func partSection(p *enmime.Part, prefix string) string {
+
+	var nums []string
+	for c := p; c.Parent != nil; c = c.Parent {
+		i := 1
+		for s := c.Parent.FirstChild; s != nil && s != c; s = s.NextSibling {
+			i++
+		}
+		nums = append([]string{strconv.Itoa(i)}, nums...)
+	}
+	if len(nums) == 0 {
+		nums = []string{"1"}
+	}
+
+	return prefix + strings.Join(nums, ".")
+}
+
+func (d *ParsedEmailData) addTNEF(content []byte, section string) bool {
+
+	t, err := decodeTNEF(content)
+	if err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to unpack winmail.dat: %v").String(), err)
+		return false
+	}
+	switch {
+	case strings.TrimSpace(d.TextBody) != "":
+	case t.HTML != "":
+		d.TextBody = renderHTML(t.HTML)
+	default:
+		d.TextBody = html.EscapeString(cleanTextLinks(t.Body))
+	}
+	for i, a := range t.Attachments {
+		d.addAttachment(a.Name, tnefMimeType(a), a.Content, fmt.Sprintf("%s#%d", section, i))
+	}
+
+	return true
+}
+
+func tnefMimeType(a *TNEFAttachment) string {
+
+	if a.MimeType != "" {
+		return a.MimeType
+	}
+
+	return mime.TypeByExtension(path.Ext(a.Name))
+}
+
+// Forwarded message as a quote with its own From, Date and Subject
+
+func (d *ParsedEmailData) addNestedMessage(raw []byte, depth int, section string) bool {
+
+	env, err := rawCharsetParser.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to parse forwarded message: %v").String(), err)
+		return false
+	}
+	headers := parseRawHeaders(raw)
+	quote := "\n\n<blockquote expandable>📎 <b>Forwarded message</b>\n"
+	for _, name := range []string{"From", "Date", "Subject", "To"} {
+		if values := headerValues(headers, name); len(values) > 0 {
+			quote += "<b>" + name + ":</b> " + html.EscapeString(values[0]) + "\n"
+		}
+	}
+	quote += "\n" + strings.TrimSpace(unquoteReplacer.Replace(envelopeBody(env))) + "</blockquote>"
+	d.TextBody += quote
+	d.addParts(env, depth, section+".")
+
+	return true
+}
+
+// Images referenced from HTML by cid: without a disposition, the IMAP library drops them
+
+func parseInlineImages(env *enmime.Envelope) []EmailImage {
+
+	var images []EmailImage
+	for _, p := range env.OtherParts {
+		if p.ContentID == "" || !isPhoto(p.ContentType) || len(p.Content) == 0 {
+			continue
+		}
+		name := decodeFileName(p)
+		if name == "" {
+			name = p.ContentID
+		}
+		images = append(images, EmailImage{Name: name, Part: partSection(p, ""), Content: partContent(p)})
+	}
+
+	return images
+}
+
+// Formats Telegram accepts as photos, everything else goes as a document
+
+func isPhoto(mimeType string) bool {
+
+	switch strings.ToLower(mimeType) {
+	case "image/jpeg", "image/jpg", "image/pjpeg", "image/png", "image/webp":
+		return true
+	}
+
+	return false
+}
+
+// Attachment names in a stable order
+
+func (d *ParsedEmailData) AttachmentNames() []string {
+
+	names := make([]string, 0, len(d.Attachments))
+	for name := range d.Attachments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// File by its part id, among attachments and images. "@n" is the n-th attachment name,
+// for emails whose parts could not be numbered.
+
+func (d *ParsedEmailData) Part(id string) (string, []byte, bool) {
+
+	if index, ok := strings.CutPrefix(id, "@"); ok {
+		names := d.AttachmentNames()
+		i, err := strconv.Atoi(index)
+		if err != nil || i < 0 || i >= len(names) {
+			return "", nil, false
+		}
+		return names[i], d.Attachments[names[i]], true
+	}
+
+	for name, part := range d.Parts {
+		if part == id {
+			return name, d.Attachments[name], true
+		}
+	}
+	for _, img := range d.Images {
+		if img.Part == id {
+			return img.Name, img.Content, true
+		}
+	}
+
+	return "", nil, false
+}
+
+func (d *ParsedEmailData) applyAnalysis(res *EmailAnalysisResult) {
+
+	d.Type = res.Type
+	d.Summary = res.Summary
+	d.Language = res.Language
+	d.Unsubscrube = res.Unsubscribe
+	if len(d.Events) == 0 {
+		d.Events = parseAIEvents(res.Events)
+	}
+
+}
+
+func firstAddress(list string) string {
+
+	address, _, _ := strings.Cut(list, ", ")
+	if fields := strings.Fields(address); len(fields) > 0 {
+		return fields[0]
+	}
+
+	return ""
+}
+
+func sortedKeys(m map[string]string) []string {
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
 func parseAddressList(m map[string]string) string {
 
 	var result []string
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/BrianLeishman/go-imap"
+)
+
+const testNestedEmail = "From: a@example.com\r\n" +
+	"Subject: Parts\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=alt\r\n" +
+	"\r\n" +
+	"--alt\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hello\r\n" +
+	"--alt\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>Hello</p>\r\n" +
+	"--alt--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+	"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQ=\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"From: b@example.com\r\n" +
+	"Subject: Forwarded\r\n" +
+	"Content-Type: multipart/mixed; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Inner text\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/csv; name=\"data.csv\"\r\n" +
+	"Content-Disposition: attachment; filename=\"data.csv\"\r\n" +
+	"\r\n" +
+	"a,b\r\n" +
+	"--inner--\r\n" +
+	"--outer--\r\n"
+
+func TestAttachmentParts(t *testing.T) {
+
+	d := ParseEmail(&imap.Email{}, []byte(testNestedEmail), 1)
+	tests := []struct {
+		name    string
+		part    string
+		content string
+	}{
+		{"report.pdf", "2", "%PDF-1.4"},
+		{"data.csv", "3.2", "a,b"},
+	}
+	for _, tt := range tests {
+		if got := d.Parts[tt.name]; got != tt.part {
+			t.Errorf("part of %s = %q, want %q", tt.name, got, tt.part)
+		}
+		name, content, ok := d.Part(tt.part)
+		if !ok || name != tt.name || strings.TrimSpace(string(content)) != tt.content {
+			t.Errorf("Part(%q) = %q, %q, %v", tt.part, name, content, ok)
+		}
+	}
+	if name, _, ok := d.Part("@0"); !ok || name != "data.csv" {
+		t.Errorf("Part(@0) = %q, %v, want data.csv", name, ok)
+	}
+	if _, _, ok := d.Part("9"); ok {
+		t.Error("Part(9) found a part that does not exist")
+	}
+
+}
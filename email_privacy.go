@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	telehtml "github.com/svanichkin/TelegramHTML"
+)
+
+// Tracking parameters added by newsletter and analytics tools
+
+var trackingParams = map[string]bool{
+	"fbclid": true, "gclid": true, "dclid": true, "msclkid": true, "yclid": true, "igshid": true,
+	"mc_cid": true, "mc_eid": true, "_hsenc": true, "_hsmi": true, "mkt_tok": true, "oly_enc_id": true,
+	"oly_anon_id": true, "vero_id": true, "trk": true, "trkcampaign": true,
+}
+
+// Public redirectors that carry the target as a parameter, other links are kept as they are,
+// an app's own /redirect?url= is part of how it works
+
+var redirectors = []struct{ host, path, param string }{
+	{"l.facebook.com", "/l.php", "u"},
+	{"lm.facebook.com", "/l.php", "u"},
+	{"l.instagram.com", "/", "u"},
+	{"www.youtube.com", "/redirect", "q"},
+	{"www.linkedin.com", "/redir/redirect", "url"},
+	{"slack-redir.net", "/link", "url"},
+	{"vk.com", "/away.php", "to"},
+	{"steamcommunity.com", "/linkfilter/", "url"},
+}
+
+var (
+	reTrackingPixelStyle = regexp.MustCompile(`(?i)(display\s*:\s*none|visibility\s*:\s*hidden|(width|height)\s*:\s*[01]px)`)
+	reTextLinks          = regexp.MustCompile(`https?://[^\s<>"']+`)
+)
+
+// HTML body for Telegram without tracking pixels and with clean links
+// followed by their real domain
+
+func renderHTML(body string) string {
+
+	return telehtml.CleanTelegramHTML(stripTracking(body))
+}
+
+func stripTracking(body string) string {
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return body
+	}
+
+	doc.Find("img").Each(func(i int, s *goquery.Selection) {
+		if isTrackingPixel(s) {
+			s.Remove()
+		}
+	})
+
+	doc.Find("a[href]").Each(func(i int, s *goquery.Selection) {
+		href, _ := s.Attr("href")
+		link := cleanLink(href)
+		s.SetAttr("href", link)
+		if tracker := linkTracker(link); tracker != "" {
+			s.AfterHtml(" <i>(tracked by " + tracker + ")</i>")
+			return
+		}
+		u, err := url.Parse(link)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+			return
+		}
+		domain := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+		if text := strings.ToLower(s.Text()); strings.TrimSpace(text) == "" || strings.Contains(text, domain) {
+			return
+		}
+		s.AfterHtml(" <i>(" + html.EscapeString(domain) + ")</i>")
+	})
+
+	cleaned, err := doc.Html()
+	if err != nil {
+		return body
+	}
+
+	return cleaned
+}
+
+// Images of at most 1x1 pixel or hidden by style, they only report that the email was opened
+
+func isTrackingPixel(s *goquery.Selection) bool {
+
+	if style, ok := s.Attr("style"); ok && reTrackingPixelStyle.MatchString(style) {
+		return true
+	}
+	for _, attr := range []string{"width", "height"} {
+		v, ok := s.Attr(attr)
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(v), "px")); err == nil && n <= 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Links in plain text bodies
+
+func cleanTextLinks(text string) string {
+
+	return reTextLinks.ReplaceAllStringFunc(text, func(link string) string {
+		link = cleanLink(link)
+		if tracker := linkTracker(link); tracker != "" {
+			return link + " (tracked by " + tracker + ")"
+		}
+		return link
+	})
+}
+
+// Real destination of a redirector link without tracking parameters. Redirectors that
+// keep the target on their server (Mailchimp, SendGrid click tracking) are left as is,
+// resolving them would register a click.
+
+func cleanLink(link string) string {
+
+	for range 5 {
+		target := unwrapRedirect(link)
+		if target == "" || target == link {
+			break
+		}
+		link = target
+	}
+
+	u, err := url.Parse(link)
+	if err != nil || u.RawQuery == "" {
+		return link
+	}
+	query := u.Query()
+	changed := false
+	for key := range query {
+		if lower := strings.ToLower(key); strings.HasPrefix(lower, "utm_") || trackingParams[lower] {
+			query.Del(key)
+			changed = true
+		}
+	}
+	if !changed {
+		return link
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+func unwrapRedirect(link string) string {
+
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	query := u.Query()
+
+	switch {
+
+	// Outlook SafeLinks
+
+	case strings.HasSuffix(host, "safelinks.protection.outlook.com"):
+		return query.Get("url")
+
+	// Google redirects
+
+	case (host == "www.google.com" || host == "google.com") && u.Path == "/url":
+		if q := query.Get("q"); q != "" {
+			return q
+		}
+		return query.Get("url")
+
+	// Mandrill (Mailchimp transactional), base64 JSON with the target inside
+
+	case strings.HasSuffix(host, "mandrillapp.com") && strings.HasPrefix(u.Path, "/track/click"):
+		return mandrillTarget(query.Get("p"))
+	}
+
+	for _, r := range redirectors {
+		if host != r.host || u.Path != r.path {
+			continue
+		}
+		if v := query.Get(r.param); strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://") {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// Click trackers that keep the target on their server, the link is shown with a mark
+
+func linkTracker(link string) string {
+
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+
+	switch {
+	case strings.HasSuffix(host, ".list-manage.com") && strings.HasPrefix(u.Path, "/track/"):
+		return "Mailchimp"
+	case strings.HasSuffix(host, "mandrillapp.com") && strings.HasPrefix(u.Path, "/track/"):
+		return "Mailchimp"
+
+	// SendGrid, also on the sender's own domain with link branding
+
+	case host == "sendgrid.net" || strings.HasSuffix(host, ".sendgrid.net"):
+		return "SendGrid"
+	case strings.HasPrefix(u.Path, "/ls/click") && u.Query().Has("upn"):
+		return "SendGrid"
+	}
+
+	return ""
+}
+
+func mandrillTarget(p string) string {
+
+	raw, err := base64.URLEncoding.DecodeString(p)
+	if err != nil {
+		if raw, err = base64.StdEncoding.DecodeString(p); err != nil {
+			return ""
+		}
+	}
+	var outer struct {
+		P string `json:"p"`
+	}
+	var inner struct {
+		URL string `json:"url"`
+	}
+	if json.Unmarshal(raw, &outer) != nil || json.Unmarshal([]byte(outer.P), &inner) != nil {
+		return ""
+	}
+
+	return inner.URL
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCleanLink(t *testing.T) {
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "https://example.com/page", "https://example.com/page"},
+		{"utm", "https://example.com/page?utm_source=news&utm_medium=email&id=7", "https://example.com/page?id=7"},
+		{"fbclid", "https://example.com/?fbclid=abc", "https://example.com/"},
+		{"safelinks", "https://eur01.safelinks.protection.outlook.com/?url=https%3A%2F%2Fexample.com%2Fdoc&data=x", "https://example.com/doc"},
+		{"google", "https://www.google.com/url?q=https://example.com/a&sa=D", "https://example.com/a"},
+		{"facebook", "https://l.facebook.com/l.php?u=https%3A%2F%2Fexample.com%2F%3Futm_source%3Dfb&h=x", "https://example.com/"},
+		{"youtube", "https://www.youtube.com/redirect?q=https%3A%2F%2Fexample.com&event=video", "https://example.com"},
+		{"nested", "https://www.google.com/url?q=https%3A%2F%2Fl.facebook.com%2Fl.php%3Fu%3Dhttps%253A%252F%252Fexample.com%252Fx", "https://example.com/x"},
+		{"mandrill", "https://mandrillapp.com/track/click/1/example.com?p=eyJwIjogIntcInVybFwiOiBcImh0dHBzOi8vZXhhbXBsZS5jb20vbVwifSJ9", "https://example.com/m"},
+		{"app redirect", "https://app.example.com/auth/redirect?token=abc&redirect_url=https://app.example.com/home", "https://app.example.com/auth/redirect?token=abc&redirect_url=https://app.example.com/home"},
+		{"carrier tracking", "https://www.ups.com/track?loc=en_US&tracknum=1Z999&url=https://www.ups.com/", "https://www.ups.com/track?loc=en_US&tracknum=1Z999&url=https://www.ups.com/"},
+		{"mailchimp", "https://example.us1.list-manage.com/track/click?u=1&id=2&e=3", "https://example.us1.list-manage.com/track/click?u=1&id=2&e=3"},
+		{"not http", "https://l.facebook.com/l.php?u=javascript:alert(1)", "https://l.facebook.com/l.php?u=javascript:alert(1)"},
+	}
+	for _, tt := range tests {
+		if got := cleanLink(tt.in); got != tt.want {
+			t.Errorf("%s: cleanLink = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+}
+
+func TestLinkTracker(t *testing.T) {
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"https://example.us1.list-manage.com/track/click?u=1&id=2", "Mailchimp"},
+		{"https://example.us1.list-manage.com/subscribe?u=1", ""},
+		{"https://mandrillapp.com/track/click/1/example.com?p=broken", "Mailchimp"},
+		{"https://u123.ct.sendgrid.net/ls/click?upn=abc", "SendGrid"},
+		{"https://url9.example.com/ls/click?upn=abc", "SendGrid"},
+		{"https://example.com/ls/click", ""},
+		{"https://www.ups.com/track?tracknum=1Z999", ""},
+	}
+	for _, tt := range tests {
+		if got := linkTracker(tt.in); got != tt.want {
+			t.Errorf("linkTracker(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+}
+
+func TestStripTrackingMarksTrackers(t *testing.T) {
+
+	body := `<p><a href="https://x.us1.list-manage.com/track/click?u=1">Read more</a> <a href="https://example.com/?utm_source=a">Site</a></p>`
+	got := stripTracking(body)
+	if !strings.Contains(got, "(tracked by Mailchimp)") {
+		t.Errorf("stripTracking did not mark the Mailchimp link: %s", got)
+	}
+	if !strings.Contains(got, `href="https://example.com/"`) || !strings.Contains(got, "(example.com)") {
+		t.Errorf("stripTracking did not clean the plain link: %s", got)
+	}
+	if got := cleanTextLinks("See https://u1.ct.sendgrid.net/ls/click?upn=x now"); got != "See https://u1.ct.sendgrid.net/ls/click?upn=x (tracked by SendGrid) now" {
+		t.Errorf("cleanTextLinks = %q", got)
+	}
+
+}
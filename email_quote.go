@@ -0,0 +1,71 @@
+package main
+
+import (
+	"html"
+	"strings"
+)
+
+// Reply quoting modes, set with reply_quote in the [email] section
+
+const (
+	QuoteTop    = "top"
+	QuoteBottom = "bottom"
+	QuoteNone   = "none"
+)
+
+func parseQuoteMode(mode string) string {
+
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case QuoteBottom:
+		return QuoteBottom
+	case QuoteNone, "off", "false":
+		return QuoteNone
+	}
+
+	return QuoteTop
+}
+
+// "On <date>, <sender> wrote:" line above the quote
+
+func quoteAttribution(d *ParsedEmailData) string {
+
+	sender := d.FromAddress
+	if d.FromName != "" {
+		sender = d.FromName + " <" + d.FromAddress + ">"
+	}
+	if d.Date.IsZero() {
+		return sender + " wrote:"
+	}
+
+	return "On " + d.Date.Format("Mon, 2 Jan 2006 at 15:04") + ", " + sender + " wrote:"
+}
+
+// Plain text and HTML versions of a reply with the original quoted above or below it
+
+func quoteReply(text string, htmlBody string, d *ParsedEmailData, mode string) (string, string) {
+
+	if d == nil || mode == QuoteNone {
+		return text, htmlBody
+	}
+	attribution := quoteAttribution(d)
+	original := stripMarkup(d.TextBody)
+
+	var quoted []string
+	for _, line := range strings.Split(original, "\n") {
+		if line = strings.TrimRight(line, " \r"); line == "" || strings.HasPrefix(line, ">") {
+			quoted = append(quoted, ">"+line)
+		} else {
+			quoted = append(quoted, "> "+line)
+		}
+	}
+	textQuote := attribution + "\n" + strings.Join(quoted, "\n")
+	htmlQuote := "<div>" + html.EscapeString(attribution) + "</div>" +
+		`<blockquote style="margin:0 0 0 .8ex;border-left:1px solid #ccc;padding-left:1ex">` +
+		strings.ReplaceAll(html.EscapeString(original), "\n", "<br>") + "</blockquote>"
+
+	if mode == QuoteBottom {
+		return textQuote + "\n\n" + text, htmlQuote + "<br>" + htmlBody
+	}
+
+	return text + "\n\n" + textQuote, htmlBody + "<br>" + htmlQuote
+}
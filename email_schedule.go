@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Emails to send later, kept encrypted on disk so they survive restarts
+
+type ScheduledEmail struct {
+	ID       string
+	Tid      int
+	Out      *OutgoingEmail
+	Files    map[string]string
+	Attempts int
+	RetryAt  time.Time
+}
+
+type Scheduler struct {
+	mu      sync.Mutex
+	key     string
+	file    string
+	pending map[string]*ScheduledEmail
+	timers  map[string]*time.Timer
+	send    func(e *ScheduledEmail, retry time.Time) error
+}
+
+// Pauses before the next attempts when sending fails, then the email is dropped
+
+var scheduleRetries = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute, time.Hour}
+
+func (e *ScheduledEmail) due() time.Time {
+
+	if !e.RetryAt.IsZero() {
+		return e.RetryAt
+	}
+
+	return e.Out.SendAt
+}
+
+func NewScheduler(recipientID int64) *Scheduler {
+
+	rid := fmt.Sprint(recipientID)
+	s := &Scheduler{key: rid, file: rid + ".sch", pending: make(map[string]*ScheduledEmail), timers: make(map[string]*time.Timer)}
+	stored, err := LoadAndDecrypt(rid, s.file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to load scheduled emails: %v").String(), err)
+		}
+		return s
+	}
+	for id, raw := range stored {
+		var e ScheduledEmail
+		if err := json.Unmarshal([]byte(raw), &e); err != nil || e.Out == nil {
+			log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Skipping broken scheduled email %s").String(), id)
+			continue
+		}
+		s.pending[id] = &e
+	}
+
+	return s
+}
+
+// Arms the timers, emails whose time passed while the bot was down go out right away.
+// send gets the time of the next attempt if this one fails, zero for the last one.
+
+func (s *Scheduler) Start(send func(e *ScheduledEmail, retry time.Time) error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.send = send
+	for id, e := range s.pending {
+		s.arm(id, e.due())
+	}
+	if len(s.pending) > 0 {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Cyan("Loaded %d scheduled emails").String(), len(s.pending))
+	}
+
+}
+
+func (s *Scheduler) arm(id string, at time.Time) {
+
+	s.timers[id] = time.AfterFunc(time.Until(at), func() {
+		s.fire(id)
+	})
+
+}
+
+// The email stays stored until the server takes it, so a failure or a crash
+// while sending does not lose it. Cancel can not stop it once the timer fired.
+
+func (s *Scheduler) fire(id string) {
+
+	s.mu.Lock()
+	e, ok := s.pending[id]
+	send := s.send
+	var retry time.Time
+	if ok && e.Attempts < len(scheduleRetries) {
+		retry = time.Now().Add(scheduleRetries[e.Attempts])
+	}
+	s.mu.Unlock()
+	if !ok || send == nil {
+		return
+	}
+	err := send(e, retry)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case err == nil:
+		delete(s.pending, id)
+		delete(s.timers, id)
+	case retry.IsZero():
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Giving up on scheduled email %s after %d attempts").String(), id, e.Attempts+1)
+		delete(s.pending, id)
+		delete(s.timers, id)
+	default:
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Scheduled email %s will be retried at %s").String(), id, retry.Format(time.RFC3339))
+		e.Attempts++
+		e.RetryAt = retry
+		s.arm(id, retry)
+	}
+	if err := s.save(); err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to save scheduled emails: %v").String(), err)
+	}
+
+}
+
+// files are the Telegram file ids of the links in the body, by link
+
+func (s *Scheduler) Add(tid int, out *OutgoingEmail, files map[string]string) (*ScheduledEmail, error) {
+
+	e := &ScheduledEmail{ID: newOutboxID(), Tid: tid, Out: out, Files: files}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[e.ID] = e
+	if err := s.save(); err != nil {
+		delete(s.pending, e.ID)
+		return nil, err
+	}
+	s.arm(e.ID, out.SendAt)
+	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Cyan("Email %s to %v scheduled for %s").String(), e.ID, out.To, out.SendAt)
+
+	return e, nil
+}
+
+// Removes the email, false when it is already sent or unknown. Before Start it has no timer yet.
+
+func (s *Scheduler) Cancel(id string) (*ScheduledEmail, bool) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.pending[id]
+	if t := s.timers[id]; !ok || t != nil && !t.Stop() {
+		return nil, false
+	}
+	delete(s.pending, id)
+	delete(s.timers, id)
+	if err := s.save(); err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to save scheduled emails: %v").String(), err)
+	}
+	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Blue("Scheduled email %s cancelled").String(), id)
+
+	return e, true
+}
+
+// Pending emails, the next one first
+
+func (s *Scheduler) List() []*ScheduledEmail {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*ScheduledEmail, 0, len(s.pending))
+	for _, e := range s.pending {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].due().Before(list[j].due())
+	})
+
+	return list
+}
+
+func (s *Scheduler) save() error {
+
+	stored := make(map[string]string, len(s.pending))
+	for id, e := range s.pending {
+		raw, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		stored[id] = string(raw)
+	}
+
+	return EncryptAndSave(s.key, s.file, stored)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSchedulerRetry(t *testing.T) {
+
+	retries := scheduleRetries
+	scheduleRetries = []time.Duration{10 * time.Millisecond}
+	defer func() { scheduleRetries = retries }()
+
+	s := NewScheduler(1)
+	s.file = filepath.Join(t.TempDir(), "1.sch")
+	attempts := make(chan time.Time, 3)
+	calls := 0
+	s.Start(func(e *ScheduledEmail, retry time.Time) error {
+		stored, err := LoadAndDecrypt(s.key, s.file)
+		if err != nil || stored[e.ID] == "" {
+			t.Errorf("email %s is not stored while it is being sent: %v", e.ID, err)
+		}
+		attempts <- retry
+		if calls++; calls == 1 {
+			return errors.New("smtp down")
+		}
+		return nil
+	})
+	e, err := s.Add(0, &OutgoingEmail{To: []string{"x@example.com"}, SendAt: time.Now()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retry := <-attempts; retry.IsZero() {
+		t.Error("first attempt has no retry")
+	}
+	if retry := <-attempts; !retry.IsZero() {
+		t.Errorf("last attempt has a retry at %s", retry)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if list := s.List(); len(list) != 0 {
+		t.Errorf("%d emails still pending after sending", len(list))
+	}
+	stored, err := LoadAndDecrypt(s.key, s.file)
+	if err != nil || stored[e.ID] != "" {
+		t.Errorf("sent email is still stored: %v", err)
+	}
+
+}
+
+func TestSchedulerCancelBeforeStart(t *testing.T) {
+
+	s := NewScheduler(1)
+	s.file = filepath.Join(t.TempDir(), "1.sch")
+	e, err := s.Add(0, &OutgoingEmail{To: []string{"x@example.com"}, SendAt: time.Now().Add(time.Hour)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Loaded from disk after a restart, the timer is armed only by Start
+
+	restarted := NewScheduler(1)
+	restarted.file = s.file
+	restarted.pending = make(map[string]*ScheduledEmail)
+	stored, err := LoadAndDecrypt(s.key, s.file)
+	if err != nil || stored[e.ID] == "" {
+		t.Fatalf("email is not stored: %v", err)
+	}
+	restarted.pending[e.ID] = e
+	if got, ok := restarted.Cancel(e.ID); !ok || got != e {
+		t.Errorf("Cancel before Start = %v, %v", got, ok)
+	}
+	if _, ok := restarted.Cancel(e.ID); ok {
+		t.Error("cancelled the same email twice")
+	}
+	s.Cancel(e.ID)
+
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Emails hidden until a later time, kept encrypted on disk so they survive restarts
+
+type Snooze struct {
+	ID        string
+	Uid       int
+	Tid       int
+	Mid       int
+	Until     time.Time
+	MessageID string
+	Subject   string
+	From      string
+	Folder    string
+}
+
+type Snoozer struct {
+	mu      sync.Mutex
+	key     string
+	file    string
+	pending map[string]*Snooze
+	woken   map[string]*Snooze
+	wake    func(s *Snooze)
+}
+
+func NewSnoozer(recipientID int64) *Snoozer {
+
+	rid := fmt.Sprint(recipientID)
+	s := &Snoozer{key: rid, file: rid + ".snz", pending: make(map[string]*Snooze), woken: make(map[string]*Snooze)}
+	stored, err := LoadAndDecrypt(rid, s.file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to load snoozed emails: %v").String(), err)
+		}
+		return s
+	}
+	for id, raw := range stored {
+		var sn Snooze
+		if err := json.Unmarshal([]byte(raw), &sn); err != nil {
+			log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Skipping broken snoozed email %s").String(), id)
+			continue
+		}
+		s.pending[id] = &sn
+	}
+
+	return s
+}
+
+// Arms the timers, emails whose time passed while the bot was down wake up right away
+
+func (s *Snoozer) Start(wake func(sn *Snooze)) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wake = wake
+	for _, sn := range s.pending {
+		s.arm(sn)
+	}
+	if len(s.pending) > 0 {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Cyan("Loaded %d snoozed emails").String(), len(s.pending))
+	}
+
+}
+
+func (s *Snoozer) arm(sn *Snooze) {
+
+	time.AfterFunc(time.Until(sn.Until), func() {
+		s.mu.Lock()
+		_, ok := s.pending[sn.ID]
+		delete(s.pending, sn.ID)
+		if err := s.save(); err != nil {
+			log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to save snoozed emails: %v").String(), err)
+		}
+		wake := s.wake
+		s.mu.Unlock()
+		if ok && wake != nil {
+			log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Magenta("Snoozed email UID %d wakes up").String(), sn.Uid)
+			wake(sn)
+		}
+	})
+
+}
+
+func (s *Snoozer) Add(sn *Snooze) error {
+
+	sn.ID = newOutboxID()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[sn.ID] = sn
+	if err := s.save(); err != nil {
+		delete(s.pending, sn.ID)
+		return err
+	}
+	s.arm(sn)
+	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Cyan("Email UID %d snoozed until %s").String(), sn.Uid, sn.Until)
+
+	return nil
+}
+
+// The move to the snooze folder failed, the email stays in INBOX and only gets a reminder
+
+func (s *Snoozer) Unmoved(sn *Snooze) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sn.Folder = ""
+	if err := s.save(); err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to save snoozed emails: %v").String(), err)
+	}
+
+}
+
+// Snoozed email waiting in the snooze folder under its old INBOX UID
+
+func (s *Snoozer) Snoozed(uid int) (*Snooze, bool) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, sn := s.find(uid)
+
+	return sn, id != ""
+}
+
+// Takes a snoozed email out of its folder early, its timer then does nothing
+
+func (s *Snoozer) Take(uid int) (*Snooze, bool) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, sn := s.find(uid)
+	if id == "" {
+		return nil, false
+	}
+	delete(s.pending, id)
+	if err := s.save(); err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to save snoozed emails: %v").String(), err)
+	}
+
+	return sn, true
+}
+
+func (s *Snoozer) find(uid int) (string, *Snooze) {
+
+	for id, sn := range s.pending {
+		if sn.Uid == uid && sn.Folder != "" {
+			return id, sn
+		}
+	}
+
+	return "", nil
+}
+
+// Emails moved back to INBOX are announced when the new mail check finds them
+
+func (s *Snoozer) MarkWoken(sn *Snooze) {
+
+	s.mu.Lock()
+	s.woken[sn.MessageID] = sn
+	s.mu.Unlock()
+
+}
+
+func (s *Snoozer) Woken(messageID string) (*Snooze, bool) {
+
+	if messageID == "" {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sn, ok := s.woken[messageID]
+	delete(s.woken, messageID)
+
+	return sn, ok
+}
+
+func (s *Snoozer) save() error {
+
+	stored := make(map[string]string, len(s.pending))
+	for id, sn := range s.pending {
+		raw, err := json.Marshal(sn)
+		if err != nil {
+			return err
+		}
+		stored[id] = string(raw)
+	}
+
+	return EncryptAndSave(s.key, s.file, stored)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnoozerTake(t *testing.T) {
+
+	s := NewSnoozer(1)
+	s.file = filepath.Join(t.TempDir(), "1.snz")
+	woken := make(chan *Snooze, 1)
+	s.Start(func(sn *Snooze) { woken <- sn })
+	moved := &Snooze{Uid: 7, Until: time.Now().Add(50 * time.Millisecond), MessageID: "<a@x>", Folder: "Snoozed"}
+	kept := &Snooze{Uid: 8, Until: time.Now().Add(time.Hour), MessageID: "<b@x>", Folder: "Snoozed"}
+	for _, sn := range []*Snooze{moved, kept} {
+		if err := s.Add(sn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Unmoved(kept)
+
+	// Looking one up leaves it snoozed, only emails out of INBOX count
+
+	if sn, ok := s.Snoozed(7); !ok || sn != moved {
+		t.Errorf("Snoozed(7) = %v, %v", sn, ok)
+	}
+	if _, ok := s.Snoozed(8); ok {
+		t.Error("an email left in INBOX counts as snoozed")
+	}
+
+	// Only emails out of INBOX are taken, and their timer stays quiet
+
+	if _, ok := s.Take(8); ok {
+		t.Error("took an email that was not moved")
+	}
+	if sn, ok := s.Take(7); !ok || sn != moved {
+		t.Fatalf("Take(7) = %v, %v", sn, ok)
+	}
+	if _, ok := s.Take(7); ok {
+		t.Error("took the same email twice")
+	}
+	select {
+	case sn := <-woken:
+		t.Errorf("email %d woke up after it was taken", sn.Uid)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Stored state has the unmoved email without its folder
+
+	raw, err := LoadAndDecrypt(s.key, s.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 1 || raw[kept.ID] == "" {
+		t.Errorf("stored snoozes = %v", raw)
+	}
+	if kept.Folder != "" {
+		t.Errorf("unmoved email keeps folder %q", kept.Folder)
+	}
+
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/logrusorgru/aurora/v4"
+)
+
+// Flag changes from other clients come in bursts, one sync runs after they settle
+
+var (
+	flagsSyncLock  sync.Mutex
+	flagsSyncTimer *time.Timer
+)
+
+func scheduleFlagsSync(ec *EmailClient, tb *TelegramBot) {
+
+	flagsSyncLock.Lock()
+	defer flagsSyncLock.Unlock()
+	if flagsSyncTimer != nil {
+		flagsSyncTimer.Stop()
+	}
+	flagsSyncTimer = time.AfterFunc(2*time.Second, func() {
+		syncMailFlags(ec, tb)
+	})
+
+}
+
+// Reads the flags of every email shown in Telegram, emails a search no longer finds in INBOX are crossed out
+
+func syncMailFlags(ec *EmailClient, tb *TelegramBot) {
+
+	uids := tb.TrackedUids()
+	if len(uids) == 0 {
+		return
+	}
+	log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Cyan("Syncing flags of %d emails").String(), len(uids))
+	mu.Lock()
+	ec.imap.StopIdle()
+	flags, err := ec.FetchFlags(uids)
+	var missing []int
+	for _, uid := range uids {
+		if _, ok := flags[uid]; !ok && err == nil {
+			missing = append(missing, uid)
+		}
+	}
+	var exist map[int]bool
+	if len(missing) > 0 {
+		exist, err = ec.ExistingUIDs(missing)
+	}
+	if err := ec.startIdleWithHandler(); err != nil {
+		log.Fatalf(au.Gray(12, "[EMAIL]").String()+" "+au.Red(aurora.Bold("Failed to restart idle mode: %v")).String(), err)
+	}
+	mu.Unlock()
+	if err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Red("Error syncing flags: %v").String(), err)
+		return
+	}
+	for _, uid := range uids {
+		f, ok := flags[uid]
+		switch {
+		case !ok && !exist[uid]:
+			tb.ShowMailGone(uid)
+		case ok:
+			has := func(flag string) bool {
+				return slices.ContainsFunc(f, func(s string) bool { return strings.EqualFold(s, flag) })
+			}
+			tb.ShowMailFlags(uid, has(`\Seen`), has(`\Flagged`))
+		}
+	}
+
+}
+
+// Expanding counts as reading, the caller must hold mu with idle stopped
+
+func markSeen(ec *EmailClient, tb *TelegramBot, uid int) {
+
+	if err := ec.storeFlag(uid, `\Seen`, true); err != nil {
+		log.Printf(au.Gray(12, "[EMAIL]").String()+" "+au.Yellow("Failed to mark email %d as read: %v").String(), uid, err)
+		return
+	}
+	tb.SetMailSeen(uid, true)
+
+}
+
+// A reply counts as reading the email it answers once SMTP took it, not when it is written
+
+func markReplied(ec *EmailClient, tb *TelegramBot, out *OutgoingEmail) {
+
+	if out.Uid == 0 {
+		return
+	}
+	mu.Lock()
+	ec.imap.StopIdle()
+	markSeen(ec, tb, tb.currentUid(out.Uid))
+	if err := ec.startIdleWithHandler(); err != nil {
+		log.Fatalf(au.Gray(12, "[EMAIL]").String()+" "+au.Red(aurora.Bold("Failed to restart idle mode: %v")).String(), err)
+	}
+	mu.Unlock()
+
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"unicode/utf16"
+)
+
+// Outlook winmail.dat, a TNEF stream with the message body and the real attachments
+
+const tnefSignature = 0x223e9f78
+
+const (
+	tnefLevelAttachment = 0x02
+
+	tnefAttBody           = 0x800c
+	tnefAttAttachData     = 0x800f
+	tnefAttAttachTitle    = 0x8010
+	tnefAttAttachRendData = 0x9002
+	tnefAttMAPIProps      = 0x9003
+	tnefAttAttachment     = 0x9005
+)
+
+const (
+	mapiBody             = 0x1000
+	mapiBodyHTML         = 0x1013
+	mapiAttachDataObj    = 0x3701
+	mapiAttachLongName   = 0x3707
+	mapiAttachMimeTag    = 0x370e
+	mapiTypeString8      = 0x001e
+	mapiTypeUnicode      = 0x001f
+	mapiTypeBinary       = 0x0102
+	mapiTypeObject       = 0x000d
+	mapiTypeMultiValue   = 0x1000
+	mapiNamedPropertyMin = 0x8000
+)
+
+var errTNEFFormat = errors.New("not a TNEF stream")
+
+type TNEFAttachment struct {
+	Name     string
+	MimeType string
+	Content  []byte
+}
+
+type TNEFData struct {
+	Body        string
+	HTML        string
+	Attachments []*TNEFAttachment
+}
+
+func isTNEF(contentType string, name string) bool {
+
+	return strings.EqualFold(contentType, "application/ms-tnef") || strings.EqualFold(contentType, "application/vnd.ms-tnef") || strings.EqualFold(name, "winmail.dat")
+}
+
+func decodeTNEF(b []byte) (*TNEFData, error) {
+
+	if len(b) < 6 || binary.LittleEndian.Uint32(b) != tnefSignature {
+		return nil, errTNEFFormat
+	}
+
+	data := &TNEFData{}
+	var current *TNEFAttachment
+	for pos := 6; pos+9 <= len(b); {
+		level := b[pos]
+		id := binary.LittleEndian.Uint32(b[pos+1:]) & 0xffff
+		length := int(binary.LittleEndian.Uint32(b[pos+5:]))
+		pos += 9
+		if length < 0 || pos+length+2 > len(b) {
+			return nil, errTNEFFormat
+		}
+		value := b[pos : pos+length]
+		pos += length + 2 // checksum
+
+		switch {
+		case id == tnefAttAttachRendData:
+			current = &TNEFAttachment{}
+			data.Attachments = append(data.Attachments, current)
+		case level == tnefLevelAttachment && current != nil && id == tnefAttAttachTitle:
+			current.Name = decodeText(trimNul(value), "")
+		case level == tnefLevelAttachment && current != nil && id == tnefAttAttachData:
+			current.Content = value
+		case level == tnefLevelAttachment && current != nil && id == tnefAttAttachment:
+			props := parseMAPIProps(value)
+			if name := mapiString(props[mapiAttachLongName]); name != "" {
+				current.Name = name
+			}
+			current.MimeType = mapiString(props[mapiAttachMimeTag])
+			if obj := props[mapiAttachDataObj]; len(current.Content) == 0 && obj != nil && len(obj.value) > 16 {
+				current.Content = obj.value[16:] // interface id before the data
+			}
+		case id == tnefAttBody:
+			data.Body = decodeText(trimNul(value), "")
+		case id == tnefAttMAPIProps:
+			props := parseMAPIProps(value)
+			if html := mapiString(props[mapiBodyHTML]); html != "" {
+				data.HTML = html
+			}
+			if body := mapiString(props[mapiBody]); body != "" && data.Body == "" {
+				data.Body = body
+			}
+		}
+	}
+
+	return data, nil
+}
+
+type mapiProp struct {
+	kind  uint16
+	value []byte
+}
+
+// MAPI property list by property id, only the first value of each property is kept
+
+func parseMAPIProps(b []byte) map[uint16]*mapiProp {
+
+	props := make(map[uint16]*mapiProp)
+	if len(b) < 4 {
+		return props
+	}
+	count := int(binary.LittleEndian.Uint32(b))
+	pos := 4
+	for i := 0; i < count && pos+4 <= len(b); i++ {
+		kind := binary.LittleEndian.Uint16(b[pos:])
+		id := binary.LittleEndian.Uint16(b[pos+2:])
+		pos += 4
+
+		// Named properties carry a GUID and a numeric id or a name
+
+		if id >= mapiNamedPropertyMin {
+			if pos+20 > len(b) {
+				break
+			}
+			named := binary.LittleEndian.Uint32(b[pos+16:])
+			pos += 20
+			if named == 0 {
+				pos += 4
+			} else {
+				if pos+4 > len(b) {
+					break
+				}
+				pos += 4 + pad4(int(binary.LittleEndian.Uint32(b[pos:])))
+			}
+		}
+
+		values := 1
+		base := kind &^ mapiTypeMultiValue
+		variable := base == mapiTypeString8 || base == mapiTypeUnicode || base == mapiTypeBinary || base == mapiTypeObject
+		if kind&mapiTypeMultiValue != 0 || variable {
+			if pos+4 > len(b) {
+				break
+			}
+			values = int(binary.LittleEndian.Uint32(b[pos:]))
+			pos += 4
+		}
+		for v := 0; v < values && pos <= len(b); v++ {
+			size := mapiFixedSize(base)
+			if variable {
+				if pos+4 > len(b) {
+					return props
+				}
+				size = int(binary.LittleEndian.Uint32(b[pos:]))
+				pos += 4
+			}
+			if size < 0 || pos+size > len(b) {
+				return props
+			}
+			if props[id] == nil {
+				props[id] = &mapiProp{kind: base, value: b[pos : pos+size]}
+			}
+			pos += pad4(size)
+		}
+	}
+
+	return props
+}
+
+func mapiFixedSize(kind uint16) int {
+
+	switch kind {
+	case 0x0005, 0x0006, 0x0007, 0x0014, 0x0040:
+		return 8
+	case 0x0048:
+		return 16
+	}
+
+	return 4
+}
+
+func mapiString(p *mapiProp) string {
+
+	if p == nil {
+		return ""
+	}
+	if p.kind == mapiTypeUnicode {
+		units := make([]uint16, 0, len(p.value)/2)
+		for i := 0; i+1 < len(p.value); i += 2 {
+			units = append(units, binary.LittleEndian.Uint16(p.value[i:]))
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	}
+
+	return decodeText(trimNul(p.value), "")
+}
+
+func trimNul(b []byte) []byte {
+
+	for len(b) > 0 && b[len(b)-1] == 0 {
+		b = b[:len(b)-1]
+	}
+
+	return b
+}
+
+func pad4(n int) int {
+
+	return (n + 3) &^ 3
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+)
+
+// TNEF attribute: level, id, length, value and a checksum the decoder does not check
+
+func tnefAttr(level byte, id uint32, value []byte) []byte {
+
+	b := []byte{level}
+	b = binary.LittleEndian.AppendUint32(b, id)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(value)))
+	b = append(b, value...)
+
+	return append(b, 0, 0)
+}
+
+func mapiValue(kind uint16, id uint16, value []byte) []byte {
+
+	b := binary.LittleEndian.AppendUint16(nil, kind)
+	b = binary.LittleEndian.AppendUint16(b, id)
+	if id >= mapiNamedPropertyMin {
+		b = append(b, make([]byte, 16)...) // GUID
+		b = binary.LittleEndian.AppendUint32(b, 1)
+		name := []byte("x\x00\x00\x00")
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(name)))
+		b = append(b, name...)
+	}
+	b = binary.LittleEndian.AppendUint32(b, 1)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(value)))
+	b = append(b, value...)
+
+	return append(b, make([]byte, pad4(len(value))-len(value))...)
+}
+
+func mapiProps(props ...[]byte) []byte {
+
+	b := binary.LittleEndian.AppendUint32(nil, uint32(len(props)))
+	for _, p := range props {
+		b = append(b, p...)
+	}
+
+	return b
+}
+
+func utf16LE(s string) []byte {
+
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s + "\x00")) {
+		b = binary.LittleEndian.AppendUint16(b, u)
+	}
+
+	return b
+}
+
+func testTNEF() []byte {
+
+	b := binary.LittleEndian.AppendUint32(nil, tnefSignature)
+	b = append(b, 0, 0)
+	b = append(b, tnefAttr(1, tnefAttBody, []byte("Hello\x00"))...)
+	b = append(b, tnefAttr(1, tnefAttMAPIProps, mapiProps(
+		mapiValue(mapiTypeBinary, mapiNamedPropertyMin, []byte("named")),
+		mapiValue(mapiTypeString8, mapiBodyHTML, []byte("<p>Hello</p>\x00")),
+	))...)
+	b = append(b, tnefAttr(tnefLevelAttachment, tnefAttAttachRendData, make([]byte, 14))...)
+	b = append(b, tnefAttr(tnefLevelAttachment, tnefAttAttachTitle, []byte("REPORT~1.TXT\x00"))...)
+	b = append(b, tnefAttr(tnefLevelAttachment, tnefAttAttachData, []byte("report"))...)
+	b = append(b, tnefAttr(tnefLevelAttachment, tnefAttAttachment, mapiProps(
+		mapiValue(mapiTypeUnicode, mapiAttachLongName, utf16LE("Отчёт за год.txt")),
+		mapiValue(mapiTypeString8, mapiAttachMimeTag, []byte("text/plain\x00")),
+	))...)
+
+	return b
+}
+
+func TestDecodeTNEF(t *testing.T) {
+
+	data, err := decodeTNEF(testTNEF())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Body != "Hello" || data.HTML != "<p>Hello</p>" {
+		t.Errorf("body = %q, html = %q", data.Body, data.HTML)
+	}
+	if len(data.Attachments) != 1 {
+		t.Fatalf("%d attachments, want 1", len(data.Attachments))
+	}
+	a := data.Attachments[0]
+	if a.Name != "Отчёт за год.txt" || a.MimeType != "text/plain" || string(a.Content) != "report" {
+		t.Errorf("attachment = %q %q %q", a.Name, a.MimeType, a.Content)
+	}
+
+}
+
+func TestDecodeTNEFTruncated(t *testing.T) {
+
+	b := testTNEF()
+	for n := 0; n < len(b); n++ {
+		data, err := decodeTNEF(b[:n])
+		if err == nil && data == nil {
+			t.Errorf("decodeTNEF(%d bytes) returned neither data nor error", n)
+		}
+		if n < 6 && err != errTNEFFormat {
+			t.Errorf("decodeTNEF(%d bytes) error = %v, want %v", n, err, errTNEFFormat)
+		}
+	}
+	if _, err := decodeTNEF([]byte("PK\x03\x04 not tnef")); err != errTNEFFormat {
+		t.Errorf("decodeTNEF(zip) error = %v", err)
+	}
+
+}
+
+func TestParseMAPIPropsTruncated(t *testing.T) {
+
+	b := mapiProps(
+		mapiValue(mapiTypeBinary, mapiNamedPropertyMin, []byte("named")),
+		mapiValue(mapiTypeUnicode, mapiAttachLongName, utf16LE("name.txt")),
+		mapiValue(mapiTypeString8, mapiAttachMimeTag, []byte("text/plain\x00")),
+	)
+	if props := parseMAPIProps(b); mapiString(props[mapiAttachLongName]) != "name.txt" || mapiString(props[mapiAttachMimeTag]) != "text/plain" {
+		t.Errorf("parseMAPIProps = %+v", props)
+	}
+	for n := 0; n < len(b); n++ {
+		props := parseMAPIProps(b[:n])
+		if p := props[mapiAttachMimeTag]; p != nil && string(p.value) != "text/plain\x00" {
+			t.Errorf("parseMAPIProps(%d bytes) kept a cut value %q", n, p.value)
+		}
+	}
+
+	// Counts and sizes far beyond the data
+
+	huge := binary.LittleEndian.AppendUint32(nil, 0xffffffff)
+	huge = binary.LittleEndian.AppendUint16(huge, mapiTypeBinary|mapiTypeMultiValue)
+	huge = binary.LittleEndian.AppendUint16(huge, mapiAttachDataObj)
+	huge = binary.LittleEndian.AppendUint32(huge, 0xffffffff)
+	huge = binary.LittleEndian.AppendUint32(huge, 0xfffffff0)
+	if props := parseMAPIProps(huge); len(props) != 0 {
+		t.Errorf("parseMAPIProps(huge sizes) = %+v", props)
+	}
+
+}
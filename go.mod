@@ -3,15 +3,19 @@ module email_bot
 go 1.24.3
 
 require (
-	github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
+	github.com/ProtonMail/go-crypto v1.5.2
+	github.com/PuerkitoBio/goquery v1.10.3
+	github.com/emersion/go-msgauth v0.7.0
+	github.com/logrusorgru/aurora/v4 v4.0.0
+	github.com/mymmrac/telego v1.1.1
 	github.com/sashabaranov/go-openai v1.40.2
+	github.com/smallstep/pkcs7 v0.2.3
 	github.com/svanichkin/TelegramHTML v1.1.0
 	gopkg.in/ini.v1 v1.67.0
 )
 
 require (
 	al.essio.dev/pkg/shellescape v1.6.0 // indirect
-	github.com/PuerkitoBio/goquery v1.10.3 // indirect
 	github.com/StirlingMarketingGroup/go-retry v0.0.0-20190512160921-94a8eb23e893 // indirect
 	github.com/andybalholm/brotli v1.1.1 // indirect
 	github.com/andybalholm/cascadia v1.3.3 // indirect
@@ -19,6 +23,7 @@ require (
 	github.com/bytedance/sonic v1.13.2 // indirect
 	github.com/bytedance/sonic/loader v0.2.4 // indirect
 	github.com/cention-sany/utf7 v0.0.0-20170124080048-26cad61bd60a // indirect
+	github.com/cloudflare/circl v1.6.3 // indirect
 	github.com/cloudwego/base64x v0.1.5 // indirect
 	github.com/danieljoos/wincred v1.2.2 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -31,9 +36,7 @@ require (
 	github.com/klauspost/compress v1.18.0 // indirect
 	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
 	github.com/logrusorgru/aurora v2.0.3+incompatible // indirect
-	github.com/logrusorgru/aurora/v4 v4.0.0 // indirect
 	github.com/mattn/go-runewidth v0.0.16 // indirect
-	github.com/mymmrac/telego v1.1.1 // indirect
 	github.com/olekukonko/tablewriter v0.0.5 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
@@ -45,15 +48,15 @@ require (
 	github.com/valyala/fasthttp v1.62.0 // indirect
 	github.com/valyala/fastjson v1.6.4 // indirect
 	golang.org/x/arch v0.0.0-20210923205945-b76863e36670 // indirect
-	golang.org/x/net v0.41.0 // indirect
-	golang.org/x/sys v0.33.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/net v0.42.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
 )
 
 require (
 	github.com/BrianLeishman/go-imap v0.1.11
-	github.com/jhillyerd/enmime v1.3.0 // indirect
+	github.com/jhillyerd/enmime v1.3.0
 	github.com/microcosm-cc/bluemonday v1.0.27 // indirect
-	github.com/stretchr/testify v1.10.0 // indirect
 	github.com/zalando/go-keyring v0.2.6
-	golang.org/x/text v0.26.0 // indirect
+	golang.org/x/text v0.28.0
 )
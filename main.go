@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/mail"
@@ -9,6 +10,8 @@ import (
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
+	_ "time/tzdata"
 
 	"strings"
 
@@ -42,6 +45,17 @@ func main() {
 	if err != nil {
 		log.Fatalf(au.Gray(12, "[INIT]").String()+" "+au.Red(aurora.Bold("Failed to init Telegram bot: %v")).String(), err)
 	}
+	tb.zipFiles = cfg.TelegramZipFiles
+	tb.onDemand = cfg.TelegramOnDemand
+	tb.draftMode = cfg.TelegramDraftMode
+	tb.undoSend = cfg.EmailUndoSend > 0
+	tb.timeZone = time.Local
+	if cfg.TelegramTimeZone != "" {
+		tb.timeZone, err = time.LoadLocation(cfg.TelegramTimeZone)
+		if err != nil {
+			log.Fatalf(au.Gray(12, "[INIT]").String()+" "+au.Red(aurora.Bold("Unknown time zone %q: %v")).String(), cfg.TelegramTimeZone, err)
+		}
+	}
 
 	// Check permissions if group mode
 
@@ -79,8 +93,12 @@ func main() {
 
 	// OpenAI Client init
 
+	redactor, err := NewRedactor(cfg.OpenAIRedact, cfg.OpenAIRedactPatterns, cfg.OpenAINeverSenders)
+	if err != nil {
+		log.Fatalf(au.Gray(12, "[INIT]").String()+" "+au.Red(aurora.Bold("Failed to init redaction: %v")).String(), err)
+	}
 	var ai *OpenAIClient
-	ai, err = NewOpenAIClient(cfg.OpenAIToken)
+	ai, err = NewOpenAIClient(cfg.OpenAIToken, cfg.OpenAIModel, cfg.OpenAITokenBudget, cfg.OpenAIStructured, cfg.OpenAILanguage, cfg.OpenAIExtractEvents, redactor, NewAIState(cfg.TelegramRecipientId, cfg.OpenAIPromptPrice, cfg.OpenAICompletionPrice, cfg.OpenAIMonthlyBudget))
 	if err != nil {
 		log.Printf(au.Gray(12, "[INIT]").String()+" "+au.Yellow(aurora.Bold("Warning: Failed to initialize OpenAI client: %v. OpenAI features will be disabled.")).String(), err)
 		ai = nil
@@ -88,6 +106,8 @@ func main() {
 		log.Println(au.Gray(12, "[INIT]").String() + " " + au.Yellow("OpenAI token not provided or empty. OpenAI features will be disabled.").String())
 	} else {
 		log.Println(au.Gray(12, "[INIT]").String() + " " + au.Green("OpenAI client initialized successfully.").String())
+		ai.aiEncrypted = cfg.AIEncrypted
+		tb.translate = ai.Language() != ""
 	}
 
 	// User request for username if needed
@@ -134,6 +154,31 @@ func main() {
 		cfg.SetCred(email, password)
 	}
 
+	// PGP and S/MIME init, passphrase of the PGP key is requested if needed
+
+	passphrase := cfg.GetPassphrase()
+	mc, err := NewMailCrypto(cfg.PGPPrivateKey, cfg.PGPPublicKeys, passphrase, cfg.SMIMECert, cfg.SMIMEKey, cfg.SMIMERoots, cfg.SignReplies, cfg.EncryptReplies)
+	for errors.Is(err, ErrPGPPassphrase) {
+		if passphrase != "" {
+			if err := tb.SendMessage("Wrong passphrase!"); err != nil {
+				log.Printf(au.Gray(12, "[INIT]").String()+" "+au.Red("Failed to send 'Wrong passphrase' message: %v").String(), err)
+			}
+		}
+		passphrase, err = tb.RequestUserInput("Enter the passphrase of your PGP key, please...")
+		if err != nil {
+			log.Printf(au.Gray(12, "[INIT]").String()+" "+au.Red("Error getting passphrase: %v").String(), err)
+			err = ErrPGPPassphrase
+			continue
+		}
+		mc, err = NewMailCrypto(cfg.PGPPrivateKey, cfg.PGPPublicKeys, passphrase, cfg.SMIMECert, cfg.SMIMEKey, cfg.SMIMERoots, cfg.SignReplies, cfg.EncryptReplies)
+		if err == nil {
+			cfg.SetPassphrase(passphrase)
+		}
+	}
+	if err != nil {
+		log.Fatalf(au.Gray(12, "[INIT]").String()+" "+au.Red(aurora.Bold("Failed to init PGP and S/MIME: %v")).String(), err)
+	}
+
 	// Mail init
 
 	var emailClient *EmailClient
@@ -151,22 +196,96 @@ func main() {
 		log.Fatalf(au.Gray(12, "[INIT]").String()+" "+au.Red(aurora.Bold("Failed to init email client: %v")).String(), err)
 	}
 	defer emailClient.Close()
+	emailClient.verifyDKIM = cfg.EmailVerifyDKIM
+	emailClient.contacts = NewContacts(cfg.TelegramRecipientId)
+	emailClient.crypto = mc
+	emailClient.replyQuote = cfg.EmailReplyQuote
+	emailClient.quoteAttachments = cfg.EmailQuoteFiles
+	emailClient.identities = cfg.Identities
+	emailClient.outbox = NewOutbox(time.Duration(cfg.EmailUndoSend)*time.Second, emailClient.Send)
+	emailClient.scheduler = NewScheduler(cfg.TelegramRecipientId)
+	emailClient.snoozer = NewSnoozer(cfg.TelegramRecipientId)
+	emailClient.snoozeFolder = cfg.EmailSnoozeFolder
+	emailClient.flagsChanged = func() {
+		scheduleFlagsSync(emailClient, tb)
+	}
+
+	// Timers of stored emails run before the listener can cancel them
+
+	emailClient.scheduler.Start(func(e *ScheduledEmail, retry time.Time) error {
+		return sendScheduledEmail(emailClient, tb, e, retry)
+	})
+	emailClient.snoozer.Start(func(sn *Snooze) {
+		wakeEmail(emailClient, tb, sn)
+	})
 
 	// Telegram listener
 
-	go tb.StartListener(
-		func(uid int, message string, files []struct{ Url, Name string }) {
-			replayToEmail(emailClient, tb, uid, message, files)
+	go tb.StartListener(TelegramCallbacks{
+		Reply: func(uid, tid int, message string, files []struct{ Url, Name string }) {
+			replyOrOfferTranslation(emailClient, tb, ai, uid, tid, message, files)
+		},
+		SendReply: func(uid, tid int, message string, files []struct{ Url, Name string }) {
+			replayToEmail(emailClient, tb, uid, tid, message, files)
+		},
+		New: func(from string, to string, title string, message string, files []struct{ Url, Name string }) {
+			sendNewEmail(emailClient, tb, 0, from, to, title, message, files)
+		},
+		Expand: func(uid, tid int) {
+			expandEmail(emailClient, tb, ai, uid, tid)
+		},
+		Draft: func(uid, tid int, language string) {
+			draftReplyToEmail(emailClient, tb, ai, uid, tid, language)
+		},
+		Summary: func(uids []int, tid int) {
+			summarizeThread(emailClient, tb, ai, uids, tid)
+		},
+		Usage: func(tid int) {
+			reportUsage(tb, ai, tid)
+		},
+		Translate: func(uid, tid int) {
+			translateEmail(emailClient, tb, ai, uid, tid)
+		},
+		TranslateReply: func(uid, tid int, message string, files []struct{ Url, Name string }, language string) {
+			translateReply(tb, ai, uid, tid, message, files, language)
+		},
+		Preview: func(p *EmailPreview) {
+			previewEmail(emailClient, tb, p)
+		},
+		PreviewAction: func(p *EmailPreview, send bool) {
+			sendOrCancelPreview(emailClient, tb, p, send)
+		},
+		Undo: func(mid int, id string) bool {
+			return undoEmail(emailClient, tb, mid, id)
+		},
+		Scheduled: func(tid int) {
+			tb.SendScheduledList(tid, emailClient.scheduler.List())
+		},
+		Unschedule: func(mid int, id string) {
+			unscheduleEmail(emailClient, tb, mid, id)
+		},
+		Snooze: func(uid, tid, mid, picker int, until time.Time) {
+			snoozeEmail(emailClient, tb, uid, tid, mid, picker, until)
+		},
+		Mailbox: func(uid int, action string, folder string) (bool, string, error) {
+			return mailboxAction(emailClient, uid, action, folder)
+		},
+		Folders: func() ([]string, error) {
+			return listFolders(emailClient)
+		},
+		Attachment: func(uid, tid int, part string) {
+			getAttachment(emailClient, tb, uid, tid, part)
 		},
-		func(to string, title string, message string, files []struct{ Url, Name string }) {
-			sendNewEmail(emailClient, tb, to, title, message, files)
+		Source: func(uid, tid int, headersOnly bool) {
+			sendEmailSource(emailClient, tb, uid, tid, headersOnly)
 		},
-		func(uid, tid int) {
-			expandEmail(emailClient, tb, uid, tid)
+		Rsvp: func(uid, tid, mid, index int, partstat string) {
+			replyToEvent(emailClient, tb, uid, mid, index, partstat)
 		},
-	)
+	})
 
 	processNewEmails(emailClient, tb, ai)
+	syncMailFlags(emailClient, tb)
 
 	// Graceful shutdown
 
@@ -177,4 +296,5 @@ func main() {
 
 	<-signalChan
 	log.Println(au.Gray(12, "[END]").String() + " " + au.Yellow("Shutdown signal received").String())
+	emailClient.outbox.Drop()
 }
@@ -6,18 +6,32 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"regexp"
 	"strings"
+	"sync/atomic"
 
 	"github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
 )
 
 type OpenAIClient struct {
-	client       *openai.Client
-	systemPrompt string
+	client          *openai.Client
+	systemPrompt    string
+	draftPrompt     string
+	summaryPrompt   string
+	redactor        *Redactor
+	model           string
+	tokenBudget     int
+	structured      atomic.Bool
+	classifier      *openai.ChatCompletionResponseFormat
+	state           *AIState
+	language        string
+	translatePrompt string
+	aiEncrypted     bool
 }
 
-func NewOpenAIClient(token string) (*OpenAIClient, error) {
+func NewOpenAIClient(token string, model string, tokenBudget int, structured bool, language string, extractEvents bool, redactor *Redactor, state *AIState) (*OpenAIClient, error) {
 
 	if token == "" {
 		log.Println(au.Gray(12, "[OPENAI]").String() + " " + au.Yellow("No OpenAI token provided, client will be disabled").String())
@@ -43,17 +57,62 @@ func NewOpenAIClient(token string) (*OpenAIClient, error) {
 Формат:
 {
   "type": "spam|phishing|notification|code|human|unknown",
-  "language": "Определи язык на котором письмо написано",
+  "language": "Код языка письма по ISO 639-1 (например: en, ru)",
   "summary": "Краткое описание письма на языке language",
   "unsubscribe": "URL отписки, если есть" // поле необязательное
 }
 Если type = "code", в summary укажи только сам код.
+`
+	if language != "" {
+		systemPrompt += "summary всегда пиши на языке: " + language + ", независимо от языка письма.\n"
+	}
+	if extractEvents {
+		systemPrompt +=
+			`Добавь поле "events": список встреч и дедлайнов из текста письма, каждый в формате
+{"title": "Название", "start": "Начало в ISO 8601", "end": "Окончание в ISO 8601 или пустая строка", "location": "Место или пустая строка"}
+Для дедлайна без времени укажи только дату (YYYY-MM-DD). Если событий нет, верни пустой список.
+`
+	}
+	draftPrompt :=
+		`
+Ты помогаешь ответить на письмо. Напиши черновик ответа от имени получателя письма.
+Пиши на том же языке, на котором написано письмо, вежливо и по существу.
+Верни только текст ответа, без темы, без пояснений и без разметки.
+`
+	summaryPrompt :=
+		`
+Тебе дана переписка из нескольких писем в хронологическом порядке. Составь по ней сводку и верни результат в формате JSON. Не добавляй ничего от себя.
+
+Формат:
+{
+  "digest": "Краткое описание переписки",
+  "decisions": ["Принятые решения"],
+  "open_questions": ["Открытые вопросы"],
+  "action_items": ["Задачи: кто и что должен сделать"]
+}
+Пиши на языке переписки. Пустые списки оставляй пустыми.
+`
+	translatePrompt :=
+		`
+Переведи текст на указанный язык. Сохрани абзацы, ссылки и имена. Верни только перевод, без пояснений и без разметки.
 `
 	log.Println(au.Gray(12, "[OPENAI]").String() + " " + au.Green(au.Bold("OpenRouter client initialized successfully")).String())
-	return &OpenAIClient{
-		client:       client,
-		systemPrompt: systemPrompt,
-	}, nil
+	oac := &OpenAIClient{
+		client:          client,
+		systemPrompt:    systemPrompt,
+		draftPrompt:     draftPrompt,
+		summaryPrompt:   summaryPrompt,
+		redactor:        redactor,
+		model:           model,
+		tokenBudget:     tokenBudget,
+		classifier:      newClassifierResponseFormat(extractEvents),
+		state:           state,
+		language:        language,
+		translatePrompt: translatePrompt,
+	}
+	oac.structured.Store(structured)
+
+	return oac, nil
 }
 
 type EmailType string
@@ -67,13 +126,77 @@ const (
 	TypeUnknown      EmailType = "unknown"
 )
 
+func (t EmailType) Valid() bool {
+
+	switch t {
+	case TypeSpam, TypePhishing, TypeNotification, TypeCode, TypeHuman, TypeUnknown:
+		return true
+	}
+
+	return false
+}
+
+func newClassifierResponseFormat(extractEvents bool) *openai.ChatCompletionResponseFormat {
+
+	properties := map[string]jsonschema.Definition{
+		"type": {
+			Type: jsonschema.String,
+			Enum: []string{string(TypeSpam), string(TypePhishing), string(TypeNotification), string(TypeCode), string(TypeHuman), string(TypeUnknown)},
+		},
+		"language":    {Type: jsonschema.String},
+		"summary":     {Type: jsonschema.String},
+		"unsubscribe": {Type: jsonschema.String, Description: "Unsubscribe URL or empty string"},
+	}
+	required := []string{"type", "language", "summary", "unsubscribe"}
+	if extractEvents {
+		properties["events"] = jsonschema.Definition{
+			Type: jsonschema.Array,
+			Items: &jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"title":    {Type: jsonschema.String},
+					"start":    {Type: jsonschema.String, Description: "ISO 8601 date or date-time"},
+					"end":      {Type: jsonschema.String, Description: "ISO 8601 date or date-time, or empty string"},
+					"location": {Type: jsonschema.String},
+				},
+				Required:             []string{"title", "start", "end", "location"},
+				AdditionalProperties: false,
+			},
+		}
+		required = append(required, "events")
+	}
+
+	return &openai.ChatCompletionResponseFormat{
+		Type: openai.ChatCompletionResponseFormatTypeJSONSchema,
+		JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{
+			Name:   "email_analysis",
+			Strict: true,
+			Schema: &jsonschema.Definition{
+				Type:                 jsonschema.Object,
+				Properties:           properties,
+				Required:             required,
+				AdditionalProperties: false,
+			},
+		},
+	}
+}
+
 type EmailAnalysisResult struct {
 	Type        EmailType `json:"type"`
+	Language    string    `json:"language"`
 	Summary     string    `json:"summary"`
 	Unsubscribe string    `json:"unsubscribe,omitempty"`
+	Events      []AIEvent `json:"events,omitempty"`
 }
 
-func (oac *OpenAIClient) GenerateTextFromEmail(emailText string) (*EmailAnalysisResult, error) {
+type AIEvent struct {
+	Title    string `json:"title"`
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Location string `json:"location"`
+}
+
+func (oac *OpenAIClient) GenerateTextFromEmail(emailText string, sender string) (*EmailAnalysisResult, error) {
 
 	if oac.client == nil {
 		return nil, errors.New("OpenAI client not initialized")
@@ -83,43 +206,259 @@ func (oac *OpenAIClient) GenerateTextFromEmail(emailText string) (*EmailAnalysis
 	}
 
 	log.Println(au.Gray(12, "[OPENAI]").String() + " " + au.Magenta("Analyzing email content with OpenRouter...").String())
-	resp, err := oac.client.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model: "qwen/qwen3-coder",
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleSystem,
-					Content: oac.systemPrompt,
-				},
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: emailText,
-				},
-			},
-			Temperature: 0.25,
-		},
-	)
+	emailText, redaction := oac.redactor.Redact(emailText)
+	result, err := oac.classify(emailText, sender)
+	if errors.Is(err, errMalformedResponse) {
+		log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Yellow("Retrying analysis after malformed response: %v").String(), err)
+		result, err = oac.classify(emailText, sender)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("OpenRouter chat completion error: %w", err)
+		return nil, err
 	}
-
-	if len(resp.Choices) == 0 {
-		return nil, errors.New("OpenRouter returned no choices")
+	result.Summary = redaction.Restore(result.Summary)
+	result.Unsubscribe = redaction.Restore(result.Unsubscribe)
+	for i := range result.Events {
+		result.Events[i].Title = redaction.Restore(result.Events[i].Title)
+		result.Events[i].Location = redaction.Restore(result.Events[i].Location)
 	}
 
-	log.Println(au.Gray(12, "[OPENAI]").String() + " " + au.Blue("Received response from OpenRouter, processing...").String())
-	content := cleanOpenAIResponse(resp.Choices[0].Message.Content)
+	log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Green("Analysis completed. Type: %s, Unsubscribe: %t, Summary: %t").String(), string(result.Type), result.Summary != "", result.Unsubscribe != "")
+	return result, nil
+}
+
+var errMalformedResponse = errors.New("malformed OpenRouter response")
+
+func (oac *OpenAIClient) classify(emailText string, sender string) (*EmailAnalysisResult, error) {
+
+	content, err := oac.complete(oac.systemPrompt, emailText, oac.classifier, sender)
+	if err != nil {
+		return nil, err
+	}
+	content = cleanOpenAIResponse(content)
 
 	var result EmailAnalysisResult
+	if err := json.Unmarshal([]byte(content), &result); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse as JSON: %v\nResponse: %s", errMalformedResponse, err, content)
+	}
+	if !result.Type.Valid() {
+		return nil, fmt.Errorf("%w: unexpected type %q", errMalformedResponse, result.Type)
+	}
+
+	return &result, nil
+}
+
+func (oac *OpenAIClient) DraftReply(emailText string, language string, sender string) (string, error) {
+
+	if oac.client == nil {
+		return "", errors.New("OpenAI client not initialized")
+	}
+	if emailText == "" {
+		return "", errors.New("email text is empty")
+	}
+
+	log.Println(au.Gray(12, "[OPENAI]").String() + " " + au.Magenta("Drafting reply with OpenRouter...").String())
+	prompt := oac.draftPrompt
+	if language != "" {
+		prompt += "\nЯзык ответа: " + language + "\n"
+	}
+	emailText, redaction := oac.redactor.Redact(emailText)
+	content, err := oac.complete(prompt, emailText, nil, sender)
+	if err != nil {
+		return "", err
+	}
+	content = strings.TrimSpace(redaction.Restore(content))
+	if content == "" {
+		return "", errors.New("OpenRouter returned empty draft")
+	}
+
+	log.Println(au.Gray(12, "[OPENAI]").String() + " " + au.Green("Draft reply completed").String())
+	return content, nil
+}
+
+func (oac *OpenAIClient) Translate(text string, language string, sender string) (string, error) {
+
+	if oac.client == nil {
+		return "", errors.New("OpenAI client not initialized")
+	}
+	if text == "" {
+		return "", errors.New("text is empty")
+	}
+	if language == "" {
+		return "", errors.New("target language is empty")
+	}
+
+	log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Magenta("Translating text into %s with OpenRouter...").String(), language)
+	text, redaction := oac.redactor.Redact(text)
+	content, err := oac.complete(oac.translatePrompt+"\nЯзык перевода: "+language+"\n", text, nil, sender)
+	if err != nil {
+		return "", err
+	}
+	content = strings.TrimSpace(redaction.Restore(content))
+	if content == "" {
+		return "", errors.New("OpenRouter returned empty translation")
+	}
+
+	log.Println(au.Gray(12, "[OPENAI]").String() + " " + au.Green("Translation completed").String())
+	return content, nil
+}
+
+// Target language for summaries and translations, empty if translation is disabled
+
+func (oac *OpenAIClient) Language() string {
+
+	if oac == nil {
+		return ""
+	}
+
+	return oac.language
+}
+
+// Whether a reply to an email in this language should be offered a translation
+
+func (oac *OpenAIClient) NeedsTranslation(language string) bool {
+
+	return oac.Language() != "" && language != "" && !strings.EqualFold(language, oac.Language())
+}
+
+type ThreadSummary struct {
+	Digest        string   `json:"digest"`
+	Decisions     []string `json:"decisions"`
+	OpenQuestions []string `json:"open_questions"`
+	ActionItems   []string `json:"action_items"`
+}
+
+func (oac *OpenAIClient) SummarizeThread(threadText string) (*ThreadSummary, error) {
+
+	if oac.client == nil {
+		return nil, errors.New("OpenAI client not initialized")
+	}
+	if threadText == "" {
+		return nil, errors.New("thread text is empty")
+	}
+
+	log.Println(au.Gray(12, "[OPENAI]").String() + " " + au.Magenta("Summarizing thread with OpenRouter...").String())
+	threadText, redaction := oac.redactor.Redact(threadText)
+	content, err := oac.complete(oac.summaryPrompt, threadText, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	content = cleanOpenAIResponse(content)
+
+	var result ThreadSummary
 	if err := json.Unmarshal([]byte(content), &result); err != nil {
 		return nil, fmt.Errorf("failed to parse OpenRouter response as JSON: %w\nResponse: %s", err, content)
 	}
+	result.Digest = redaction.Restore(result.Digest)
+	for _, items := range [][]string{result.Decisions, result.OpenQuestions, result.ActionItems} {
+		for i := range items {
+			items[i] = redaction.Restore(items[i])
+		}
+	}
 
-	log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Green("Analysis completed. Type: %s, Unsubscribe: %t, Summary: %t").String(), string(result.Type), result.Summary != "", result.Unsubscribe != "")
+	log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Green("Summary completed. Decisions: %d, Questions: %d, Actions: %d").String(), len(result.Decisions), len(result.OpenQuestions), len(result.ActionItems))
 	return &result, nil
 }
 
+func (oac *OpenAIClient) Allowed(from string) bool {
+
+	return oac.redactor.Allowed(from)
+}
+
+// Decrypted emails stay away from the model and the analysis cache unless ai_encrypted is set
+
+func (oac *OpenAIClient) AllowedEmail(d *ParsedEmailData) bool {
+
+	if d.Crypto != nil && d.Crypto.Encrypted && !oac.aiEncrypted {
+		return false
+	}
+
+	return oac.Allowed(d.From)
+}
+
+func (oac *OpenAIClient) CachedAnalysis(messageID string) (*EmailAnalysisResult, bool) {
+
+	if oac == nil {
+		return nil, false
+	}
+
+	return oac.state.CachedAnalysis(messageID)
+}
+
+func (oac *OpenAIClient) CacheAnalysis(messageID string, result *EmailAnalysisResult) {
+
+	oac.state.CacheAnalysis(messageID, result)
+}
+
+func (oac *OpenAIClient) UsageReport() string {
+
+	return oac.state.UsageReport()
+}
+
+var ErrAIBudgetExceeded = errors.New("monthly AI budget exceeded")
+
+func (oac *OpenAIClient) complete(systemPrompt string, userText string, format *openai.ChatCompletionResponseFormat, sender string) (string, error) {
+
+	if oac.state.BudgetExceeded() {
+		return "", ErrAIBudgetExceeded
+	}
+	userText = truncateToTokenBudget(userText, inputBudget(oac.tokenBudget, systemPrompt))
+	req := openai.ChatCompletionRequest{
+		Model: oac.model,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: systemPrompt,
+			},
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: userText,
+			},
+		},
+		Temperature: 0.25,
+	}
+	if oac.structured.Load() {
+		req.ResponseFormat = format
+	}
+	resp, err := oac.client.CreateChatCompletion(context.Background(), req)
+
+	// Request rejected with structured output, retried once with plain JSON in text. It is
+	// switched off for good only when the error blames the response format.
+
+	var apiErr *openai.APIError
+	if err != nil && req.ResponseFormat != nil && errors.As(err, &apiErr) && apiErr.HTTPStatusCode == http.StatusBadRequest {
+		if responseFormatUnsupported(apiErr.Message) {
+			log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Yellow("Structured output not supported by %s, falling back to plain JSON: %v").String(), oac.model, err)
+			oac.structured.Store(false)
+		} else {
+			log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Yellow("Request rejected by %s, retrying without structured output: %v").String(), oac.model, err)
+		}
+		req.ResponseFormat = nil
+		resp, err = oac.client.CreateChatCompletion(context.Background(), req)
+	}
+	if err != nil {
+		return "", fmt.Errorf("OpenRouter chat completion error: %w", err)
+	}
+	oac.state.RecordUsage(sender, resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+	if len(resp.Choices) == 0 {
+		return "", errors.New("OpenRouter returned no choices")
+	}
+
+	log.Println(au.Gray(12, "[OPENAI]").String() + " " + au.Blue("Received response from OpenRouter, processing...").String())
+	return resp.Choices[0].Message.Content, nil
+}
+
+func responseFormatUnsupported(message string) bool {
+
+	message = strings.ToLower(message)
+	for _, s := range []string{"response_format", "response format", "json_schema", "structured output"} {
+		if strings.Contains(message, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func cleanOpenAIResponse(resp string) string {
 
 	log.Println(au.Gray(12, "[OPENAI]").String() + " " + au.Cyan("Cleaning OpenRouter response...").String())
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"html"
+	"log"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	reMarkupLinks  = regexp.MustCompile(`(?is)<a\s[^>]*href="([^"]*)"[^>]*>(.*?)</a>`)
+	reMarkupTags   = regexp.MustCompile(`(?s)<[^>]*>`)
+	reBlankLines   = regexp.MustCompile(`\n{3,}`)
+	reQuoteHeaders = []*regexp.Regexp{
+		regexp.MustCompile(`(?im)^\s*On .{1,200}wrote:\s*$`),
+		regexp.MustCompile(`(?im)^.{0,200}(пишет|написал|написала)\s*:\s*$`),
+		regexp.MustCompile(`(?im)^\s*-{2,}\s*(Original Message|Forwarded message|Исходное сообщение|Пересылаемое сообщение)\s*-{2,}\s*$`),
+		regexp.MustCompile(`(?im)^\s*From:\s.+\n\s*(Sent|Date):\s.+$`),
+		regexp.MustCompile(`(?im)^\s*От:\s.+\n\s*(Отправлено|Дата):\s.+$`),
+	}
+	reSignatures = []*regexp.Regexp{
+		regexp.MustCompile(`(?m)^-- ?$`),
+		regexp.MustCompile(`(?im)^\s*(Sent from my|Отправлено с|Get Outlook for)\b.*$`),
+	}
+)
+
+// Remove HTML / Telegram HTML markup, leaving plain text and link targets
+
+func stripMarkup(text string) string {
+
+	text = strings.NewReplacer("<br>", "\n", "<br/>", "\n", "<br />", "\n", "</p>", "\n").Replace(text)
+	text = reMarkupLinks.ReplaceAllString(text, "$2 ($1)")
+	text = html.UnescapeString(reMarkupTags.ReplaceAllString(text, ""))
+
+	return strings.TrimSpace(reBlankLines.ReplaceAllString(text, "\n\n"))
+}
+
+// Cut quoted history: "> " lines and everything after a reply attribution
+
+func stripQuotedHistory(text string) string {
+
+	cut := len(text)
+	for _, re := range reQuoteHeaders {
+		if loc := re.FindStringIndex(text); loc != nil && loc[0] > 0 && loc[0] < cut {
+			cut = loc[0]
+		}
+	}
+	text = text[:cut]
+
+	lines := strings.Split(text, "\n")
+	kept := lines[:0]
+	for _, l := range lines {
+		if strings.HasPrefix(strings.TrimSpace(l), ">") {
+			continue
+		}
+		kept = append(kept, l)
+	}
+
+	return strings.TrimSpace(strings.Join(kept, "\n"))
+}
+
+// Cut signature after "-- " delimiter or mobile client footers
+
+func stripSignature(text string) string {
+
+	cut := len(text)
+	for _, re := range reSignatures {
+		if loc := re.FindStringIndex(text); loc != nil && loc[0] > 0 && loc[0] < cut {
+			cut = loc[0]
+		}
+	}
+
+	return strings.TrimSpace(text[:cut])
+}
+
+func prepareEmailBody(body string) string {
+
+	return stripSignature(stripQuotedHistory(stripMarkup(body)))
+}
+
+// Rough token estimate: ~4 chars per token for latin text, ~2 for other scripts
+
+func estimateTokens(text string) int {
+
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+
+	return (ascii+3)/4 + (other+1)/2
+}
+
+// Tokens left for the email after the system prompt, never so few that the cap turns off
+
+const minInputTokens = 256
+
+func inputBudget(total int, systemPrompt string) int {
+
+	return max(total-estimateTokens(systemPrompt), minInputTokens)
+}
+
+// Keep the head and the tail of a text that does not fit the budget
+
+func truncateToTokenBudget(text string, budget int) string {
+
+	tokens := estimateTokens(text)
+	if budget <= 0 || tokens <= budget {
+		return text
+	}
+
+	runes := []rune(text)
+	keep := int(float64(len(runes)) * float64(budget) / float64(tokens) * 0.95)
+	head := keep * 7 / 10
+	tail := keep - head
+	headText := string(runes[:head])
+	if i := strings.LastIndexAny(headText, "\n "); i > len(headText)/2 {
+		headText = headText[:i]
+	}
+	tailText := string(runes[len(runes)-tail:])
+	if i := strings.IndexAny(tailText, "\n "); i >= 0 && i < len(tailText)/2 {
+		tailText = tailText[i+1:]
+	}
+	log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Yellow("Truncated AI input from ~%d to ~%d tokens").String(), tokens, budget)
+
+	return headText + "\n[...truncated...]\n" + tailText
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateToTokenBudget(t *testing.T) {
+
+	long := strings.Repeat("word ", 4000) + "the end"
+	cyrillic := strings.Repeat("слово ", 3000) + "конец"
+	tests := []struct {
+		name   string
+		text   string
+		budget int
+		keep   bool
+	}{
+		{"fits", "short text", 100, true},
+		{"no budget", long, 0, true},
+		{"latin", long, 500, false},
+		{"cyrillic", cyrillic, 500, false},
+	}
+	for _, tt := range tests {
+		got := truncateToTokenBudget(tt.text, tt.budget)
+		if tt.keep {
+			if got != tt.text {
+				t.Errorf("%s: text changed", tt.name)
+			}
+			continue
+		}
+		if !strings.Contains(got, "[...truncated...]") {
+			t.Errorf("%s: no truncation marker", tt.name)
+		}
+		if n := estimateTokens(got); n > tt.budget {
+			t.Errorf("%s: %d tokens, budget %d", tt.name, n, tt.budget)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("%s: broken UTF-8", tt.name)
+		}
+		if !strings.HasPrefix(got, tt.text[:4]) || !strings.HasSuffix(got, tt.text[len(tt.text)-4:]) {
+			t.Errorf("%s: head or tail lost", tt.name)
+		}
+	}
+
+}
+
+func TestPrepareEmailBody(t *testing.T) {
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"markup", "<p>Hello <b>there</b></p><a href=\"https://x.io\">link</a>", "Hello there\nlink (https://x.io)"},
+		{"quote", "Thanks!\n\nOn Mon, 1 Jan 2024, Bob wrote:\n> old text", "Thanks!"},
+		{"quoted lines", "Yes\n> no\nMaybe", "Yes\nMaybe"},
+		{"signature", "See you\n-- \nBob\nCEO", "See you"},
+		{"mobile", "Ok\nSent from my iPhone", "Ok"},
+	}
+	for _, tt := range tests {
+		if got := prepareEmailBody(tt.in); got != tt.want {
+			t.Errorf("%s: prepareEmailBody = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+}
+
+func TestInputBudget(t *testing.T) {
+
+	prompt := strings.Repeat("rule ", 2000)
+	if got := inputBudget(8000, "short"); got != 8000-estimateTokens("short") {
+		t.Errorf("inputBudget(8000) = %d", got)
+	}
+	for _, total := range []int{100, 0, -5} {
+		if got := inputBudget(total, prompt); got != minInputTokens {
+			t.Errorf("inputBudget(%d, long prompt) = %d, want %d", total, got, minInputTokens)
+		}
+	}
+
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cached analyses by Message-ID and token usage rolled up by day and by sender
+
+type AIState struct {
+	mu sync.Mutex
+
+	key          string
+	analysesFile string
+	usageFile    string
+	analyses     map[string]string
+	usage        map[string]string
+
+	promptPrice     float64
+	completionPrice float64
+	monthlyBudget   float64
+}
+
+type aiUsageEntry struct {
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+func NewAIState(recipientID int64, promptPrice float64, completionPrice float64, monthlyBudget float64) *AIState {
+
+	rid := fmt.Sprint(recipientID)
+	analyses, err := LoadAndDecrypt(rid, rid+".ana")
+	if err != nil {
+		log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Yellow("Failed to load cached analyses: %v").String(), err)
+		analyses = make(map[string]string)
+	}
+	usage, err := LoadAndDecrypt(rid, rid+".use")
+	if err != nil {
+		log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Yellow("Failed to load token usage: %v").String(), err)
+		usage = make(map[string]string)
+	}
+
+	return &AIState{
+		key:          rid,
+		analysesFile: rid + ".ana",
+		usageFile:    rid + ".use",
+		analyses:     analyses,
+		usage:        usage,
+
+		promptPrice:     promptPrice,
+		completionPrice: completionPrice,
+		monthlyBudget:   monthlyBudget,
+	}
+}
+
+// Analyses cache
+
+func (s *AIState) CachedAnalysis(messageID string) (*EmailAnalysisResult, bool) {
+
+	if s == nil || messageID == "" {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	raw, ok := s.analyses[messageID]
+	if !ok {
+		return nil, false
+	}
+	var result EmailAnalysisResult
+	if err := json.Unmarshal([]byte(raw), &result); err != nil {
+		return nil, false
+	}
+
+	return &result, true
+}
+
+func (s *AIState) CacheAnalysis(messageID string, result *EmailAnalysisResult) {
+
+	if s == nil || messageID == "" || result == nil {
+		return
+	}
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.analyses[messageID] = string(raw)
+	if err := EncryptAndSave(s.key, s.analysesFile, s.analyses); err != nil {
+		log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Yellow("Failed to save cached analyses: %v").String(), err)
+	}
+
+}
+
+// Token usage
+
+func (s *AIState) RecordUsage(sender string, promptTokens int, completionTokens int) {
+
+	if s == nil {
+		return
+	}
+	cost := (float64(promptTokens)*s.promptPrice + float64(completionTokens)*s.completionPrice) / 1e6
+	now := time.Now()
+	if sender == "" {
+		sender = "-"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range []string{
+		"day:" + now.Format("2006-01-02"),
+		"sender:" + now.Format("2006-01") + ":" + strings.ToLower(sender),
+	} {
+		e := s.entry(key)
+		e.Requests++
+		e.PromptTokens += promptTokens
+		e.CompletionTokens += completionTokens
+		e.Cost += cost
+		raw, _ := json.Marshal(e)
+		s.usage[key] = string(raw)
+	}
+	if err := EncryptAndSave(s.key, s.usageFile, s.usage); err != nil {
+		log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Yellow("Failed to save token usage: %v").String(), err)
+	}
+	log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Blue("Used %d prompt and %d completion tokens ($%.4f)").String(), promptTokens, completionTokens, cost)
+
+}
+
+func (s *AIState) BudgetExceeded() bool {
+
+	if s == nil || s.monthlyBudget <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.monthTotal(time.Now()).Cost >= s.monthlyBudget
+}
+
+func (s *AIState) UsageReport() string {
+
+	if s == nil {
+		return "AI usage is not tracked."
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	today := s.entry("day:" + now.Format("2006-01-02"))
+	month := s.monthTotal(now)
+	text := "📊 <b>AI USAGE</b>\n\n"
+	text += fmt.Sprintf("<b>Today:</b> %d requests, %d + %d tokens, $%.4f\n", today.Requests, today.PromptTokens, today.CompletionTokens, today.Cost)
+	text += fmt.Sprintf("<b>%s:</b> %d requests, %d + %d tokens, $%.4f\n", now.Format("January 2006"), month.Requests, month.PromptTokens, month.CompletionTokens, month.Cost)
+	if s.monthlyBudget > 0 {
+		text += fmt.Sprintf("<b>Budget:</b> $%.2f, used %.0f%%", s.monthlyBudget, month.Cost/s.monthlyBudget*100)
+		if month.Cost >= s.monthlyBudget {
+			text += "\n⏸ AI classification is paused until next month."
+		}
+		text += "\n"
+	}
+
+	// Top senders this month
+
+	prefix := "sender:" + now.Format("2006-01") + ":"
+	type senderUsage struct {
+		sender string
+		entry  aiUsageEntry
+	}
+	var senders []senderUsage
+	for key := range s.usage {
+		if strings.HasPrefix(key, prefix) {
+			senders = append(senders, senderUsage{strings.TrimPrefix(key, prefix), s.entry(key)})
+		}
+	}
+	sort.Slice(senders, func(i, j int) bool { return senders[i].entry.Cost > senders[j].entry.Cost })
+	if len(senders) > 0 {
+		text += "\n<b>Top senders:</b>"
+		for i, su := range senders {
+			if i == 10 {
+				break
+			}
+			text += fmt.Sprintf("\n%s — %d requests, $%.4f", html.EscapeString(su.sender), su.entry.Requests, su.entry.Cost)
+		}
+	}
+
+	return text
+}
+
+func (s *AIState) entry(key string) aiUsageEntry {
+
+	var e aiUsageEntry
+	if raw, ok := s.usage[key]; ok {
+		json.Unmarshal([]byte(raw), &e)
+	}
+
+	return e
+}
+
+func (s *AIState) monthTotal(now time.Time) aiUsageEntry {
+
+	var total aiUsageEntry
+	prefix := "day:" + now.Format("2006-01")
+	for key := range s.usage {
+		if strings.HasPrefix(key, prefix) {
+			e := s.entry(key)
+			total.Requests += e.Requests
+			total.PromptTokens += e.PromptTokens
+			total.CompletionTokens += e.CompletionTokens
+			total.Cost += e.Cost
+		}
+	}
+
+	return total
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type Redactor struct {
+	patterns     []redactPattern
+	neverSenders []string
+}
+
+type redactPattern struct {
+	label string
+	re    *regexp.Regexp
+	valid func(string) bool
+}
+
+// Placeholder -> original value, used to re-hydrate AI answers locally
+
+type Redaction map[string]string
+
+var builtinRedactPatterns = map[string]redactPattern{
+	"card":  {label: "CARD", re: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), valid: luhnValid},
+	"iban":  {label: "IBAN", re: regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]){11,30}\b`), valid: ibanValid},
+	"phone": {label: "PHONE", re: regexp.MustCompile(`\+?\d[\d ().\-]{7,}\d`), valid: phoneValid},
+	"email": {label: "EMAIL", re: regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)},
+}
+
+// Built-in patterns are applied in this order, so card numbers and IBANs are not taken for phones
+
+var builtinRedactOrder = []string{"card", "iban", "phone", "email"}
+
+func NewRedactor(builtins []string, custom map[string]string, neverSenders []string) (*Redactor, error) {
+
+	r := &Redactor{}
+
+	// Built-in patterns
+
+	enabled := make(map[string]bool)
+	for _, name := range builtins {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, ok := builtinRedactPatterns[name]; !ok {
+			return nil, fmt.Errorf("unknown redact pattern: %s", name)
+		}
+		enabled[name] = true
+	}
+	for _, name := range builtinRedactOrder {
+		if enabled[name] {
+			r.patterns = append(r.patterns, builtinRedactPatterns[name])
+		}
+	}
+
+	// Custom patterns, sorted by name for stable placeholders
+
+	names := make([]string, 0, len(custom))
+	for name := range custom {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		re, err := regexp.Compile(custom[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %s: %w", name, err)
+		}
+		r.patterns = append(r.patterns, redactPattern{label: strings.ToUpper(name), re: re})
+	}
+
+	// Never send lists
+
+	for _, s := range neverSenders {
+		if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+			r.neverSenders = append(r.neverSenders, s)
+		}
+	}
+
+	log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Blue("Redaction: %d patterns, %d never-send senders").String(), len(r.patterns), len(r.neverSenders))
+	return r, nil
+}
+
+func (r *Redactor) Redact(text string) (string, Redaction) {
+
+	if r == nil || len(r.patterns) == 0 {
+		return text, nil
+	}
+
+	redaction := make(Redaction)
+	placeholders := make(map[string]string)
+	counters := make(map[string]int)
+	for _, p := range r.patterns {
+		text = p.re.ReplaceAllStringFunc(text, func(match string) string {
+			if p.valid != nil && !p.valid(match) {
+				return match
+			}
+			if ph, ok := placeholders[match]; ok {
+				return ph
+			}
+			counters[p.label]++
+			ph := fmt.Sprintf("[%s_%d]", p.label, counters[p.label])
+			placeholders[match] = ph
+			redaction[ph] = match
+			return ph
+		})
+	}
+	if len(redaction) > 0 {
+		log.Printf(au.Gray(12, "[OPENAI]").String()+" "+au.Blue("Redacted %d values before sending to AI").String(), len(redaction))
+	}
+
+	return text, redaction
+}
+
+func (rd Redaction) Restore(text string) string {
+
+	if len(rd) == 0 {
+		return text
+	}
+	pairs := make([]string, 0, len(rd)*2)
+	for ph, original := range rd {
+		pairs = append(pairs, ph, original)
+	}
+
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+func (r *Redactor) Allowed(from string) bool {
+
+	if r == nil {
+		return true
+	}
+	for _, address := range strings.Split(strings.ToLower(from), ", ") {
+		fields := strings.Fields(address)
+		if len(fields) == 0 {
+			continue
+		}
+		address = fields[0]
+		for _, s := range r.neverSenders {
+			if address == s || (strings.HasPrefix(s, "@") && strings.HasSuffix(address, s)) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Validators
+
+func luhnValid(s string) bool {
+
+	var digits []int
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			digits = append(digits, int(c-'0'))
+		}
+	}
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := digits[i]
+		if (len(digits)-1-i)%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+
+	return sum%10 == 0
+}
+
+func ibanValid(s string) bool {
+
+	s = strings.ReplaceAll(s, " ", "")
+	if len(s) < 15 || len(s) > 34 {
+		return false
+	}
+	var numeric strings.Builder
+	for _, c := range s[4:] + s[:4] {
+		switch {
+		case c >= '0' && c <= '9':
+			numeric.WriteRune(c)
+		case c >= 'A' && c <= 'Z':
+			numeric.WriteString(fmt.Sprint(int(c-'A') + 10))
+		default:
+			return false
+		}
+	}
+	n, ok := new(big.Int).SetString(numeric.String(), 10)
+
+	return ok && new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
+
+func phoneValid(s string) bool {
+
+	digits := 0
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			digits++
+		}
+	}
+
+	return digits >= 9 && digits <= 15
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLuhnValid(t *testing.T) {
+
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"4111 1111 1111 1111", true},
+		{"4111-1111-1111-1111", true},
+		{"5500000000000004", true},
+		{"4111 1111 1111 1112", false},
+		{"1234 5678 9012", false},
+		{"12345678901234567890", false},
+	}
+	for _, tt := range tests {
+		if got := luhnValid(tt.in); got != tt.want {
+			t.Errorf("luhnValid(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+
+}
+
+func TestIbanValid(t *testing.T) {
+
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"DE89370400440532013000", true},
+		{"DE89 3704 0044 0532 0130 00", true},
+		{"GB29NWBK60161331926819", true},
+		{"DE89370400440532013001", false},
+		{"DE8937040044", false},
+		{"de89370400440532013000", false},
+	}
+	for _, tt := range tests {
+		if got := ibanValid(tt.in); got != tt.want {
+			t.Errorf("ibanValid(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+
+}
+
+func TestPhoneValid(t *testing.T) {
+
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"+1 (555) 123-4567", true},
+		{"+49 30 1234567", true},
+		{"2024-01-15", false},
+		{"1234567", false},
+		{"+1234567890123456", false},
+	}
+	for _, tt := range tests {
+		if got := phoneValid(tt.in); got != tt.want {
+			t.Errorf("phoneValid(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+
+}
+
+func TestRedactRestore(t *testing.T) {
+
+	r, err := NewRedactor([]string{"card", "iban", "phone", "email"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := "Card 4111 1111 1111 1111, IBAN DE89370400440532013000, mail john@example.com"
+	masked, rd := r.Redact(text)
+	for _, secret := range []string{"4111 1111 1111 1111", "DE89370400440532013000", "john@example.com"} {
+		if strings.Contains(masked, secret) {
+			t.Errorf("Redact left %q in %q", secret, masked)
+		}
+	}
+	if got := rd.Restore(masked); got != text {
+		t.Errorf("Restore = %q, want %q", got, text)
+	}
+
+}
+
+func TestAllowed(t *testing.T) {
+
+	r, err := NewRedactor(nil, nil, []string{"boss@example.com", "@bank.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		from string
+		want bool
+	}{
+		{"Boss@Example.com (The Boss)", false},
+		{"alerts@bank.example.com", false},
+		{"friend@example.com", true},
+		{"friend@example.com, boss@example.com", false},
+	}
+	for _, tt := range tests {
+		if got := r.Allowed(tt.from); got != tt.want {
+			t.Errorf("Allowed(%q) = %v, want %v", tt.from, got, tt.want)
+		}
+	}
+
+}
@@ -4,13 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"html"
 	"log"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mymmrac/telego"
 	tu "github.com/mymmrac/telego/telegoutil"
+	telehtml "github.com/svanichkin/TelegramHTML"
 )
 
 type TelegramBot struct {
@@ -19,11 +21,57 @@ type TelegramBot struct {
 	token       string
 	updates     <-chan telego.Update
 	isChat      bool
+	translate   bool
+	zipFiles    int
+	onDemand    bool
+	draftMode   bool
+	undoSend    bool
+	timeZone    *time.Location
 	tids        map[string]string
 	uids        map[string]string
+	threads     map[string]string
+	moved       map[string]string
+	topicsMu    sync.Mutex
+	mails       map[string]string
+	mailsMu     sync.Mutex
+	drafts      map[int]draftReply
+	previews    map[int]*EmailPreview
+	draftsMu    sync.Mutex
+	fileIDs     map[string]string
+	fileIDsMu   sync.Mutex
 	ctx         context.Context
 }
 
+type TelegramCallbacks struct {
+	Reply          func(uid, tid int, message string, files []struct{ Url, Name string })
+	SendReply      func(uid, tid int, message string, files []struct{ Url, Name string })
+	New            func(from string, to string, title string, message string, files []struct{ Url, Name string })
+	Expand         func(uid, tid int)
+	Draft          func(uid, tid int, language string)
+	Summary        func(uids []int, tid int)
+	Usage          func(tid int)
+	Translate      func(uid, tid int)
+	TranslateReply func(uid, tid int, message string, files []struct{ Url, Name string }, language string)
+	Rsvp           func(uid, tid, mid, index int, partstat string)
+	Attachment     func(uid, tid int, part string)
+	Source         func(uid, tid int, headersOnly bool)
+	Preview        func(p *EmailPreview)
+	PreviewAction  func(p *EmailPreview, send bool)
+	Undo           func(mid int, id string) bool
+	Scheduled      func(tid int)
+	Unschedule     func(mid int, id string)
+	Snooze         func(uid, tid, mid, picker int, until time.Time)
+	Mailbox        func(uid int, action string, folder string) (bool, string, error)
+	Folders        func() ([]string, error)
+}
+
+type draftReply struct {
+	uid      int
+	text     string
+	files    []struct{ Url, Name string }
+	language string
+}
+
 func NewTelegramBot(apiToken string, recipientID int64) (*TelegramBot, error) {
 
 	log.Println(au.Gray(12, "[TELEGRAM]").String() + " " + au.Cyan("Initializing Telegram bot...").String())
@@ -57,6 +105,21 @@ func NewTelegramBot(apiToken string, recipientID int64) (*TelegramBot, error) {
 		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Yellow("Failed to load (unical mail id) uids: %v").String(), err)
 		uids = make(map[string]string)
 	}
+	threads, err := LoadAndDecrypt(rid, rid+".thr")
+	if err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Yellow("Failed to load threads: %v").String(), err)
+		threads = make(map[string]string)
+	}
+	moved, err := LoadAndDecrypt(rid, rid+".mov")
+	if err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Yellow("Failed to load moved uids: %v").String(), err)
+		moved = make(map[string]string)
+	}
+	mails, err := LoadAndDecrypt(rid, rid+".sta")
+	if err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Yellow("Failed to load mail states: %v").String(), err)
+		mails = make(map[string]string)
+	}
 
 	log.Println(au.Gray(12, "[TELEGRAM]").String() + " " + au.Green(au.Bold("Bot initialized successfully")).String())
 	return &TelegramBot{
@@ -67,11 +130,16 @@ func NewTelegramBot(apiToken string, recipientID int64) (*TelegramBot, error) {
 		ctx:         context.Background(),
 		tids:        tids,
 		uids:        uids,
+		threads:     threads,
+		moved:       moved,
+		mails:       mails,
+		drafts:      make(map[int]draftReply),
+		previews:    make(map[int]*EmailPreview),
 	}, nil
 
 }
 
-func (tb *TelegramBot) StartListener(replayMessage func(uid int, message string, files []struct{ Url, Name string }), newMessage func(to string, title string, message string, files []struct{ Url, Name string }), expandMessage func(uid, tid int)) {
+func (tb *TelegramBot) StartListener(callbacks TelegramCallbacks) {
 
 	log.Println(au.Gray(12, "[TELEGRAM]").String() + " " + au.Cyan("Starting message listener...").String())
 	if tb.ctx == nil {
@@ -79,7 +147,7 @@ func (tb *TelegramBot) StartListener(replayMessage func(uid int, message string,
 	}
 	go func() {
 		for update := range tb.updates {
-			tb.handleUpdate(update, replayMessage, newMessage, expandMessage)
+			tb.handleUpdate(update, callbacks)
 		}
 	}()
 
@@ -103,6 +171,25 @@ func (tb *TelegramBot) SendMessage(msg string) error {
 
 }
 
+func (tb *TelegramBot) SendHTMLMessage(tid int, text string) error {
+
+	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Magenta("Sending HTML message to topic %d").String(), tid)
+	if tb.api == nil {
+		return errors.New("telego API is not initialized in SendHTMLMessage")
+	}
+	if tb.ctx == nil {
+		tb.ctx = context.Background()
+	}
+	for _, msg := range telehtml.SplitTelegramHTML(text) {
+		if err := tb.sendMessage(tid, msg, "", ""); err != nil {
+			return fmt.Errorf("failed to send message via Telego: %w", err)
+		}
+	}
+
+	return nil
+
+}
+
 func (tb *TelegramBot) RequestUserInput(prompt string) (string, error) {
 
 	log.Println(au.Gray(12, "[TELEGRAM]").String() + " " + au.Cyan("Requesting user input...").String())
@@ -192,7 +279,11 @@ func (tb *TelegramBot) SendEmailData(d *ParsedEmailData) error {
 		if err := tb.sendHumanOrNotificationOrUnknown(tid, d); err != nil {
 			return err
 		}
-		if err := tb.sendAttachments(tid, d); err != nil {
+		notes, retry := tb.sendImages(tid, d)
+		if err := tb.sendEvents(tid, d); err != nil {
+			return err
+		}
+		if err := tb.sendAttachments(tid, d, notes, retry); err != nil {
 			return err
 		}
 	}
@@ -221,6 +312,141 @@ func (tb *TelegramBot) SendExpandEmailData(d *ParsedEmailData, tid int) error {
 	return nil
 }
 
+func (tb *TelegramBot) SendAttachment(tid int, uid int, name string, content []byte) error {
+
+	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Cyan("Sending attachment on demand (UID: %d)").String(), uid)
+	if tb.ctx == nil {
+		tb.ctx = context.Background()
+	}
+
+	return tb.sendDocument(tid, uid, name, content)
+}
+
+func (tb *TelegramBot) SendEML(tid int, uid int, raw []byte) error {
+
+	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Cyan("Sending original email (UID: %d)").String(), uid)
+	if tb.ctx == nil {
+		tb.ctx = context.Background()
+	}
+
+	return tb.sendDocument(tid, uid, fmt.Sprintf("email-%d.eml", uid), raw)
+}
+
+// Replace the RSVP buttons of an invitation card with the sent answer
+
+func (tb *TelegramBot) MarkEventReplied(mid int, partstat string) {
+
+	if tb.ctx == nil {
+		tb.ctx = context.Background()
+	}
+	status := map[string]string{
+		"ACCEPTED":  "✅ ACCEPTED",
+		"TENTATIVE": "❔ TENTATIVE",
+		"DECLINED":  "❌ DECLINED",
+	}[partstat]
+	tb.editReplyMarkup(mid, tu.InlineKeyboard(tu.InlineKeyboardRow(
+		telego.InlineKeyboardButton{Text: status, CallbackData: "noop"},
+	)))
+
+}
+
+func (tb *TelegramBot) SendDraftReply(uid int, tid int, draft string, files []struct{ Url, Name string }) error {
+
+	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Cyan("Sending draft reply (UID: %d)").String(), uid)
+	if tb.api == nil {
+		return errors.New("telego API is not initialized in SendDraftReply")
+	}
+	if tb.ctx == nil {
+		tb.ctx = context.Background()
+	}
+	draft = html.EscapeString(draft) // replies are Telegram HTML, the AI draft is plain text
+	p := tu.Message(tu.ID(tb.recipientId), "✍️ <b>DRAFT REPLY</b>\n\n"+draft+telehtml.EncodeIntInvisible(uid))
+	p.ParseMode = telego.ModeHTML
+	p.MessageThreadID = tid
+	p.ReplyMarkup = tu.InlineKeyboard(tu.InlineKeyboardRow(
+		telego.InlineKeyboardButton{Text: "📤 SEND", CallbackData: "draftsend"},
+		telego.InlineKeyboardButton{Text: "✏️ EDIT", CallbackData: "draftedit"},
+		telego.InlineKeyboardButton{Text: "🗑 DISCARD", CallbackData: "draftdiscard"},
+	))
+	m, err := tb.api.SendMessage(tb.ctx, p)
+	if err != nil {
+		return fmt.Errorf("failed to send draft reply with Telego: %w", err)
+	}
+	tb.draftsMu.Lock()
+	tb.drafts[m.MessageID] = draftReply{uid: uid, text: draft, files: files}
+	tb.draftsMu.Unlock()
+
+	log.Println(au.Gray(12, "[TELEGRAM]").String() + " " + au.Green("Draft reply sent successfully").String())
+	return nil
+}
+
+func (tb *TelegramBot) OfferReplyTranslation(uid int, tid int, message string, files []struct{ Url, Name string }, language string) error {
+
+	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Cyan("Offering reply translation to %s (UID: %d)").String(), language, uid)
+	if tb.api == nil {
+		return errors.New("telego API is not initialized in OfferReplyTranslation")
+	}
+	if tb.ctx == nil {
+		tb.ctx = context.Background()
+	}
+	p := tu.Message(tu.ID(tb.recipientId), "🌐 The email is written in <b>"+html.EscapeString(language)+"</b>. Translate your reply before sending?"+telehtml.EncodeIntInvisible(uid))
+	p.ParseMode = telego.ModeHTML
+	p.MessageThreadID = tid
+	p.ReplyMarkup = tu.InlineKeyboard(tu.InlineKeyboardRow(
+		telego.InlineKeyboardButton{Text: "🌐 TRANSLATE", CallbackData: "drafttranslate"},
+		telego.InlineKeyboardButton{Text: "📤 SEND AS IS", CallbackData: "draftsend"},
+		telego.InlineKeyboardButton{Text: "🗑 DISCARD", CallbackData: "draftdiscard"},
+	))
+	m, err := tb.api.SendMessage(tb.ctx, p)
+	if err != nil {
+		return fmt.Errorf("failed to send translation offer with Telego: %w", err)
+	}
+	tb.draftsMu.Lock()
+	tb.drafts[m.MessageID] = draftReply{uid: uid, text: message, files: files, language: language}
+	tb.draftsMu.Unlock()
+
+	return nil
+}
+
+func (tb *TelegramBot) SendThreadSummary(tid int, summary *ThreadSummary) error {
+
+	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Cyan("Sending thread summary to topic %d").String(), tid)
+	if tb.api == nil {
+		return errors.New("telego API is not initialized in SendThreadSummary")
+	}
+	if tb.ctx == nil {
+		tb.ctx = context.Background()
+	}
+	if summary == nil {
+		return errors.New("thread summary is nil")
+	}
+	text := "📋 <b>SUMMARY</b>\n\n" + html.EscapeString(summary.Digest)
+	for _, section := range []struct {
+		title string
+		items []string
+	}{
+		{"Decisions", summary.Decisions},
+		{"Open questions", summary.OpenQuestions},
+		{"Action items", summary.ActionItems},
+	} {
+		if len(section.items) == 0 {
+			continue
+		}
+		text += "\n\n<b>" + section.title + "</b>"
+		for _, item := range section.items {
+			text += "\n• " + html.EscapeString(item)
+		}
+	}
+	for _, msg := range telehtml.SplitTelegramHTML(text) {
+		if err := tb.sendMessage(tid, msg, "", ""); err != nil {
+			return fmt.Errorf("failed to send thread summary with Telego: %w", err)
+		}
+	}
+
+	log.Println(au.Gray(12, "[TELEGRAM]").String() + " " + au.Green("Thread summary sent successfully").String())
+	return nil
+}
+
 // Checkers
 
 func (tb *TelegramBot) CheckAndRequestAdminRights(chatID int64) (bool, error) {
@@ -276,7 +502,7 @@ func (tb *TelegramBot) CheckTopicsEnabled(chat *telego.ChatFullInfo) (bool, erro
 
 // Events from user
 
-func (tb *TelegramBot) handleUpdate(update telego.Update, replayMessageFunc func(uid int, message string, files []struct{ Url, Name string }), newMessageFunc func(to string, title string, message string, files []struct{ Url, Name string }), expandMessageFunc func(uid, tid int)) {
+func (tb *TelegramBot) handleUpdate(update telego.Update, callbacks TelegramCallbacks) {
 
 	if tb.ctx == nil {
 		tb.ctx = context.Background()
@@ -285,11 +511,16 @@ func (tb *TelegramBot) handleUpdate(update telego.Update, replayMessageFunc func
 	switch {
 	case update.Message != nil:
 		msg = update.Message
+	case update.EditedMessage != nil:
+		msg = update.EditedMessage
 	case update.CallbackQuery != nil && update.CallbackQuery.Message != nil:
 		msg = update.CallbackQuery.Message.Message()
 	default:
 		return
 	}
+	if msg == nil {
+		return
+	}
 	var fid int64
 	if msg.From != nil {
 		fid = msg.From.ID
@@ -303,25 +534,50 @@ func (tb *TelegramBot) handleUpdate(update telego.Update, replayMessageFunc func
 		return
 	}
 
-	// Handle expand message callback
+	// Handle inline buttons
 
-	if strings.HasPrefix(update.CallbackQuery.Data, "expand:") {
-		uid, err := strconv.Atoi(strings.TrimPrefix(update.CallbackQuery.Data, "expand:"))
-		if err != nil {
+	if update.CallbackQuery != nil {
+		tb.handleCallbackQuery(update.CallbackQuery, msg, callbacks)
+		return
+	}
+
+	// Edits only matter for email drafts
+
+	if update.EditedMessage != nil {
+		if !tb.hasPreview(msg.MessageID) {
 			return
 		}
-		tb.handleExpandMessage(msg, uid, expandMessageFunc)
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Updating email draft of edited message %d").String(), msg.MessageID)
+		if msg.ReplyToMessage != nil {
+			tb.handleReplyMessage(msg, tb.previewReply(msg.MessageID, callbacks.Preview))
+		} else {
+			tb.handleNewMessage(msg, tb.previewNew(msg.MessageID, msg.MessageThreadID, callbacks.Preview))
+		}
+		return
+	}
+
+	// Handle commands
+
+	if strings.HasPrefix(msg.Text, "/") && tb.handleCommand(msg, callbacks) {
 		return
 	}
 
-	// Handle reply messages or topic message
+	// Handle reply messages or topic message, in draft mode as a preview first
 
 	if msg.ReplyToMessage != nil {
-		tb.handleReplyMessage(msg, replayMessageFunc)
+		if tb.draftMode {
+			tb.handleReplyMessage(msg, tb.previewReply(msg.MessageID, callbacks.Preview))
+			return
+		}
+		tb.handleReplyMessage(msg, callbacks.Reply)
 		return
 	}
 
 	// Handle new messages
 
-	tb.handleNewMessage(msg, newMessageFunc)
+	if tb.draftMode {
+		tb.handleNewMessage(msg, tb.previewNew(msg.MessageID, msg.MessageThreadID, callbacks.Preview))
+		return
+	}
+	tb.handleNewMessage(msg, callbacks.New)
 }
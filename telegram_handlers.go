@@ -2,38 +2,19 @@ package main
 
 import (
 	"fmt"
+	"html"
 	"log"
 	"strconv"
+	"strings"
 
 	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
 	telehtml "github.com/svanichkin/TelegramHTML"
 )
 
-func (tb *TelegramBot) handleReplyMessage(msg *telego.Message, replayMessageFunc func(uid int, message string, files []struct{ Url, Name string })) {
-
-	// Get uid marked message
-
-	var uid int
-	if msg.MessageThreadID > 0 {
-
-		// Get uid from topic
-
-		uid, _ = strconv.Atoi(tb.uids[fmt.Sprint(msg.MessageThreadID)])
-
-	} else {
-
-		// Get uid from message
-
-		repliedText := msg.ReplyToMessage.Text
-		if repliedText == "" && msg.ReplyToMessage.Caption != "" {
-			repliedText = msg.ReplyToMessage.Caption
-		}
-		res := telehtml.FindInvisibleIntSequences(repliedText)
-		if len(res) > 0 {
-			uid = telehtml.DecodeIntInvisible(res[0])
-		}
-	}
+func (tb *TelegramBot) handleReplyMessage(msg *telego.Message, replayMessageFunc func(uid, tid int, message string, files []struct{ Url, Name string })) {
 
+	uid := tb.messageUid(msg)
 	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Processing reply to message UID %d").String(), uid)
 
 	// Group files (album)
@@ -46,7 +27,7 @@ func (tb *TelegramBot) handleReplyMessage(msg *telego.Message, replayMessageFunc
 			}
 			text := extractTextFromMessages(albumMsgs)
 			log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Magenta("Processing album reply with %d files").String(), len(files))
-			replayMessageFunc(uid, text, files)
+			replayMessageFunc(uid, msg.MessageThreadID, text, files)
 		}) {
 			return
 		}
@@ -56,16 +37,43 @@ func (tb *TelegramBot) handleReplyMessage(msg *telego.Message, replayMessageFunc
 	// Single file / non-album message
 
 	files := tb.getAllFileURLs(msg)
-	body := msg.Text
-	if body == "" {
-		body = msg.Caption
-	}
+	body := messageHTML(msg)
 	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Magenta("Processing single reply with %d files").String(), len(files))
-	replayMessageFunc(uid, body, files)
+	replayMessageFunc(uid, msg.MessageThreadID, body, files)
+
+}
+
+// UID of the email a message answers, from the topic or the invisible mark of the replied message
+
+func (tb *TelegramBot) messageUid(msg *telego.Message) int {
 
+	var uid int
+	if msg.MessageThreadID > 0 {
+
+		// Get uid from topic
+
+		tb.topicsMu.Lock()
+		uid, _ = strconv.Atoi(tb.uids[fmt.Sprint(msg.MessageThreadID)])
+		tb.topicsMu.Unlock()
+
+	} else if msg.ReplyToMessage != nil {
+
+		// Get uid from message
+
+		repliedText := msg.ReplyToMessage.Text
+		if repliedText == "" && msg.ReplyToMessage.Caption != "" {
+			repliedText = msg.ReplyToMessage.Caption
+		}
+		res := telehtml.FindInvisibleIntSequences(repliedText)
+		if len(res) > 0 {
+			uid = telehtml.DecodeIntInvisible(res[0])
+		}
+	}
+
+	return tb.currentUid(uid)
 }
 
-func (tb *TelegramBot) handleNewMessage(msg *telego.Message, newMessageFunc func(to string, title string, message string, files []struct{ Url, Name string })) {
+func (tb *TelegramBot) handleNewMessage(msg *telego.Message, newMessageFunc func(from string, to string, title string, message string, files []struct{ Url, Name string })) {
 
 	// Triggered bot off
 
@@ -77,18 +85,9 @@ func (tb *TelegramBot) handleNewMessage(msg *telego.Message, newMessageFunc func
 
 	if msg.MediaGroupID != "" {
 		if tb.bufferAlbumMessage(msg, func(albumMsgs []*telego.Message) {
-			var rawText string
-			for _, m := range albumMsgs {
-				if m.Text != "" {
-					rawText = m.Text
-					break
-				}
-				if m.Caption != "" {
-					rawText = m.Caption
-					break
-				}
-			}
-			to, title, body, ok := parseMailContent(rawText)
+			line, text := cutSendAtLine(extractTextFromMessages(albumMsgs))
+			from, text := parseFromLine(text)
+			to, title, body, ok := parseMailContent(text)
 			if !ok {
 				log.Println(au.Gray(12, "[TELEGRAM]").String() + " " + au.Yellow("Invalid mail format in album").String())
 				tb.sendInstructions()
@@ -99,7 +98,7 @@ func (tb *TelegramBot) handleNewMessage(msg *telego.Message, newMessageFunc func
 				files = append(files, tb.getAllFileURLs(m)...)
 			}
 			log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Magenta("Processing new album message with %d files").String(), len(files))
-			newMessageFunc(to, title, body, files)
+			newMessageFunc(from, to, title, withSendAtLine(line, body), files)
 		}) {
 			return
 		}
@@ -107,12 +106,9 @@ func (tb *TelegramBot) handleNewMessage(msg *telego.Message, newMessageFunc func
 
 	// Single file / non-album new message
 
-	msgText := msg.Text
-	if msgText == "" {
-		msgText = msg.Caption
-	}
-
-	to, title, body, ok := parseMailContent(msgText)
+	line, text := cutSendAtLine(messageHTML(msg))
+	from, text := parseFromLine(text)
+	to, title, body, ok := parseMailContent(text)
 	if !ok {
 		log.Println(au.Gray(12, "[TELEGRAM]").String() + " " + au.Yellow("Invalid mail format, sending instructions").String())
 		tb.sendInstructions()
@@ -121,7 +117,7 @@ func (tb *TelegramBot) handleNewMessage(msg *telego.Message, newMessageFunc func
 
 	files := tb.getAllFileURLs(msg)
 	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Magenta("Processing new message with %d files").String(), len(files))
-	newMessageFunc(to, title, body, files)
+	newMessageFunc(from, to, title, withSendAtLine(line, body), files)
 }
 
 func (tb *TelegramBot) handleExpandMessage(msg *telego.Message, uid int, expandMessageFunc func(uid int, tid int)) {
@@ -130,3 +126,179 @@ func (tb *TelegramBot) handleExpandMessage(msg *telego.Message, uid int, expandM
 	expandMessageFunc(uid, msg.MessageThreadID)
 
 }
+
+func (tb *TelegramBot) handleCallbackQuery(query *telego.CallbackQuery, msg *telego.Message, callbacks TelegramCallbacks) {
+
+	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Cyan("Processing callback: %s").String(), query.Data)
+	action, arg, _ := strings.Cut(query.Data, ":")
+	if action != "undo" {
+		tb.answerCallbackQuery(query.ID, "")
+	}
+	switch action {
+	case "expand":
+		uid, err := tb.callbackUid(arg)
+		if err != nil {
+			return
+		}
+		tb.handleExpandMessage(msg, uid, callbacks.Expand)
+	case "draft":
+		uidStr, language, _ := strings.Cut(arg, ":")
+		uid, err := tb.callbackUid(uidStr)
+		if err != nil {
+			return
+		}
+		tb.handleDraftMessage(msg, uid, language, callbacks.Draft)
+	case "translate":
+		uid, err := tb.callbackUid(arg)
+		if err != nil {
+			return
+		}
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Processing translate of message UID %d").String(), uid)
+		callbacks.Translate(uid, msg.MessageThreadID)
+	case "eml", "headers":
+		uid, err := tb.callbackUid(arg)
+		if err != nil {
+			return
+		}
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Processing %s of message UID %d").String(), action, uid)
+		callbacks.Source(uid, msg.MessageThreadID, action == "headers")
+	case "attachment", "part":
+		uidStr, part, _ := strings.Cut(arg, ":")
+		uid, err := tb.callbackUid(uidStr)
+		if err != nil || part == "" {
+			return
+		}
+
+		// Older buttons carry the index in the sorted attachment names
+
+		if action == "attachment" {
+			part = "@" + part
+		}
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Processing attachment %s of message UID %d").String(), part, uid)
+		callbacks.Attachment(uid, msg.MessageThreadID, part)
+	case "rsvp":
+		// rsvp:uid:event:partstat, buttons sent before events were numbered have no index
+
+		parts := strings.Split(arg, ":")
+		uid, err := tb.callbackUid(parts[0])
+		if err != nil || len(parts) < 2 {
+			return
+		}
+		index, partstat := -1, parts[len(parts)-1]
+		if len(parts) == 3 {
+			if index, err = strconv.Atoi(parts[1]); err != nil {
+				return
+			}
+		}
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Processing %s reply to invitation %d in message UID %d").String(), partstat, index, uid)
+		callbacks.Rsvp(uid, msg.MessageThreadID, msg.MessageID, index, partstat)
+	case "draftsend", "draftedit", "draftdiscard", "drafttranslate":
+		tb.handleDraftAction(msg, action, callbacks)
+	case "outsend", "outedit", "outcancel":
+		tb.handlePreviewAction(msg, action, arg, callbacks)
+	case "undo":
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Processing undo of queued email %s").String(), arg)
+		if callbacks.Undo(msg.MessageID, arg) {
+			tb.answerCallbackQuery(query.ID, "")
+		} else {
+			tb.answerCallbackQuery(query.ID, "Too late, the email is already being sent")
+		}
+	case "snooze", "snoozeat":
+		tb.handleSnoozeAction(msg, action, arg, callbacks)
+	case "read", "unread", "star", "unstar", "archive", "trash", "move", "moveto", "movetoh":
+		tb.handleMailboxAction(msg, action, arg, callbacks)
+	case "close":
+		if err := tb.api.DeleteMessage(tb.ctx, tu.Delete(tu.ID(tb.recipientId), msg.MessageID)); err != nil {
+			log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error deleting message %d: %v").String(), msg.MessageID, err)
+		}
+	case "unschedule":
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Processing cancel of scheduled email %s").String(), arg)
+		callbacks.Unschedule(msg.MessageID, arg)
+	}
+
+}
+
+func (tb *TelegramBot) handleDraftMessage(msg *telego.Message, uid int, language string, draftMessageFunc func(uid, tid int, language string)) {
+
+	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Processing draft reply to message UID %d").String(), uid)
+	draftMessageFunc(uid, msg.MessageThreadID, language)
+
+}
+
+func (tb *TelegramBot) handleDraftAction(msg *telego.Message, action string, callbacks TelegramCallbacks) {
+
+	tb.draftsMu.Lock()
+	draft, ok := tb.drafts[msg.MessageID]
+	delete(tb.drafts, msg.MessageID)
+	tb.draftsMu.Unlock()
+	if !ok {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Yellow("Draft for message %d not found").String(), msg.MessageID)
+		tb.editMessage(msg.MessageID, "⌛️ <b>DRAFT EXPIRED</b>")
+		return
+	}
+
+	switch action {
+	case "draftsend":
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Magenta("Sending draft reply to UID %d").String(), draft.uid)
+		tb.editMessage(msg.MessageID, tb.sentLabel("REPLY")+"\n\n"+draft.text+telehtml.EncodeIntInvisible(draft.uid))
+		callbacks.SendReply(draft.uid, msg.MessageThreadID, draft.text, draft.files)
+	case "draftedit":
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Editing draft reply to UID %d").String(), draft.uid)
+		tb.editMessage(msg.MessageID, "✏️ <b>DRAFT REPLY</b>\n\n<pre>"+html.EscapeString(stripMarkup(draft.text))+"</pre>\n\nCopy the draft, edit it and send it as a reply to this message."+telehtml.EncodeIntInvisible(draft.uid))
+	case "drafttranslate":
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Translating reply to UID %d into %s").String(), draft.uid, draft.language)
+		if err := tb.api.DeleteMessage(tb.ctx, tu.Delete(tu.ID(tb.recipientId), msg.MessageID)); err != nil {
+			log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error deleting translation offer: %v").String(), err)
+		}
+		callbacks.TranslateReply(draft.uid, msg.MessageThreadID, draft.text, draft.files, draft.language)
+	case "draftdiscard":
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Discarding draft reply to UID %d").String(), draft.uid)
+		if err := tb.api.DeleteMessage(tb.ctx, tu.Delete(tu.ID(tb.recipientId), msg.MessageID)); err != nil {
+			log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error deleting draft message: %v").String(), err)
+		}
+	}
+
+}
+
+func (tb *TelegramBot) handleCommand(msg *telego.Message, callbacks TelegramCallbacks) bool {
+
+	command, _, _ := strings.Cut(strings.Fields(msg.Text)[0], "@")
+	switch command {
+	case "/summary":
+		if !tb.isChat || msg.MessageThreadID == 0 {
+			tb.SendMessage("Use /summary inside an email topic.")
+			return true
+		}
+		uids := tb.threadUids(msg.MessageThreadID)
+		if len(uids) == 0 {
+			tb.sendMessage(msg.MessageThreadID, "No emails found in this topic.", "", "")
+			return true
+		}
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Processing summary for topic %d with %d emails").String(), msg.MessageThreadID, len(uids))
+		callbacks.Summary(uids, msg.MessageThreadID)
+		return true
+	case "/usage":
+		log.Println(au.Gray(12, "[TELEGRAM]").String() + " " + au.Blue("Processing usage report").String())
+		callbacks.Usage(msg.MessageThreadID)
+		return true
+	case "/read", "/unread", "/star", "/unstar", "/archive", "/delete", "/move":
+		_, arg, _ := strings.Cut(strings.TrimSpace(msg.Text), " ")
+		tb.handleMailboxCommand(msg, command, strings.TrimSpace(arg), callbacks)
+		return true
+	case "/scheduled":
+		log.Println(au.Gray(12, "[TELEGRAM]").String() + " " + au.Blue("Processing scheduled emails list").String())
+		callbacks.Scheduled(msg.MessageThreadID)
+		return true
+	case "/sendat":
+
+		// The email follows on the next lines, a lone command would be sent as its text
+
+		if !strings.Contains(strings.TrimSpace(msg.Text), "\n") {
+			tb.sendMessage(msg.MessageThreadID, "Write the email below the send time, e.g.\n<code>/sendat tomorrow 9:00</code>\n<code>Hello!</code>", "", "")
+			return true
+		}
+	}
+
+	return false
+
+}
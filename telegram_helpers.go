@@ -1,18 +1,29 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"html"
 	"log"
 	"strconv"
+	"strings"
 
 	"github.com/mymmrac/telego"
 	tu "github.com/mymmrac/telego/telegoutil"
 	telehtml "github.com/svanichkin/TelegramHTML"
 )
 
+// Telegram Bot API upload limits, and the size of attachments worth zipping
+
+const (
+	maxPhotoSize    = 10 << 20
+	maxDocumentSize = 50 << 20
+	zipFileSize     = 1 << 20
+)
+
 func (tb *TelegramBot) ensureTopic(subject string) (string, error) {
 
 	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Cyan("Ensuring topic exists: %s").String(), subject)
@@ -49,11 +60,13 @@ func (tb *TelegramBot) createTopicAndGetId(data *ParsedEmailData) (tid int, err
 	// Check topic id from topics, then create topic if needed
 
 	subj := cleanSubject(data.Subject)
+	tb.topicsMu.Lock()
 	t := tb.tids[subj]
 	if t == "" {
 		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Creating new topic for: %s").String(), subj)
 		t, err = tb.ensureTopic(subj)
 		if err != nil {
+			tb.topicsMu.Unlock()
 			return 0, fmt.Errorf("topic handling error (ensureTopic failed): %w", err)
 		}
 		tb.tids[subj] = t
@@ -65,6 +78,8 @@ func (tb *TelegramBot) createTopicAndGetId(data *ParsedEmailData) (tid int, err
 			log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Yellow("Failed to save uids: %v").String(), err)
 		}
 	}
+	tb.topicsMu.Unlock()
+	tb.addThreadUid(t, data.Uid)
 	tid, err = strconv.Atoi(t)
 	if err != nil {
 		log.Println("Ошибка конвертации:", err)
@@ -73,7 +88,50 @@ func (tb *TelegramBot) createTopicAndGetId(data *ParsedEmailData) (tid int, err
 
 }
 
-func (tb *TelegramBot) sendMessage(tid int, text, unsubscribe, uid string) error {
+func (tb *TelegramBot) addThreadUid(tid string, uid int) {
+
+	rid := fmt.Sprint(tb.recipientId)
+	tb.topicsMu.Lock()
+	defer tb.topicsMu.Unlock()
+	if tb.threads[tid] == "" {
+		tb.threads[tid] = fmt.Sprint(uid)
+	} else {
+		tb.threads[tid] += "," + fmt.Sprint(uid)
+	}
+	if err := EncryptAndSave(rid, rid+".thr", tb.threads); err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Yellow("Failed to save threads: %v").String(), err)
+	}
+
+}
+
+func (tb *TelegramBot) threadUids(tid int) []int {
+
+	t := fmt.Sprint(tid)
+	tb.topicsMu.Lock()
+	list := tb.threads[t]
+	if list == "" {
+		list = tb.uids[t]
+	}
+	tb.topicsMu.Unlock()
+	var uids []int
+	for _, s := range strings.Split(list, ",") {
+		if uid, err := strconv.Atoi(s); err == nil {
+			uids = append(uids, uid)
+		}
+	}
+
+	return uids
+
+}
+
+func (tb *TelegramBot) sendMessage(tid int, text, unsubscribe, uid string, rows ...[]telego.InlineKeyboardButton) error {
+
+	_, err := tb.postMessage(tid, text, unsubscribe, uid, rows...)
+
+	return err
+}
+
+func (tb *TelegramBot) postMessage(tid int, text, unsubscribe, uid string, rows ...[]telego.InlineKeyboardButton) (*telego.Message, error) {
 
 	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Magenta("Sending message to topic %s").String(), tid)
 	p := tu.Message(tu.ID(tb.recipientId), text)
@@ -94,17 +152,15 @@ func (tb *TelegramBot) sendMessage(tid int, text, unsubscribe, uid string) error
 		})
 	}
 	if len(buttons) > 0 {
+		rows = append([][]telego.InlineKeyboardButton{buttons}, rows...)
+	}
+	if len(rows) > 0 {
 		p.ReplyMarkup = &telego.InlineKeyboardMarkup{
-			InlineKeyboard: [][]telego.InlineKeyboardButton{
-				buttons,
-			},
+			InlineKeyboard: rows,
 		}
 	}
-	if _, err := tb.api.SendMessage(tb.ctx, p); err != nil {
-		return err
-	}
 
-	return nil
+	return tb.api.SendMessage(tb.ctx, p)
 }
 
 func (tb *TelegramBot) sendCode(tid int, d *ParsedEmailData) error {
@@ -140,14 +196,16 @@ func (tb *TelegramBot) sendSpamOrPhishing(d *ParsedEmailData) error {
 
 	log.Println(au.Gray(12, "[TELEGRAM]").String() + " " + au.Blue("Sending spam message").String())
 	m, uid := messageAndUid(d)
-	messages := telehtml.SplitTelegramHTML("🚫 <b>" + d.Subject + "\n\n" + d.From + "\n⤷ " + d.To + "</b>\n\n" + m)
+	messages := telehtml.SplitTelegramHTML("🚫 <b>" + d.Subject + "\n\n" + d.From + "\n⤷ " + d.To + "</b>" + authNotes(d) + "\n\n" + m)
 	for i, msg := range messages {
 		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Sending spam or phising message part %d/%d").String(), i+1, len(messages))
 		u, e := "", ""
+		var rows [][]telego.InlineKeyboardButton
 		if i == len(messages)-1 {
 			u, e = d.Unsubscrube, uid
+			rows = append(rows, sourceButtons(d.Uid))
 		}
-		if err := tb.sendMessage(0, msg+telehtml.EncodeIntInvisible(d.Uid), u, e); err != nil {
+		if err := tb.sendMessage(0, msg+telehtml.EncodeIntInvisible(d.Uid), u, e, rows...); err != nil {
 			return fmt.Errorf("failed to send code message with Telego: %w", err)
 		}
 	}
@@ -161,19 +219,36 @@ func (tb *TelegramBot) sendHumanOrNotificationOrUnknown(tid int, d *ParsedEmailD
 	m, uid := messageAndUid(d)
 	var messages []string
 	if !tb.isChat {
-		messages = telehtml.SplitTelegramHTML("✉️ <b>" + d.Subject + "\n\n" + d.From + "\n⤷ " + d.To + "</b>\n\n" + m)
+		messages = telehtml.SplitTelegramHTML("✉️ <b>" + d.Subject + "\n\n" + d.From + "\n⤷ " + d.To + "</b>" + authNotes(d) + "\n\n" + m)
 	} else {
-		messages = telehtml.SplitTelegramHTML("<b>" + d.From + "\n⤷ " + d.To + "</b>\n\n" + m)
+		messages = telehtml.SplitTelegramHTML("<b>" + d.From + "\n⤷ " + d.To + "</b>" + authNotes(d) + "\n\n" + m)
 	}
+	var earlier []mailPart
 	for i, msg := range messages {
 		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Sending message part %d/%d").String(), i+1, len(messages))
 		u, e := "", ""
+		var rows [][]telego.InlineKeyboardButton
 		if i == len(messages)-1 {
 			u, e = d.Unsubscrube, uid
+			if d.Type == TypeHuman {
+				rows = append(rows, []telego.InlineKeyboardButton{{
+					Text:         "✍️ DRAFT REPLY",
+					CallbackData: draftCallbackData(d),
+				}})
+			}
+			rows = append(rows, mailboxRows(d.Uid)...)
+			rows = append(rows, sourceButtons(d.Uid))
 		}
-		if err := tb.sendMessage(tid, msg+telehtml.EncodeIntInvisible(d.Uid), u, e); err != nil {
+		text := msg + telehtml.EncodeIntInvisible(d.Uid)
+		sent, err := tb.postMessage(tid, text, u, e, rows...)
+		if err != nil {
 			return fmt.Errorf("failed to send main part with Telego: %w", err)
 		}
+		if i == len(messages)-1 {
+			tb.trackMail(d.Uid, sent, text, earlier)
+		} else if sent != nil {
+			earlier = append(earlier, mailPart{Mid: sent.MessageID, Text: text})
+		}
 	}
 
 	return nil
@@ -184,17 +259,25 @@ func (tb *TelegramBot) sendExpand(tid int, d *ParsedEmailData) error {
 
 	var messages []string
 	if tid > 0 {
-		messages = telehtml.SplitTelegramHTML("<b>" + d.From + "\n⤷ " + d.To + "</b>\n\n" + d.TextBody)
+		messages = telehtml.SplitTelegramHTML("<b>" + d.From + "\n⤷ " + d.To + "</b>" + authNotes(d) + "\n\n" + d.TextBody)
 	} else {
-		messages = telehtml.SplitTelegramHTML("🧾 <b>" + d.Subject + "\n\n" + d.From + "\n⤷ " + d.To + "</b>\n\n" + d.TextBody)
+		messages = telehtml.SplitTelegramHTML("🧾 <b>" + d.Subject + "\n\n" + d.From + "\n⤷ " + d.To + "</b>" + authNotes(d) + "\n\n" + d.TextBody)
 	}
 	for i, msg := range messages {
 		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Sending message part %d/%d").String(), i+1, len(messages))
 		u := ""
+		var rows [][]telego.InlineKeyboardButton
 		if i == len(messages)-1 {
 			u = d.Unsubscrube
+			rows = append(rows, sourceButtons(d.Uid))
+			if tb.translate {
+				rows = append(rows, []telego.InlineKeyboardButton{{
+					Text:         "🌐 TRANSLATE",
+					CallbackData: fmt.Sprintf("translate:%d", d.Uid),
+				}})
+			}
 		}
-		if err := tb.sendMessage(tid, msg+telehtml.EncodeIntInvisible(d.Uid), u, ""); err != nil {
+		if err := tb.sendMessage(tid, msg+telehtml.EncodeIntInvisible(d.Uid), u, "", rows...); err != nil {
 			return fmt.Errorf("failed to send main part with Telego: %w", err)
 		}
 	}
@@ -203,29 +286,216 @@ func (tb *TelegramBot) sendExpand(tid int, d *ParsedEmailData) error {
 
 }
 
-func (tb *TelegramBot) sendAttachments(tid int, d *ParsedEmailData) error {
+// Notes and retry buttons of images that did not make it go into the same skipped list
+
+func (tb *TelegramBot) sendAttachments(tid int, d *ParsedEmailData, notes []string, retry [][]telego.InlineKeyboardButton) error {
+
+	if len(d.Attachments) == 0 && len(notes) == 0 {
+		return nil
+	}
+	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Cyan("Sending %d attachments").String(), len(d.Attachments))
+	names := d.AttachmentNames()
+
+	// On demand mode, only buttons
 
-	if len(d.Attachments) > 0 {
-		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Cyan("Sending %d attachments").String(), len(d.Attachments))
-		for fn, b := range d.Attachments {
-			if len(b) == 0 {
-				log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Yellow("Skipping empty attachment: %s").String(), fn)
+	if tb.onDemand {
+		for i, fn := range names {
+			b := d.Attachments[fn]
+			if len(b) > maxDocumentSize {
+				notes = append(notes, fmt.Sprintf("%s (%s) — skipped: too large", html.EscapeString(fn), formatSize(len(b))))
 				continue
 			}
-			f := tu.FileFromReader(bytes.NewReader(b), fn)
-			var p *telego.SendDocumentParams
-			if !tb.isChat {
-				p = tu.Document(tu.ID(tb.recipientId), f)
-			} else {
-				p = tu.Document(tu.ID(tb.recipientId), f).WithMessageThreadID(tid)
+			notes = append(notes, fmt.Sprintf("%s (%s)", html.EscapeString(fn), formatSize(len(b))))
+			retry = append(retry, attachmentButton(d.Uid, attachmentPart(d, names, i), fn))
+		}
+		return tb.sendMessage(tid, "📎 <b>ATTACHMENTS</b>\n\n"+strings.Join(notes, "\n"), "", "", retry...)
+	}
+
+	// Small files go into one zip if there are many of them
+
+	var small []string
+	if tb.zipFiles > 0 {
+		for _, fn := range names {
+			if n := len(d.Attachments[fn]); n > 0 && n <= zipFileSize {
+				small = append(small, fn)
+			}
+		}
+		if len(small) < tb.zipFiles {
+			small = nil
+		}
+	}
+	zipped := make(map[string]bool)
+	if len(small) > 0 {
+		archive, err := zipAttachments(d.Attachments, small)
+		if err != nil {
+			log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Yellow("Failed to zip attachments, sending them one by one: %v").String(), err)
+		} else if err := tb.sendDocument(tid, d.Uid, fmt.Sprintf("attachments-%d.zip", d.Uid), archive); err != nil {
+			log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Yellow("Failed to send zipped attachments, sending them one by one: %v").String(), err)
+		} else {
+			for _, fn := range small {
+				zipped[fn] = true
 			}
-			log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Sending attachment: %s (%d bytes)").String(), fn, len(b))
+		}
+	}
+
+	// Every file on its own, a failed upload does not stop the rest
+
+	for i, fn := range names {
+		b := d.Attachments[fn]
+		switch {
+		case zipped[fn]:
+			continue
+		case len(b) > maxDocumentSize:
+			notes = append(notes, fmt.Sprintf("%s (%s) — skipped: too large", html.EscapeString(fn), formatSize(len(b))))
+		default:
+			if err := tb.sendDocument(tid, d.Uid, fn, b); err != nil {
+				log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("%v").String(), err)
+				notes = append(notes, fmt.Sprintf("%s (%s) — upload failed", html.EscapeString(fn), formatSize(len(b))))
+				retry = append(retry, attachmentButton(d.Uid, attachmentPart(d, names, i), fn))
+			}
+		}
+	}
+	if len(notes) > 0 {
+		return tb.sendMessage(tid, "⚠️ <b>SKIPPED ATTACHMENTS</b>\n\n"+strings.Join(notes, "\n"), "", "", retry...)
+	}
+
+	return nil
+
+}
+
+func (tb *TelegramBot) sendDocument(tid int, uid int, fn string, b []byte) error {
+
+	if len(b) == 0 {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Yellow("Skipping empty attachment: %s").String(), fn)
+		return nil
+	}
+	if len(b) > maxDocumentSize {
+		return fmt.Errorf("attachment %s (email UID %d) is too large for Telegram: %s", fn, uid, formatSize(len(b)))
+	}
+	f := tu.FileFromReader(bytes.NewReader(b), fn)
+	var p *telego.SendDocumentParams
+	if !tb.isChat {
+		p = tu.Document(tu.ID(tb.recipientId), f)
+	} else {
+		p = tu.Document(tu.ID(tb.recipientId), f).WithMessageThreadID(tid)
+	}
+	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Sending attachment: %s (%d bytes)").String(), fn, len(b))
+	if _, err := tb.api.SendDocument(tb.ctx, p); err != nil {
+		target := "direct message"
+		if tb.isChat {
+			target = fmt.Sprintf("topic %d", tid)
+		}
+		return fmt.Errorf("failed to send attachment %s to %s (email UID %d) with Telego: %w", fn, target, uid, err)
+	}
+
+	return nil
+
+}
+
+// Images go as an album (up to 10 photos each), too large ones as documents. Returns
+// notes and retry buttons for the ones that could not be sent.
+
+func (tb *TelegramBot) sendImages(tid int, d *ParsedEmailData) ([]string, [][]telego.InlineKeyboardButton) {
+
+	var notes []string
+	var retry [][]telego.InlineKeyboardButton
+	sendFile := func(img EmailImage) {
+		if len(img.Content) > maxDocumentSize {
+			notes = append(notes, fmt.Sprintf("%s (%s) — skipped: too large", html.EscapeString(img.Name), formatSize(len(img.Content))))
+			return
+		}
+		if err := tb.sendDocument(tid, d.Uid, img.Name, img.Content); err != nil {
+			log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("%v").String(), err)
+			notes = append(notes, fmt.Sprintf("%s (%s) — upload failed", html.EscapeString(img.Name), formatSize(len(img.Content))))
+			if img.Part != "" {
+				retry = append(retry, attachmentButton(d.Uid, img.Part, img.Name))
+			}
+		}
+	}
+	var photos []EmailImage
+	for _, img := range d.Images {
+		if len(img.Content) > maxPhotoSize {
+			sendFile(img)
+			continue
+		}
+		if len(img.Content) > 0 {
+			photos = append(photos, img)
+		}
+	}
+	if len(photos) > 0 {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Cyan("Sending %d images").String(), len(photos))
+	}
+	for len(photos) > 0 {
+		n := min(len(photos), 10)
+		if err := tb.sendAlbum(tid, photos[:n]); err != nil {
+
+			// Telegram rejects some images as photos (dimensions, format), send as files
+
+			log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Yellow("Failed to send images as photos, sending as files: %v").String(), err)
+			for _, img := range photos[:n] {
+				sendFile(img)
+			}
+		}
+		photos = photos[n:]
+	}
+
+	return notes, retry
+
+}
+
+func (tb *TelegramBot) sendAlbum(tid int, photos []EmailImage) error {
+
+	if len(photos) == 1 {
+		p := tu.Photo(tu.ID(tb.recipientId), tu.FileFromBytes(photos[0].Content, "photo"))
+		p.MessageThreadID = tid
+		_, err := tb.api.SendPhoto(tb.ctx, p)
+		return err
+	}
+	var media []telego.InputMedia
+	for i, img := range photos {
+
+		// Files of an album are attached by name, so names must be unique
+
+		media = append(media, tu.MediaPhoto(tu.FileFromBytes(img.Content, fmt.Sprintf("photo%d", i))))
+	}
+	p := tu.MediaGroup(tu.ID(tb.recipientId), media...)
+	p.MessageThreadID = tid
+	_, err := tb.api.SendMediaGroup(tb.ctx, p)
+
+	return err
+}
+
+func (tb *TelegramBot) sendEvents(tid int, d *ParsedEmailData) error {
+
+	for i, ev := range d.Events {
+		card := eventCard(ev)
+		switch {
+		case ev.Method == "REQUEST" && ev.Organizer != "":
+
+			// Invitation card with iTIP reply buttons
+
+			if err := tb.sendMessage(tid, card, "", "", tu.InlineKeyboardRow(
+				telego.InlineKeyboardButton{Text: "✅ ACCEPT", CallbackData: fmt.Sprintf("rsvp:%d:%d:ACCEPTED", d.Uid, i)},
+				telego.InlineKeyboardButton{Text: "❔ MAYBE", CallbackData: fmt.Sprintf("rsvp:%d:%d:TENTATIVE", d.Uid, i)},
+				telego.InlineKeyboardButton{Text: "❌ DECLINE", CallbackData: fmt.Sprintf("rsvp:%d:%d:DECLINED", d.Uid, i)},
+			)); err != nil {
+				return fmt.Errorf("failed to send event card (email UID %d) with Telego: %w", d.Uid, err)
+			}
+		case ev.Method == "":
+
+			// Event found by AI in the text, offered as .ics file
+
+			fn := fmt.Sprintf("event-%d-%d.ics", d.Uid, i+1)
+			p := tu.Document(tu.ID(tb.recipientId), tu.FileFromReader(strings.NewReader(buildICSEvent(ev)), fn))
+			p.Caption = card
+			p.ParseMode = telego.ModeHTML
+			p.MessageThreadID = tid
 			if _, err := tb.api.SendDocument(tb.ctx, p); err != nil {
-				target := "direct message"
-				if tb.isChat {
-					target = fmt.Sprintf("topic %d", tid)
-				}
-				return fmt.Errorf("failed to send attachment %s to %s (email UID %d) with Telego: %w", fn, target, d.Uid, err)
+				return fmt.Errorf("failed to send event file %s (email UID %d) with Telego: %w", fn, d.Uid, err)
+			}
+		default:
+			if err := tb.sendMessage(tid, card, "", ""); err != nil {
+				return err
 			}
 		}
 	}
@@ -239,7 +509,129 @@ func (tb *TelegramBot) sendInstructions() {
 	tb.SendMessage("Hi! I'm your mail bot.")
 	tb.SendMessage("To reply to an email, just reply to the message and enter your text, and attach files if needed.")
 	tb.SendMessage("To send a new email, use the format:\n\nto.user@mail.example.com\nSubject line\nEmail text\n\nAttach files if needed.")
+	tb.SendMessage("To send from another identity, start with a line like:\n\nFrom: work")
+	tb.SendMessage("To archive, delete, move or mark an email, use the buttons under it or reply to it with /read, /unread, /star, /unstar, /archive, /delete or /move <folder>")
+	tb.SendMessage("To send a reply or a new email later, start it with a line like:\n\n/sendat 2026-10-20 09:00\nor\ntomorrow 9am\n\nSee and cancel pending ones with /scheduled")
+
+}
+
+func (tb *TelegramBot) editMessage(mid int, text string) {
+
+	p := tu.EditMessageText(tu.ID(tb.recipientId), mid, text)
+	p.ParseMode = telego.ModeHTML
+	p.LinkPreviewOptions = &telego.LinkPreviewOptions{IsDisabled: true}
+	if _, err := tb.api.EditMessageText(tb.ctx, p); err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error editing message %d: %v").String(), mid, err)
+	}
+
+}
+
+func (tb *TelegramBot) editReplyMarkup(mid int, markup *telego.InlineKeyboardMarkup) {
+
+	p := &telego.EditMessageReplyMarkupParams{ChatID: tu.ID(tb.recipientId), MessageID: mid, ReplyMarkup: markup}
+	if _, err := tb.api.EditMessageReplyMarkup(tb.ctx, p); err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error editing buttons of message %d: %v").String(), mid, err)
+	}
+
+}
+
+func (tb *TelegramBot) answerCallbackQuery(id string, text string) {
+
+	p := tu.CallbackQuery(id)
+	p.Text = text
+	if err := tb.api.AnswerCallbackQuery(tb.ctx, p); err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error answering callback query: %v").String(), err)
+	}
+
+}
+
+func sourceButtons(uid int) []telego.InlineKeyboardButton {
+
+	return tu.InlineKeyboardRow(
+		telego.InlineKeyboardButton{Text: "📎 EML", CallbackData: fmt.Sprintf("eml:%d", uid)},
+		telego.InlineKeyboardButton{Text: "🔍 HEADERS", CallbackData: fmt.Sprintf("headers:%d", uid)},
+	)
+}
+
+func attachmentButton(uid int, part string, name string) []telego.InlineKeyboardButton {
+
+	return tu.InlineKeyboardRow(telego.InlineKeyboardButton{
+		Text:         "⬇️ GET " + name,
+		CallbackData: fmt.Sprintf("part:%d:%s", uid, part),
+	})
+}
+
+// Part id of an attachment, its index when the email parts could not be numbered
+
+func attachmentPart(d *ParsedEmailData, names []string, i int) string {
+
+	if part := d.Parts[names[i]]; part != "" {
+		return part
+	}
+
+	return fmt.Sprintf("@%d", i)
+}
+
+func zipAttachments(files map[string][]byte, names []string) ([]byte, error) {
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, fn := range names {
+		w, err := zw.Create(fn)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(files[fn]); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func formatSize(n int) string {
+
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.0f KB", float64(n)/(1<<10))
+	}
+
+	return fmt.Sprintf("%d B", n)
+}
+
+func draftCallbackData(d *ParsedEmailData) string {
+
+	// Telegram limits callback data to 64 bytes
+
+	data := fmt.Sprintf("draft:%d", d.Uid)
+	if d.Language != "" && len(data)+1+len(d.Language) <= 64 {
+		data += ":" + d.Language
+	}
+
+	return data
+}
+
+// Authenticity badge and spoofing warning under the sender line
+
+func authNotes(d *ParsedEmailData) string {
+
+	var notes string
+	if badge := d.Auth.Badge(); badge != "" {
+		notes += "\n" + badge
+	}
+	if d.Spoofing != "" {
+		notes += "\n" + d.Spoofing
+	}
+	if badge := d.Crypto.Badge(); badge != "" {
+		notes += "\n" + badge
+	}
 
+	return notes
 }
 
 func messageAndUid(d *ParsedEmailData) (string, string) {
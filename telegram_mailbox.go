@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+const maxFolderButtons = 40
+
+// Mailbox buttons under an email, labels assume a new unread and unflagged email
+
+func mailboxRows(uid int) [][]telego.InlineKeyboardButton {
+
+	return [][]telego.InlineKeyboardButton{
+		tu.InlineKeyboardRow(
+			seenButton(uid, false),
+			flagButton(uid, false),
+			telego.InlineKeyboardButton{Text: "⏰ SNOOZE", CallbackData: fmt.Sprintf("snooze:%d", uid)},
+		),
+		tu.InlineKeyboardRow(
+			telego.InlineKeyboardButton{Text: "🗄 ARCHIVE", CallbackData: fmt.Sprintf("archive:%d", uid)},
+			telego.InlineKeyboardButton{Text: "🗑 DELETE", CallbackData: fmt.Sprintf("trash:%d", uid)},
+			telego.InlineKeyboardButton{Text: "📁 MOVE", CallbackData: fmt.Sprintf("move:%d", uid)},
+		),
+	}
+}
+
+// Buttons name the state they set and carry it, a press never flips a state the label does not show
+
+func seenButton(uid int, seen bool) telego.InlineKeyboardButton {
+
+	if seen {
+		return telego.InlineKeyboardButton{Text: "📩 UNREAD", CallbackData: fmt.Sprintf("unread:%d", uid)}
+	}
+
+	return telego.InlineKeyboardButton{Text: "✓ READ", CallbackData: fmt.Sprintf("read:%d", uid)}
+}
+
+func flagButton(uid int, flagged bool) telego.InlineKeyboardButton {
+
+	if flagged {
+		return telego.InlineKeyboardButton{Text: "☆ UNSTAR", CallbackData: fmt.Sprintf("unstar:%d", uid)}
+	}
+
+	return telego.InlineKeyboardButton{Text: "⭐ STAR", CallbackData: fmt.Sprintf("star:%d", uid)}
+}
+
+func (tb *TelegramBot) handleMailboxAction(msg *telego.Message, action string, arg string, callbacks TelegramCallbacks) {
+
+	uidStr, target, _ := strings.Cut(arg, ":")
+	uid, err := tb.callbackUid(uidStr)
+	if err != nil {
+		return
+	}
+	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Processing %s of message UID %d").String(), action, uid)
+
+	switch action {
+	case "read", "unread", "star", "unstar":
+		on, _, err := callbacks.Mailbox(uid, action, "")
+		if err != nil {
+			tb.sendMessage(msg.MessageThreadID, "Failed to change the email: "+html.EscapeString(err.Error()), "", "")
+			return
+		}
+		button, mid := seenButton(uid, on), 0
+		if action == "star" || action == "unstar" {
+			button, mid = flagButton(uid, on), tb.SetMailFlagged(uid, on)
+		} else {
+			mid = tb.SetMailSeen(uid, on)
+		}
+		if mid != msg.MessageID {
+			tb.setButton(msg, action+":"+uidStr, button)
+		}
+	case "archive", "trash":
+		_, folder, err := callbacks.Mailbox(uid, action, "")
+		if err != nil {
+			tb.sendMessage(msg.MessageThreadID, "Failed to move the email: "+html.EscapeString(err.Error()), "", "")
+			return
+		}
+		status := "🗄 ARCHIVED"
+		if action == "trash" {
+			status = "🗑 DELETED"
+		}
+		tb.markMoved(msg, status+" TO "+strings.ToUpper(folder))
+		tb.markMailMoved(uid, msg.MessageID, status+" TO "+strings.ToUpper(folder))
+	case "move":
+		tb.showFolderPicker(msg.MessageThreadID, msg.MessageID, uid, callbacks)
+	case "moveto", "movetoh":
+		folders, err := callbacks.Folders()
+		folder := ""
+		for _, f := range folders {
+			if f == target && action == "moveto" || folderHash(f) == target && action == "movetoh" {
+				folder = f
+			}
+		}
+		if err != nil || folder == "" {
+			tb.editMessage(msg.MessageID, "❌ <b>FOLDER NOT FOUND</b>")
+			return
+		}
+		if _, _, err := callbacks.Mailbox(uid, "moveto", folder); err != nil {
+			tb.editMessage(msg.MessageID, "❌ <b>FAILED TO MOVE</b>\n\n"+html.EscapeString(err.Error()))
+			return
+		}
+		tb.editMessage(msg.MessageID, "📁 <b>MOVED TO "+html.EscapeString(strings.ToUpper(folder))+"</b>")
+		shown := 0
+		if msg.ReplyToMessage != nil && msg.ReplyToMessage.ReplyMarkup != nil {
+			shown = msg.ReplyToMessage.MessageID
+			tb.markMoved(msg.ReplyToMessage, "📁 MOVED TO "+strings.ToUpper(folder))
+		}
+		tb.markMailMoved(uid, shown, "📁 MOVED TO "+strings.ToUpper(folder))
+	}
+
+}
+
+// Folder keyboard replying to the email message, buttons carry the folder name
+
+func (tb *TelegramBot) showFolderPicker(tid int, mid int, uid int, callbacks TelegramCallbacks) {
+
+	folders, err := callbacks.Folders()
+	if err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error listing folders: %v").String(), err)
+		tb.sendMessage(tid, "Failed to list folders!", "", "")
+		return
+	}
+	var rows [][]telego.InlineKeyboardButton
+	for i, f := range folders {
+		if i == maxFolderButtons {
+			break
+		}
+		b := telego.InlineKeyboardButton{Text: f, CallbackData: folderCallback(uid, f)}
+		if i%2 == 0 {
+			rows = append(rows, tu.InlineKeyboardRow(b))
+		} else {
+			rows[len(rows)-1] = append(rows[len(rows)-1], b)
+		}
+	}
+	rows = append(rows, tu.InlineKeyboardRow(telego.InlineKeyboardButton{Text: "✖️ CLOSE", CallbackData: "close"}))
+	m := tu.Message(tu.ID(tb.recipientId), "📁 <b>MOVE TO…</b>")
+	m.ParseMode = telego.ModeHTML
+	m.MessageThreadID = tid
+	m.ReplyParameters = &telego.ReplyParameters{MessageID: mid, AllowSendingWithoutReply: true}
+	m.ReplyMarkup = tu.InlineKeyboard(rows...)
+	if _, err := tb.api.SendMessage(tb.ctx, m); err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error sending folder list: %v").String(), err)
+	}
+
+}
+
+// Telegram limits callback data to 64 bytes, longer folder names go as a hash of the name
+
+func folderCallback(uid int, folder string) string {
+
+	if data := fmt.Sprintf("moveto:%d:%s", uid, folder); len(data) <= 64 {
+		return data
+	}
+
+	return fmt.Sprintf("movetoh:%d:%s", uid, folderHash(folder))
+}
+
+func folderHash(folder string) string {
+
+	sum := sha256.Sum256([]byte(folder))
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// Commands replying to an email or sent in its topic: /read, /unread, /star, /unstar,
+// /archive, /delete and /move [folder]
+
+func (tb *TelegramBot) handleMailboxCommand(msg *telego.Message, command string, arg string, callbacks TelegramCallbacks) {
+
+	uid := tb.messageUid(msg)
+	if uid == 0 {
+		tb.sendMessage(msg.MessageThreadID, "Reply to an email with "+command+".", "", "")
+		return
+	}
+	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Processing %s of message UID %d").String(), command, uid)
+	action := map[string]string{
+		"/read":    "read",
+		"/unread":  "unread",
+		"/star":    "star",
+		"/unstar":  "unstar",
+		"/archive": "archive",
+		"/delete":  "trash",
+		"/move":    "moveto",
+	}[command]
+
+	// Folder by name, the keyboard without one
+
+	var folder string
+	if action == "moveto" {
+		if arg == "" {
+			mid := msg.MessageID
+			if msg.ReplyToMessage != nil && msg.ReplyToMessage.MessageID != msg.MessageThreadID {
+				mid = msg.ReplyToMessage.MessageID
+			}
+			tb.showFolderPicker(msg.MessageThreadID, mid, uid, callbacks)
+			return
+		}
+		folders, err := callbacks.Folders()
+		if err != nil {
+			tb.sendMessage(msg.MessageThreadID, "Failed to list folders!", "", "")
+			return
+		}
+		for _, f := range folders {
+			if f == arg || folder == "" && strings.EqualFold(f, arg) {
+				folder = f
+			}
+		}
+		if folder == "" {
+			tb.sendMessage(msg.MessageThreadID, "No folder "+html.EscapeString(arg)+", folders: "+html.EscapeString(strings.Join(folders, ", ")), "", "")
+			return
+		}
+	}
+
+	on, moved, err := callbacks.Mailbox(uid, action, folder)
+	if err != nil {
+		tb.sendMessage(msg.MessageThreadID, "Failed to change the email: "+html.EscapeString(err.Error()), "", "")
+		return
+	}
+	switch action {
+	case "read", "unread":
+		tb.SetMailSeen(uid, on)
+	case "star", "unstar":
+		tb.SetMailFlagged(uid, on)
+	default:
+		tb.markMailMoved(uid, 0, "📁 MOVED TO "+strings.ToUpper(moved))
+	}
+	status := map[string]string{
+		"read":    "✓ Marked as read",
+		"unread":  "📩 Marked as unread",
+		"star":    "⭐ Starred",
+		"unstar":  "☆ Unstarred",
+		"archive": "🗄 Archived to " + html.EscapeString(moved),
+		"trash":   "🗑 Moved to " + html.EscapeString(moved),
+		"moveto":  "📁 Moved to " + html.EscapeString(moved),
+	}[action]
+	tb.sendMessage(msg.MessageThreadID, status, "", "")
+
+}
+
+// Buttons of a message, with the one with this callback data replaced
+
+func (tb *TelegramBot) setButton(m *telego.Message, data string, b telego.InlineKeyboardButton) {
+
+	if m.ReplyMarkup == nil {
+		return
+	}
+	var rows [][]telego.InlineKeyboardButton
+	for _, row := range m.ReplyMarkup.InlineKeyboard {
+		r := append([]telego.InlineKeyboardButton(nil), row...)
+		for i := range r {
+			if r[i].CallbackData == data {
+				r[i] = b
+			}
+		}
+		rows = append(rows, r)
+	}
+	tb.editReplyMarkup(m.MessageID, tu.InlineKeyboard(rows...))
+
+}
+
+// The email left INBOX and its UID, only link buttons stay next to the status
+
+func (tb *TelegramBot) markMoved(m *telego.Message, status string) {
+
+	var rows [][]telego.InlineKeyboardButton
+	if m.ReplyMarkup != nil {
+		for _, row := range m.ReplyMarkup.InlineKeyboard {
+			var r []telego.InlineKeyboardButton
+			for _, b := range row {
+				if b.URL != "" {
+					r = append(r, b)
+				}
+			}
+			if len(r) > 0 {
+				rows = append(rows, r)
+			}
+		}
+	}
+	rows = append(rows, tu.InlineKeyboardRow(telego.InlineKeyboardButton{Text: status, CallbackData: "noop"}))
+	tb.editReplyMarkup(m.MessageID, tu.InlineKeyboard(rows...))
+
+}
+
+// The message showing the email, when it is not the one just marked, gets the status too
+
+func (tb *TelegramBot) markMailMoved(uid int, shown int, status string) {
+
+	if m := tb.trackedMessage(uid); m != nil && m.MessageID != shown {
+		tb.markMoved(m, status)
+	}
+	tb.ForgetMail(uid)
+
+}
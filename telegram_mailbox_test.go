@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFolderCallback(t *testing.T) {
+
+	if got := folderCallback(42, "Work:Projects"); got != "moveto:42:Work:Projects" {
+		t.Errorf("folderCallback(short) = %q", got)
+	}
+	long := "Clients/" + strings.Repeat("Очень длинное имя ", 4)
+	got := folderCallback(42, long)
+	if len(got) > 64 || got != "movetoh:42:"+folderHash(long) {
+		t.Errorf("folderCallback(long) = %q, %d bytes", got, len(got))
+	}
+	if folderHash(long) == folderHash(long+"2") {
+		t.Error("different folders have the same hash")
+	}
+
+}
+
+func TestMailboxButtons(t *testing.T) {
+
+	tests := []struct {
+		got  string
+		want string
+	}{
+		{seenButton(7, false).CallbackData, "read:7"},
+		{seenButton(7, true).CallbackData, "unread:7"},
+		{flagButton(7, false).CallbackData, "star:7"},
+		{flagButton(7, true).CallbackData, "unstar:7"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("button data = %q, want %q", tt.got, tt.want)
+		}
+	}
+
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// Title of a sent draft, the email is only queued while it can be undone
+
+func (tb *TelegramBot) sentLabel(what string) string {
+
+	if tb.undoSend {
+		return "⏳ <b>" + what + " QUEUED</b>"
+	}
+
+	return "📤 <b>" + what + " SENT</b>"
+}
+
+// Confirmation of a queued email with the UNDO button, edited once the email is sent
+
+func (tb *TelegramBot) ShowQueued(tid int, id string, out *OutgoingEmail, delay time.Duration) (int, error) {
+
+	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Cyan("Showing undo for queued email %s").String(), id)
+	if tb.api == nil {
+		return 0, errors.New("telego API is not initialized in ShowQueued")
+	}
+	if tb.ctx == nil {
+		tb.ctx = context.Background()
+	}
+	text := fmt.Sprintf("⏳ <b>SENDING IN %d SEC</b>\n\n<b>To:</b> %s\n<b>Subject:</b> %s",
+		int(delay.Seconds()), html.EscapeString(strings.Join(out.To, ", ")), html.EscapeString(out.Subject))
+	m := tu.Message(tu.ID(tb.recipientId), text)
+	m.ParseMode = telego.ModeHTML
+	m.MessageThreadID = tid
+	m.ReplyMarkup = tu.InlineKeyboard(tu.InlineKeyboardRow(
+		telego.InlineKeyboardButton{Text: "↩️ UNDO", CallbackData: "undo:" + id},
+	))
+	sent, err := tb.api.SendMessage(tb.ctx, m)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send undo message with Telego: %w", err)
+	}
+
+	return sent.MessageID, nil
+}
+
+func (tb *TelegramBot) ShowSent(mid int, out *OutgoingEmail, err error) {
+
+	if mid == 0 {
+		return
+	}
+	to := html.EscapeString(strings.Join(out.To, ", "))
+	if err != nil {
+		tb.editMessage(mid, "❌ <b>FAILED TO SEND EMAIL</b>\n\n<b>To:</b> "+to+"\n<b>Subject:</b> "+html.EscapeString(out.Subject)+
+			"\n"+html.EscapeString(err.Error())+"\n\n<blockquote expandable>"+previewText(out.Text)+"</blockquote>")
+		return
+	}
+	tb.editMessage(mid, "📤 <b>EMAIL SENT</b>\n\n<b>To:</b> "+to+"\n<b>Subject:</b> "+html.EscapeString(out.Subject))
+
+}
+
+// The text is kept in the message so it can be copied and sent again
+
+func (tb *TelegramBot) ShowUndone(mid int, out *OutgoingEmail) {
+
+	tb.editMessage(mid, "↩️ <b>SENDING CANCELLED</b>\n\n<b>To:</b> "+html.EscapeString(strings.Join(out.To, ", "))+
+		"\n<b>Subject:</b> "+html.EscapeString(out.Subject)+"\n\n<blockquote expandable>"+previewText(out.Text)+"</blockquote>")
+
+}
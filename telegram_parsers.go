@@ -4,12 +4,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"html"
 	"log"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 	"unicode"
+	"unicode/utf16"
 
 	"github.com/mymmrac/telego"
 )
@@ -62,6 +66,57 @@ func (tb *TelegramBot) getFileURL(fileID string) (string, error) {
 
 }
 
+// File links expire after an hour, the file id behind each link is kept so an email
+// sent later can get new ones
+
+const maxFileIDs = 500
+
+func (tb *TelegramBot) rememberFileID(url string, fileID string) {
+
+	tb.fileIDsMu.Lock()
+	defer tb.fileIDsMu.Unlock()
+	if tb.fileIDs == nil || len(tb.fileIDs) >= maxFileIDs {
+		tb.fileIDs = make(map[string]string)
+	}
+	tb.fileIDs[url] = fileID
+
+}
+
+// File ids of the links found in a text, by link
+
+func (tb *TelegramBot) FileIDs(text string) map[string]string {
+
+	tb.fileIDsMu.Lock()
+	defer tb.fileIDsMu.Unlock()
+	ids := make(map[string]string)
+	for url, id := range tb.fileIDs {
+		if strings.Contains(text, url) {
+			ids[url] = id
+		}
+	}
+
+	return ids
+}
+
+// New links for the files, by old link, links that did not change are left out
+
+func (tb *TelegramBot) FreshFileURLs(ids map[string]string) map[string]string {
+
+	fresh := make(map[string]string)
+	for old, id := range ids {
+		url, err := tb.getFileURL(id)
+		if err != nil {
+			log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Yellow("Failed to refresh file link %s: %v").String(), id, err)
+			continue
+		}
+		if url != old {
+			fresh[old] = url
+		}
+	}
+
+	return fresh
+}
+
 func (tb *TelegramBot) getAllFileURLs(msg *telego.Message) []struct{ Url, Name string } {
 
 	log.Println(au.Gray(12, "[TELEGRAM]").String() + " " + au.Cyan("Processing attachments...").String())
@@ -82,6 +137,7 @@ func (tb *TelegramBot) getAllFileURLs(msg *telego.Message) []struct{ Url, Name s
 			return
 		}
 		files = append(files, struct{ Url, Name string }{url, fileName})
+		tb.rememberFileID(url, fileID)
 		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Green("Added %s: %s").String(), fileType, fileName)
 	}
 
@@ -128,16 +184,120 @@ func (tb *TelegramBot) getAllFileURLs(msg *telego.Message) []struct{ Url, Name s
 func extractTextFromMessages(msgs []*telego.Message) string {
 
 	for _, m := range msgs {
-		if m.Text != "" {
-			return m.Text
+		if text := messageHTML(m); text != "" {
+			return text
+		}
+	}
+
+	return ""
+
+}
+
+// Text or caption of a message with its formatting as Telegram HTML
+
+func messageHTML(m *telego.Message) string {
+
+	if m.Text != "" {
+		return entitiesToHTML(m.Text, m.Entities)
+	}
+
+	return entitiesToHTML(m.Caption, m.CaptionEntities)
+}
+
+// Entity offsets count UTF-16 code units, entities are nested, never overlapping
+
+func entitiesToHTML(text string, entities []telego.MessageEntity) string {
+
+	units := utf16.Encode([]rune(text))
+	sorted := make([]telego.MessageEntity, 0, len(entities))
+	for _, e := range entities {
+		if entityTags(e) != "" && e.Length > 0 {
+			sorted = append(sorted, e)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Offset != sorted[j].Offset {
+			return sorted[i].Offset < sorted[j].Offset
+		}
+		return sorted[i].Length > sorted[j].Length
+	})
+
+	var out strings.Builder
+	var open []telego.MessageEntity
+	next, last := 0, 0
+	for pos := 0; pos <= len(units); pos++ {
+		closing := len(open) > 0 && open[len(open)-1].Offset+open[len(open)-1].Length <= pos
+		opening := next < len(sorted) && sorted[next].Offset <= pos
+		if !closing && !opening {
+			continue
 		}
-		if m.Caption != "" {
-			return m.Caption
+		out.WriteString(html.EscapeString(string(utf16.Decode(units[last:pos]))))
+		last = pos
+		for len(open) > 0 && open[len(open)-1].Offset+open[len(open)-1].Length <= pos {
+			_, end, _ := strings.Cut(entityTags(open[len(open)-1]), "|")
+			out.WriteString(end)
+			open = open[:len(open)-1]
 		}
+		for next < len(sorted) && sorted[next].Offset <= pos {
+			start, _, _ := strings.Cut(entityTags(sorted[next]), "|")
+			out.WriteString(start)
+			open = append(open, sorted[next])
+			next++
+		}
+	}
+	out.WriteString(html.EscapeString(string(utf16.Decode(units[last:]))))
+	for i := len(open) - 1; i >= 0; i-- {
+		_, end, _ := strings.Cut(entityTags(open[i]), "|")
+		out.WriteString(end)
+	}
+
+	return out.String()
+}
+
+// Opening and closing tag separated by |, empty for entities shown as plain text
+
+func entityTags(e telego.MessageEntity) string {
+
+	switch e.Type {
+	case telego.EntityTypeBold:
+		return "<b>|</b>"
+	case telego.EntityTypeItalic:
+		return "<i>|</i>"
+	case telego.EntityTypeUnderline:
+		return "<u>|</u>"
+	case telego.EntityTypeStrikethrough:
+		return "<s>|</s>"
+	case telego.EntityTypeSpoiler:
+		return "<tg-spoiler>|</tg-spoiler>"
+	case telego.EntityTypeCode:
+		return "<code>|</code>"
+	case telego.EntityTypePre:
+		if e.Language != "" {
+			return `<pre><code class="language-` + html.EscapeString(e.Language) + `">|</code></pre>`
+		}
+		return "<pre>|</pre>"
+	case telego.EntityTypeTextLink:
+		return `<a href="` + html.EscapeString(e.URL) + `">|</a>`
+	case telego.EntityTypeBlockquote:
+		return "<blockquote>|</blockquote>"
+	case telego.EntityTypeExpandableBlockquote:
+		return "<blockquote expandable>|</blockquote>"
 	}
 
 	return ""
+}
+
+// Optional "From: <identity or alias>" line before the recipient
 
+func parseFromLine(msgText string) (from, rest string) {
+
+	first, rest, found := strings.Cut(msgText, "\n")
+	key, value, isFrom := strings.Cut(stripMarkup(first), ":")
+	if !found || !isFrom || !strings.EqualFold(strings.TrimSpace(key), "from") {
+		return "", msgText
+	}
+
+	return strings.TrimSpace(value), rest
 }
 
 func parseMailContent(msgText string) (to, title, body string, ok bool) {
@@ -146,7 +306,7 @@ func parseMailContent(msgText string) (to, title, body string, ok bool) {
 	if firstNL == -1 {
 		return
 	}
-	to = strings.TrimSpace(msgText[:firstNL])
+	to = strings.TrimSpace(stripMarkup(msgText[:firstNL]))
 	if !strings.Contains(to, "@") {
 		return
 	}
@@ -155,7 +315,7 @@ func parseMailContent(msgText string) (to, title, body string, ok bool) {
 	if secondNL == -1 {
 		return
 	}
-	title = strings.TrimSpace(rest[:secondNL])
+	title = strings.TrimSpace(stripMarkup(rest[:secondNL]))
 	if len(title) == 0 {
 		return
 	}
@@ -217,3 +377,157 @@ type albumEntry struct {
 
 var albumBuffer = make(map[string]*albumEntry)
 var albumLock sync.Mutex
+
+// Send times: "2026-10-17 09:00", "in 2 hours", "tomorrow 9am", "friday at 18:00", "tonight".
+// Loose also accepts a bare clock or day, as after /sendat.
+
+var (
+	reWhenClock    = regexp.MustCompile(`^(\d{1,2})(?::(\d{2}))?\s*(am|pm)?$`)
+	reWhenRelative = regexp.MustCompile(`^in (\d+)\s*(m|min|mins|minutes?|h|hrs?|hours?|d|days?|w|weeks?)$`)
+	whenLayouts    = []string{"2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02 15:04:05", "02.01.2006 15:04"}
+)
+
+func parseWhen(s string, now time.Time, loose bool) (time.Time, bool) {
+
+	s = strings.ToLower(strings.Join(strings.Fields(s), " "))
+	if s == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range whenLayouts {
+		if t, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			return t, true
+		}
+	}
+	if m := reWhenRelative.FindStringSubmatch(s); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		unit := time.Minute
+		switch m[2][0] {
+		case 'h':
+			unit = time.Hour
+		case 'd':
+			unit = 24 * time.Hour
+		case 'w':
+			unit = 7 * 24 * time.Hour
+		}
+		return now.Add(time.Duration(n) * unit), true
+	}
+
+	// Day word, then an optional clock
+
+	date, hour, rest, found := whenDay(s, now)
+	rest = strings.TrimSpace(strings.TrimPrefix(rest, "at "))
+	if !found && !loose {
+		return time.Time{}, false
+	}
+	if rest == "" {
+		if !found || !loose {
+			return time.Time{}, false
+		}
+		return date.Add(time.Duration(hour) * time.Hour), true
+	}
+	m := reWhenClock.FindStringSubmatch(rest)
+	if m == nil {
+		if d, err := time.ParseInLocation("2006-01-02", rest, now.Location()); err == nil && loose && !found {
+			return d.Add(9 * time.Hour), true
+		}
+		return time.Time{}, false
+	}
+	h, _ := strconv.Atoi(m[1])
+	minute, _ := strconv.Atoi(m[2])
+	switch {
+	case m[3] == "" && h > 23, m[3] != "" && (h < 1 || h > 12), minute > 59:
+		return time.Time{}, false
+	case m[3] == "am" && h == 12:
+		h = 0
+	case m[3] == "pm" && h < 12:
+		h += 12
+	}
+	t := date.Add(time.Duration(h)*time.Hour + time.Duration(minute)*time.Minute)
+	if !found && !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+
+	return t, true
+}
+
+// Midnight of the day a time phrase starts with, the default hour and the rest of it
+
+func whenDay(s string, now time.Time) (date time.Time, hour int, rest string, found bool) {
+
+	date = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch {
+	case strings.HasPrefix(s, "today"):
+		return date, 9, strings.TrimSpace(s[len("today"):]), true
+	case strings.HasPrefix(s, "tonight"):
+		return date, 20, strings.TrimSpace(s[len("tonight"):]), true
+	case strings.HasPrefix(s, "tomorrow"):
+		return date.AddDate(0, 0, 1), 9, strings.TrimSpace(s[len("tomorrow"):]), true
+	case strings.HasPrefix(s, "next week"):
+		days := (8 - int(date.Weekday())) % 7
+		if days == 0 {
+			days = 7
+		}
+		return date.AddDate(0, 0, days), 9, strings.TrimSpace(s[len("next week"):]), true
+	}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		if strings.HasPrefix(s, name) {
+			days := (int(d) - int(date.Weekday()) + 7) % 7
+			if days == 0 {
+				days = 7
+			}
+			return date.AddDate(0, 0, days), 9, strings.TrimSpace(s[len(name):]), true
+		}
+	}
+
+	return date, 9, s, false
+}
+
+// Send time line above a reply or a new email, "/sendat <time>" or a time phrase alone
+
+func cutSendAtLine(msgText string) (line, rest string) {
+
+	first, rest, found := strings.Cut(msgText, "\n")
+	plain := strings.TrimSpace(stripMarkup(first))
+	if !found {
+		return "", msgText
+	}
+	if strings.HasPrefix(strings.ToLower(plain), "/sendat") {
+		return plain, rest
+	}
+	if _, ok := parseWhen(plain, time.Now(), false); ok {
+		return plain, rest
+	}
+
+	return "", msgText
+}
+
+func withSendAtLine(line string, body string) string {
+
+	if line == "" {
+		return body
+	}
+
+	return html.EscapeString(line) + "\n" + body
+}
+
+func parseSendAt(msgText string, now time.Time) (time.Time, string, error) {
+
+	line, rest := cutSendAtLine(msgText)
+	if line == "" {
+		return time.Time{}, msgText, nil
+	}
+	when, loose := line, false
+	if strings.HasPrefix(strings.ToLower(line), "/sendat") {
+		when, loose = strings.TrimSpace(line[len("/sendat"):]), true
+	}
+	at, ok := parseWhen(when, now, loose)
+	if !ok {
+		return time.Time{}, rest, fmt.Errorf("unknown send time %q", when)
+	}
+	if !at.After(now) {
+		return time.Time{}, rest, fmt.Errorf("send time %s is in the past", at.Format("2006-01-02 15:04"))
+	}
+
+	return at, rest, nil
+}
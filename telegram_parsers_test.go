@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mymmrac/telego"
+)
+
+func TestEntitiesToHTML(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		text     string
+		entities []telego.MessageEntity
+		want     string
+	}{
+		{"none", "a < b & c", nil, "a &lt; b &amp; c"},
+		{"after emoji", "Hi 👋 bold", []telego.MessageEntity{{Type: telego.EntityTypeBold, Offset: 6, Length: 4}}, "Hi 👋 <b>bold</b>"},
+		{"emoji inside", "x 👍🏽 y", []telego.MessageEntity{{Type: telego.EntityTypeItalic, Offset: 2, Length: 4}}, "x <i>👍🏽</i> y"},
+		{"cyrillic link", "Привет, мир", []telego.MessageEntity{{Type: telego.EntityTypeTextLink, Offset: 8, Length: 3, URL: "https://x.io/?a=1&b=2"}}, `Привет, <a href="https://x.io/?a=1&amp;b=2">мир</a>`},
+		{"nested", "bold italic", []telego.MessageEntity{
+			{Type: telego.EntityTypeItalic, Offset: 5, Length: 6},
+			{Type: telego.EntityTypeBold, Offset: 0, Length: 11},
+		}, "<b>bold <i>italic</i></b>"},
+		{"same start", "ab", []telego.MessageEntity{
+			{Type: telego.EntityTypeItalic, Offset: 0, Length: 1},
+			{Type: telego.EntityTypeBold, Offset: 0, Length: 2},
+		}, "<b><i>a</i>b</b>"},
+		{"past the end", "🎉 end", []telego.MessageEntity{{Type: telego.EntityTypeUnderline, Offset: 3, Length: 10}}, "🎉 <u>end</u>"},
+		{"plain entities", "@bob #tag", []telego.MessageEntity{{Type: telego.EntityTypeMention, Offset: 0, Length: 4}}, "@bob #tag"},
+		{"pre", "code", []telego.MessageEntity{{Type: telego.EntityTypePre, Offset: 0, Length: 4, Language: "go"}}, `<pre><code class="language-go">code</code></pre>`},
+	}
+	for _, tt := range tests {
+		if got := entitiesToHTML(tt.text, tt.entities); got != tt.want {
+			t.Errorf("%s: entitiesToHTML = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+}
+
+func TestParseWhen(t *testing.T) {
+
+	now := time.Date(2026, 10, 14, 10, 30, 0, 0, time.UTC) // Wednesday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 10, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		in    string
+		loose bool
+		want  time.Time
+		ok    bool
+	}{
+		{"2026-10-17 09:00", false, at(17, 9, 0), true},
+		{"17.10.2026 09:00", false, at(17, 9, 0), true},
+		{"in 2 hours", false, at(14, 12, 30), true},
+		{"in 90 min", false, at(14, 12, 0), true},
+		{"In  3 days", false, at(17, 10, 30), true},
+		{"tomorrow 9am", false, at(15, 9, 0), true},
+		{"tomorrow at 12am", false, at(15, 0, 0), true},
+		{"today 12pm", false, at(14, 12, 0), true},
+		{"friday at 18:00", false, at(16, 18, 0), true},
+		{"wednesday 9:00", false, at(21, 9, 0), true},
+		{"next week 8:15", false, at(19, 8, 15), true},
+		{"tonight", false, time.Time{}, false},
+		{"tonight", true, at(14, 20, 0), true},
+		{"9:00", false, time.Time{}, false},
+		{"9:00", true, at(15, 9, 0), true},
+		{"15:00", true, at(14, 15, 0), true},
+		{"2026-10-20", true, at(20, 9, 0), true},
+		{"tomorrow 25:00", false, time.Time{}, false},
+		{"tomorrow 13pm", false, time.Time{}, false},
+		{"tomorrow 9:75", false, time.Time{}, false},
+		{"hello there", true, time.Time{}, false},
+		{"", true, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseWhen(tt.in, now, tt.loose)
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("parseWhen(%q, loose %v) = %s, %v, want %s, %v", tt.in, tt.loose, got, ok, tt.want, tt.ok)
+		}
+	}
+
+}
+
+func TestCutSendAtLine(t *testing.T) {
+
+	tests := []struct {
+		in   string
+		line string
+		rest string
+	}{
+		{"/sendat tomorrow\nbob@example.com\nHi", "/sendat tomorrow", "bob@example.com\nHi"},
+		{"/SendAt 9:00\nHi", "/SendAt 9:00", "Hi"},
+		{"<b>in 2 hours</b>\nHi", "in 2 hours", "Hi"},
+		{"tomorrow 9am", "", "tomorrow 9am"},
+		{"Tomorrow\nsee you", "", "Tomorrow\nsee you"},
+		{"Hello\nworld", "", "Hello\nworld"},
+	}
+	for _, tt := range tests {
+		line, rest := cutSendAtLine(tt.in)
+		if line != tt.line || rest != tt.rest {
+			t.Errorf("cutSendAtLine(%q) = %q, %q, want %q, %q", tt.in, line, rest, tt.line, tt.rest)
+		}
+	}
+
+}
+
+func TestParseSendAt(t *testing.T) {
+
+	now := time.Date(2026, 10, 14, 10, 30, 0, 0, time.UTC)
+	if at, rest, err := parseSendAt("/sendat 15:00\nHi", now); err != nil || rest != "Hi" || !at.Equal(time.Date(2026, 10, 14, 15, 0, 0, 0, time.UTC)) {
+		t.Errorf("parseSendAt = %s, %q, %v", at, rest, err)
+	}
+	if _, _, err := parseSendAt("/sendat soon\nHi", now); err == nil {
+		t.Error("parseSendAt accepted an unknown time")
+	}
+	if _, _, err := parseSendAt("/sendat 2026-10-14 09:00\nHi", now); err == nil {
+		t.Error("parseSendAt accepted a time in the past")
+	}
+	if at, rest, err := parseSendAt("Hi", now); err != nil || rest != "Hi" || !at.IsZero() {
+		t.Errorf("parseSendAt without a time = %s, %q, %v", at, rest, err)
+	}
+
+}
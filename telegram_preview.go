@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// Email composed in draft mode, keyed by the Telegram message it was written in.
+// Edits of that message update the preview and the draft saved in IMAP.
+
+type EmailPreview struct {
+	Mid     int
+	Tid     int
+	Uid     int
+	From    string
+	To      string
+	Subject string
+	Message string
+	Files   []struct{ Url, Name string }
+
+	previewMID int
+	draftID    string
+}
+
+const maxPreviewText = 3000
+
+// Escaped email text, cut to fit a Telegram message
+
+func previewText(text string) string {
+
+	body := []rune(text)
+	if len(body) > maxPreviewText {
+		body = append(body[:maxPreviewText], '…')
+	}
+
+	return html.EscapeString(string(body))
+}
+
+// Reply and new message handlers of draft mode, they store the preview instead of sending
+
+func (tb *TelegramBot) previewReply(mid int, preview func(p *EmailPreview)) func(uid, tid int, message string, files []struct{ Url, Name string }) {
+
+	return func(uid, tid int, message string, files []struct{ Url, Name string }) {
+		preview(tb.storePreview(EmailPreview{Mid: mid, Tid: tid, Uid: uid, Message: message, Files: files}))
+	}
+}
+
+func (tb *TelegramBot) previewNew(mid int, tid int, preview func(p *EmailPreview)) func(from string, to string, title string, message string, files []struct{ Url, Name string }) {
+
+	return func(from string, to string, title string, message string, files []struct{ Url, Name string }) {
+		preview(tb.storePreview(EmailPreview{Mid: mid, Tid: tid, From: from, To: to, Subject: title, Message: message, Files: files}))
+	}
+}
+
+func (tb *TelegramBot) storePreview(p EmailPreview) *EmailPreview {
+
+	tb.draftsMu.Lock()
+	defer tb.draftsMu.Unlock()
+	if old, ok := tb.previews[p.Mid]; ok {
+		p.previewMID, p.draftID = old.previewMID, old.draftID
+	}
+	tb.previews[p.Mid] = &p
+
+	return &p
+}
+
+func (tb *TelegramBot) hasPreview(mid int) bool {
+
+	tb.draftsMu.Lock()
+	defer tb.draftsMu.Unlock()
+	_, ok := tb.previews[mid]
+
+	return ok
+}
+
+// Message-ID of the draft saved in IMAP, returns the previous one to delete
+
+func (tb *TelegramBot) SetPreviewDraft(mid int, draftID string) string {
+
+	tb.draftsMu.Lock()
+	defer tb.draftsMu.Unlock()
+	p, ok := tb.previews[mid]
+	if !ok {
+		return ""
+	}
+	old := p.draftID
+	p.draftID = draftID
+
+	return old
+}
+
+func (tb *TelegramBot) ShowPreview(mid int, out *OutgoingEmail) error {
+
+	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Cyan("Showing email draft for message %d").String(), mid)
+	if tb.api == nil {
+		return errors.New("telego API is not initialized in ShowPreview")
+	}
+	if tb.ctx == nil {
+		tb.ctx = context.Background()
+	}
+	tb.draftsMu.Lock()
+	p, ok := tb.previews[mid]
+	var previewMID, tid int
+	if ok {
+		previewMID, tid = p.previewMID, p.Tid
+	}
+	tb.draftsMu.Unlock()
+	if !ok {
+		return fmt.Errorf("no draft for message %d", mid)
+	}
+
+	text := "📝 <b>EMAIL DRAFT</b>\n\n" +
+		"<b>From:</b> " + html.EscapeString(decodeHeaderValue(out.From)) + "\n" +
+		"<b>To:</b> " + html.EscapeString(strings.Join(out.To, ", ")) + "\n" +
+		"<b>Subject:</b> " + html.EscapeString(out.Subject) + "\n"
+	if !out.SendAt.IsZero() {
+		text += "<b>Send at:</b> " + tb.formatTime(out.SendAt) + "\n"
+	}
+	text += "\n<blockquote expandable>" + previewText(out.Text) + "</blockquote>"
+	if len(out.Files) > 0 {
+		text += "\n📎 " + html.EscapeString(strings.Join(out.Files, ", "))
+	}
+	text += "\n\n<i>Edit your message to update the draft.</i>"
+	arg := strconv.Itoa(mid)
+	markup := tu.InlineKeyboard(tu.InlineKeyboardRow(
+		telego.InlineKeyboardButton{Text: "📤 SEND", CallbackData: "outsend:" + arg},
+		telego.InlineKeyboardButton{Text: "✏️ EDIT", CallbackData: "outedit:" + arg},
+		telego.InlineKeyboardButton{Text: "🗑 CANCEL", CallbackData: "outcancel:" + arg},
+	))
+
+	// Edit the shown preview, or post a new one under the message
+
+	if previewMID != 0 {
+		e := tu.EditMessageText(tu.ID(tb.recipientId), previewMID, text)
+		e.ParseMode = telego.ModeHTML
+		e.ReplyMarkup = markup
+		if _, err := tb.api.EditMessageText(tb.ctx, e); err != nil && !strings.Contains(err.Error(), "message is not modified") {
+			return fmt.Errorf("failed to edit email draft with Telego: %w", err)
+		}
+		return nil
+	}
+	m := tu.Message(tu.ID(tb.recipientId), text)
+	m.ParseMode = telego.ModeHTML
+	m.MessageThreadID = tid
+	m.ReplyParameters = &telego.ReplyParameters{MessageID: mid, AllowSendingWithoutReply: true}
+	m.ReplyMarkup = markup
+	sent, err := tb.api.SendMessage(tb.ctx, m)
+	if err != nil {
+		return fmt.Errorf("failed to send email draft with Telego: %w", err)
+	}
+	tb.draftsMu.Lock()
+	if p, ok := tb.previews[mid]; ok {
+		p.previewMID = sent.MessageID
+	}
+	tb.draftsMu.Unlock()
+
+	log.Println(au.Gray(12, "[TELEGRAM]").String() + " " + au.Green("Email draft shown successfully").String())
+	return nil
+}
+
+func (tb *TelegramBot) handlePreviewAction(msg *telego.Message, action string, arg string, callbacks TelegramCallbacks) {
+
+	mid, err := strconv.Atoi(arg)
+	if err != nil {
+		return
+	}
+	tb.draftsMu.Lock()
+	p, ok := tb.previews[mid]
+	if ok && action != "outedit" {
+		delete(tb.previews, mid)
+	}
+	tb.draftsMu.Unlock()
+	if !ok {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Yellow("Email draft for message %d not found").String(), mid)
+		tb.editMessage(msg.MessageID, "⌛️ <b>DRAFT EXPIRED</b>")
+		return
+	}
+
+	switch action {
+	case "outsend":
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Magenta("Sending email draft of message %d").String(), mid)
+		tb.editMessage(msg.MessageID, tb.sentLabel("EMAIL")+"\n\n"+p.Message)
+		callbacks.PreviewAction(p, true)
+	case "outedit":
+		tb.sendMessage(p.Tid, "✏️ Edit your message in Telegram, the draft follows every edit. It is also saved in your Drafts folder to finish on desktop.", "", "")
+	case "outcancel":
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Cancelling email draft of message %d").String(), mid)
+		tb.editMessage(msg.MessageID, "🗑 <b>DRAFT CANCELLED</b>")
+		callbacks.PreviewAction(p, false)
+	}
+
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// Current time in the configured time zone, send times are read in it
+
+func (tb *TelegramBot) now() time.Time {
+
+	if tb.timeZone == nil {
+		return time.Now()
+	}
+
+	return time.Now().In(tb.timeZone)
+}
+
+func (tb *TelegramBot) formatTime(t time.Time) string {
+
+	if tb.timeZone != nil {
+		t = t.In(tb.timeZone)
+	}
+
+	return t.Format("Mon, 2 Jan 2006 15:04")
+}
+
+func (tb *TelegramBot) ShowScheduled(tid int, e *ScheduledEmail) error {
+
+	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Cyan("Showing scheduled email %s").String(), e.ID)
+	text := "🕒 <b>SCHEDULED FOR " + strings.ToUpper(tb.formatTime(e.Out.SendAt)) + "</b>\n\n" +
+		"<b>To:</b> " + html.EscapeString(strings.Join(e.Out.To, ", ")) + "\n" +
+		"<b>Subject:</b> " + html.EscapeString(e.Out.Subject)
+
+	return tb.sendMessage(tid, text, "", "", tu.InlineKeyboardRow(
+		telego.InlineKeyboardButton{Text: "🗑 CANCEL", CallbackData: "unschedule:" + e.ID},
+	))
+}
+
+// Pending emails with a cancel button for each
+
+func (tb *TelegramBot) SendScheduledList(tid int, list []*ScheduledEmail) error {
+
+	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Cyan("Sending list of %d scheduled emails").String(), len(list))
+	if len(list) == 0 {
+		return tb.sendMessage(tid, "🕒 No scheduled emails.", "", "")
+	}
+	text := "🕒 <b>SCHEDULED EMAILS</b>\n"
+	var rows [][]telego.InlineKeyboardButton
+	for i, e := range list {
+		text += fmt.Sprintf("\n%d. <b>%s</b>\n%s — %s\n", i+1, html.EscapeString(tb.formatTime(e.Out.SendAt)),
+			html.EscapeString(strings.Join(e.Out.To, ", ")), html.EscapeString(e.Out.Subject))
+		rows = append(rows, tu.InlineKeyboardRow(
+			telego.InlineKeyboardButton{Text: fmt.Sprintf("🗑 CANCEL %d", i+1), CallbackData: "unschedule:" + e.ID},
+		))
+	}
+
+	return tb.sendMessage(tid, text, "", "", rows...)
+}
+
+func (tb *TelegramBot) ShowScheduledSent(e *ScheduledEmail, err error, retry time.Time) {
+
+	to := html.EscapeString(strings.Join(e.Out.To, ", "))
+	if err != nil && !retry.IsZero() {
+		tb.sendMessage(e.Tid, "⚠️ <b>SCHEDULED EMAIL NOT SENT YET</b>\n\n<b>To:</b> "+to+"\n<b>Subject:</b> "+html.EscapeString(e.Out.Subject)+
+			"\n"+html.EscapeString(err.Error())+"\n\nNext attempt at "+html.EscapeString(tb.formatTime(retry)), "", "", tu.InlineKeyboardRow(
+			telego.InlineKeyboardButton{Text: "🗑 CANCEL", CallbackData: "unschedule:" + e.ID},
+		))
+		return
+	}
+	if err != nil {
+		tb.sendMessage(e.Tid, "❌ <b>FAILED TO SEND SCHEDULED EMAIL</b>\n\n<b>To:</b> "+to+"\n<b>Subject:</b> "+html.EscapeString(e.Out.Subject)+
+			"\n"+html.EscapeString(err.Error())+"\n\n<blockquote expandable>"+previewText(e.Out.Text)+"</blockquote>", "", "")
+		return
+	}
+	tb.sendMessage(e.Tid, "📤 <b>SCHEDULED EMAIL SENT</b>\n\n<b>To:</b> "+to+"\n<b>Subject:</b> "+html.EscapeString(e.Out.Subject), "", "")
+
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	telehtml "github.com/svanichkin/TelegramHTML"
+)
+
+// Snooze presets, the picker shows them in this order
+
+var snoozePresets = []struct{ Key, Label, When string }{
+	{"1h", "1 HOUR", "in 1 hour"},
+	{"tonight", "TONIGHT", "tonight"},
+	{"tomorrow", "TOMORROW", "tomorrow"},
+	{"nextweek", "NEXT WEEK", "next week"},
+}
+
+func snoozeTime(preset string, now time.Time) (time.Time, bool) {
+
+	for _, p := range snoozePresets {
+		if p.Key != preset {
+			continue
+		}
+		t, ok := parseWhen(p.When, now, true)
+		if ok && !t.After(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, ok
+	}
+
+	return time.Time{}, false
+}
+
+// Preset buttons under the email message, mid is the message the reminder will reply to
+
+func (tb *TelegramBot) showSnoozePicker(msg *telego.Message, uid int) {
+
+	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Showing snooze options for message UID %d").String(), uid)
+	var row []telego.InlineKeyboardButton
+	for _, p := range snoozePresets {
+		row = append(row, telego.InlineKeyboardButton{Text: p.Label, CallbackData: fmt.Sprintf("snoozeat:%d:%d:%s", uid, msg.MessageID, p.Key)})
+	}
+	m := tu.Message(tu.ID(tb.recipientId), "⏰ <b>SNOOZE UNTIL…</b>")
+	m.ParseMode = telego.ModeHTML
+	m.MessageThreadID = msg.MessageThreadID
+	m.ReplyParameters = &telego.ReplyParameters{MessageID: msg.MessageID, AllowSendingWithoutReply: true}
+	m.ReplyMarkup = tu.InlineKeyboard(row, tu.InlineKeyboardRow(telego.InlineKeyboardButton{Text: "✖️ CLOSE", CallbackData: "close"}))
+	if _, err := tb.api.SendMessage(tb.ctx, m); err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error sending snooze options: %v").String(), err)
+	}
+
+}
+
+func (tb *TelegramBot) handleSnoozeAction(msg *telego.Message, action string, arg string, callbacks TelegramCallbacks) {
+
+	switch action {
+	case "snooze":
+		uid, err := tb.callbackUid(arg)
+		if err != nil {
+			return
+		}
+		tb.showSnoozePicker(msg, uid)
+	case "snoozeat":
+		parts := strings.SplitN(arg, ":", 3)
+		if len(parts) != 3 {
+			return
+		}
+		uid, err := tb.callbackUid(parts[0])
+		if err != nil {
+			return
+		}
+		mid, _ := strconv.Atoi(parts[1])
+		until, ok := snoozeTime(parts[2], tb.now())
+		if !ok {
+			return
+		}
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Processing snooze of message UID %d until %s").String(), uid, until)
+		callbacks.Snooze(uid, msg.MessageThreadID, mid, msg.MessageID, until)
+	}
+
+}
+
+func (tb *TelegramBot) ShowSnoozed(picker int, sn *Snooze, err error) {
+
+	if err != nil {
+		tb.editMessage(picker, "❌ <b>FAILED TO SNOOZE</b>\n\n"+html.EscapeString(err.Error()))
+		return
+	}
+	text := "⏰ <b>SNOOZED UNTIL " + strings.ToUpper(tb.formatTime(sn.Until)) + "</b>"
+	if sn.Folder != "" {
+		text += "\n\nMoved to " + html.EscapeString(sn.Folder) + " meanwhile."
+		tb.ForgetMail(sn.Uid)
+	}
+	tb.editMessage(picker, text)
+
+}
+
+// Reminder replying to the original Telegram message, uid is the email's current UID in INBOX
+
+func (tb *TelegramBot) SendSnoozeReminder(sn *Snooze, uid int) error {
+
+	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Magenta("Sending snooze reminder for email UID %d").String(), uid)
+	if tb.api == nil {
+		return errors.New("telego API is not initialized in SendSnoozeReminder")
+	}
+	if tb.ctx == nil {
+		tb.ctx = context.Background()
+	}
+	if uid != sn.Uid {
+		tb.replaceUid(sn.Tid, sn.Uid, uid)
+	}
+	text := "⏰ <b>REMINDER</b>\n\n<b>" + html.EscapeString(sn.Subject) + "</b>\n" + html.EscapeString(sn.From) + telehtml.EncodeIntInvisible(uid)
+	m := tu.Message(tu.ID(tb.recipientId), text)
+	m.ParseMode = telego.ModeHTML
+	m.MessageThreadID = sn.Tid
+	m.ReplyParameters = &telego.ReplyParameters{MessageID: sn.Mid, AllowSendingWithoutReply: true}
+	m.ReplyMarkup = tu.InlineKeyboard(append([][]telego.InlineKeyboardButton{
+		tu.InlineKeyboardRow(telego.InlineKeyboardButton{Text: "🧾 EXPAND", CallbackData: fmt.Sprintf("expand:%d", uid)}),
+	}, mailboxRows(uid)...)...)
+	sent, err := tb.api.SendMessage(tb.ctx, m)
+	if err != nil {
+		return fmt.Errorf("failed to send snooze reminder with Telego: %w", err)
+	}
+	tb.trackMail(uid, sent, text, nil)
+
+	return nil
+}
+
+// The email got a new UID after a move, replies to its old messages and in its topic must use it
+
+func (tb *TelegramBot) replaceUid(tid int, oldUid int, newUid int) {
+
+	rid := fmt.Sprint(tb.recipientId)
+	t, old, cur := fmt.Sprint(tid), fmt.Sprint(oldUid), fmt.Sprint(newUid)
+	tb.topicsMu.Lock()
+	defer tb.topicsMu.Unlock()
+	tb.moved[old] = cur
+	if err := EncryptAndSave(rid, rid+".mov", tb.moved); err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Yellow("Failed to save moved uids: %v").String(), err)
+	}
+	if tid == 0 {
+		return
+	}
+	if tb.uids[t] == old {
+		tb.uids[t] = cur
+		if err := EncryptAndSave(rid, rid+".uis", tb.uids); err != nil {
+			log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Yellow("Failed to save uids: %v").String(), err)
+		}
+	}
+	if list := tb.threads[t]; list != "" {
+		uids := strings.Split(list, ",")
+		for i, u := range uids {
+			if u == old {
+				uids[i] = cur
+			}
+		}
+		tb.threads[t] = strings.Join(uids, ",")
+		if err := EncryptAndSave(rid, rid+".thr", tb.threads); err != nil {
+			log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Yellow("Failed to save threads: %v").String(), err)
+		}
+	}
+
+}
+
+// Current UID of an email, following its moves out of and back into INBOX
+
+func (tb *TelegramBot) currentUid(uid int) int {
+
+	tb.topicsMu.Lock()
+	defer tb.topicsMu.Unlock()
+	for range len(tb.moved) {
+		cur, ok := tb.moved[fmt.Sprint(uid)]
+		if !ok {
+			break
+		}
+		uid, _ = strconv.Atoi(cur)
+	}
+
+	return uid
+}
+
+// UID from button data, buttons of moved emails still carry the old one
+
+func (tb *TelegramBot) callbackUid(s string) (int, error) {
+
+	uid, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+
+	return tb.currentUid(uid), nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestReplaceUid(t *testing.T) {
+
+	t.Chdir(t.TempDir())
+	tb := &TelegramBot{recipientId: 1, uids: map[string]string{"5": "10"}, threads: map[string]string{"5": "9,10"}, moved: map[string]string{}}
+
+	// Snoozed and woken twice, once outside of topics
+
+	tb.replaceUid(5, 10, 20)
+	tb.replaceUid(0, 20, 30)
+	if tb.uids["5"] != "20" || tb.threads["5"] != "9,20" {
+		t.Errorf("topic uids = %q, threads = %q", tb.uids["5"], tb.threads["5"])
+	}
+	for uid, want := range map[int]int{10: 30, 20: 30, 30: 30, 9: 9} {
+		if got := tb.currentUid(uid); got != want {
+			t.Errorf("currentUid(%d) = %d, want %d", uid, got, want)
+		}
+	}
+	if uid, err := tb.callbackUid("10"); err != nil || uid != 30 {
+		t.Errorf("callbackUid(10) = %d, %v", uid, err)
+	}
+
+	// Moves survive a restart
+
+	moved, err := LoadAndDecrypt("1", "1.mov")
+	if err != nil || moved["10"] != "20" || moved["20"] != "30" {
+		t.Errorf("stored moves = %v, %v", moved, err)
+	}
+
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// Read state of emails shown in Telegram, mirrored from IMAP flags. The text and buttons
+// are kept because edits have to resend both.
+
+const maxTrackedMails = 200
+
+// Telegram counts message text after parsing the HTML, in UTF-16 code units
+
+const maxMessageText = 4096
+
+var reHTMLTag = regexp.MustCompile(`<[^>]*>`)
+
+type mailState struct {
+	Mid     int
+	Text    string
+	Markup  *telego.InlineKeyboardMarkup
+	Earlier []mailPart `json:",omitempty"`
+	Seen    bool
+	Flagged bool
+	Gone    bool
+}
+
+// Parts of a long email before the last one, which has the buttons
+
+type mailPart struct {
+	Mid  int
+	Text string
+}
+
+func (tb *TelegramBot) trackMail(uid int, m *telego.Message, text string, earlier []mailPart) {
+
+	if m == nil {
+		return
+	}
+	tb.mailsMu.Lock()
+	defer tb.mailsMu.Unlock()
+	raw, err := json.Marshal(mailState{Mid: m.MessageID, Text: text, Markup: m.ReplyMarkup, Earlier: earlier})
+	if err != nil {
+		return
+	}
+	tb.mails[fmt.Sprint(uid)] = string(raw)
+
+	// Oldest emails drop out so the flag sync stays one short FETCH
+
+	if uids := tb.trackedUids(); len(uids) > maxTrackedMails {
+		for _, u := range uids[:len(uids)-maxTrackedMails] {
+			delete(tb.mails, fmt.Sprint(u))
+		}
+	}
+	tb.saveMails()
+
+}
+
+// The email left INBOX through the bot, its UID means nothing now
+
+func (tb *TelegramBot) ForgetMail(uid int) {
+
+	tb.mailsMu.Lock()
+	defer tb.mailsMu.Unlock()
+	if _, ok := tb.mails[fmt.Sprint(uid)]; ok {
+		delete(tb.mails, fmt.Sprint(uid))
+		tb.saveMails()
+	}
+
+}
+
+// Id and buttons of the message showing the email, nil when it is not tracked
+
+func (tb *TelegramBot) trackedMessage(uid int) *telego.Message {
+
+	tb.mailsMu.Lock()
+	defer tb.mailsMu.Unlock()
+	var st mailState
+	if err := json.Unmarshal([]byte(tb.mails[fmt.Sprint(uid)]), &st); err != nil {
+		return nil
+	}
+
+	return &telego.Message{MessageID: st.Mid, ReplyMarkup: st.Markup}
+}
+
+func (tb *TelegramBot) TrackedUids() []int {
+
+	tb.mailsMu.Lock()
+	defer tb.mailsMu.Unlock()
+
+	return tb.trackedUids()
+}
+
+func (tb *TelegramBot) trackedUids() []int {
+
+	var uids []int
+	for k := range tb.mails {
+		if uid, err := strconv.Atoi(k); err == nil {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Ints(uids)
+
+	return uids
+}
+
+// Setters return the tracked message id, 0 when the email is not tracked
+
+func (tb *TelegramBot) SetMailSeen(uid int, seen bool) int {
+
+	return tb.updateMail(uid, func(st *mailState) { st.Seen = seen })
+}
+
+func (tb *TelegramBot) SetMailFlagged(uid int, flagged bool) int {
+
+	return tb.updateMail(uid, func(st *mailState) { st.Flagged = flagged })
+}
+
+func (tb *TelegramBot) ShowMailFlags(uid int, seen bool, flagged bool) int {
+
+	return tb.updateMail(uid, func(st *mailState) { st.Seen, st.Flagged = seen, flagged })
+}
+
+// Removed from INBOX elsewhere: deleted, archived or moved by another client
+
+func (tb *TelegramBot) ShowMailGone(uid int) int {
+
+	mid := tb.updateMail(uid, func(st *mailState) { st.Gone = true })
+	tb.ForgetMail(uid)
+
+	return mid
+}
+
+func (tb *TelegramBot) updateMail(uid int, change func(st *mailState)) int {
+
+	tb.mailsMu.Lock()
+	defer tb.mailsMu.Unlock()
+	raw, ok := tb.mails[fmt.Sprint(uid)]
+	if !ok {
+		return 0
+	}
+	var st mailState
+	if err := json.Unmarshal([]byte(raw), &st); err != nil {
+		return 0
+	}
+	old := st
+	change(&st)
+	if st.Seen == old.Seen && st.Flagged == old.Flagged && st.Gone == old.Gone {
+		return st.Mid
+	}
+	log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Blue("Showing state of email UID %d: seen %t, flagged %t, gone %t").String(), uid, st.Seen, st.Flagged, st.Gone)
+	tb.renderMail(uid, &st, &old)
+	if b, err := json.Marshal(st); err == nil {
+		tb.mails[fmt.Sprint(uid)] = string(b)
+		tb.saveMails()
+	}
+
+	return st.Mid
+}
+
+// ✓ for read and ⭐ for flagged before the first part, strikethrough and status only once gone.
+// Earlier parts are edited only when their text changes, the last one always has new buttons.
+
+func (tb *TelegramBot) renderMail(uid int, st *mailState, old *mailState) {
+
+	for i, p := range st.Earlier {
+		if text := st.partText(p.Text, i == 0); text != old.partText(p.Text, i == 0) {
+			tb.editMailPart(p.Mid, text, nil)
+		}
+	}
+	var rows [][]telego.InlineKeyboardButton
+	if st.Markup != nil {
+		for _, row := range st.Markup.InlineKeyboard {
+			var r []telego.InlineKeyboardButton
+			for _, b := range row {
+				switch {
+				case st.Gone && b.URL == "":
+					continue
+				case b.CallbackData == fmt.Sprintf("read:%d", uid) || b.CallbackData == fmt.Sprintf("unread:%d", uid):
+					b = seenButton(uid, st.Seen)
+				case b.CallbackData == fmt.Sprintf("star:%d", uid) || b.CallbackData == fmt.Sprintf("unstar:%d", uid):
+					b = flagButton(uid, st.Flagged)
+				}
+				r = append(r, b)
+			}
+			if len(r) > 0 {
+				rows = append(rows, r)
+			}
+		}
+	}
+	if st.Gone {
+		rows = append(rows, tu.InlineKeyboardRow(telego.InlineKeyboardButton{Text: "🗑 REMOVED FROM INBOX", CallbackData: "noop"}))
+	}
+	var markup *telego.InlineKeyboardMarkup
+	if len(rows) > 0 {
+		markup = tu.InlineKeyboard(rows...)
+	}
+	tb.editMailPart(st.Mid, st.partText(st.Text, len(st.Earlier) == 0), markup)
+
+}
+
+// Marks are left out when they would push the text past the Telegram limit, the buttons still show the state
+
+func (st *mailState) partText(text string, first bool) string {
+
+	if st.Gone {
+		text = "<s>" + text + "</s>"
+	}
+	var marks []string
+	if st.Flagged {
+		marks = append(marks, "⭐")
+	}
+	if st.Seen {
+		marks = append(marks, "✓")
+	}
+	if first && len(marks) > 0 {
+		if marked := strings.Join(marks, " ") + " " + text; visibleLen(marked) <= maxMessageText {
+			text = marked
+		}
+	}
+
+	return text
+}
+
+func visibleLen(s string) int {
+
+	return len(utf16.Encode([]rune(html.UnescapeString(reHTMLTag.ReplaceAllString(s, "")))))
+}
+
+func (tb *TelegramBot) editMailPart(mid int, text string, markup *telego.InlineKeyboardMarkup) {
+
+	p := tu.EditMessageText(tu.ID(tb.recipientId), mid, text)
+	p.ParseMode = telego.ModeHTML
+	p.LinkPreviewOptions = &telego.LinkPreviewOptions{IsDisabled: true}
+	p.ReplyMarkup = markup
+	if _, err := tb.api.EditMessageText(tb.ctx, p); err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Red("Error editing message %d: %v").String(), mid, err)
+	}
+
+}
+
+func (tb *TelegramBot) saveMails() {
+
+	rid := fmt.Sprint(tb.recipientId)
+	if err := EncryptAndSave(rid, rid+".sta", tb.mails); err != nil {
+		log.Printf(au.Gray(12, "[TELEGRAM]").String()+" "+au.Yellow("Failed to save mail states: %v").String(), err)
+	}
+
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMailPartText(t *testing.T) {
+
+	st := &mailState{Seen: true, Flagged: true}
+	if got := st.partText("<b>Hi</b> &amp; bye", true); got != "⭐ ✓ <b>Hi</b> &amp; bye" {
+		t.Errorf("first part = %q", got)
+	}
+	if got := st.partText("rest", false); got != "rest" {
+		t.Errorf("later part = %q", got)
+	}
+	st.Gone = true
+	if got := st.partText("rest", false); got != "<s>rest</s>" {
+		t.Errorf("gone part = %q", got)
+	}
+
+	// Markup and entities do not count, marks are dropped only past the limit
+
+	full := "<b>" + strings.Repeat("&lt;", maxMessageText-4) + "</b>"
+	if got := st.partText(full, true); !strings.HasPrefix(got, "⭐ ✓ ") {
+		t.Errorf("marks dropped from a text of %d characters", visibleLen(full))
+	}
+	over := strings.Repeat("я", maxMessageText-3)
+	if got := st.partText(over, true); got != "<s>"+over+"</s>" {
+		t.Error("marks pushed the text past the limit")
+	}
+	if n := visibleLen("😀<i>a</i>"); n != 3 {
+		t.Errorf("visibleLen(emoji) = %d, want 3", n)
+	}
+
+}